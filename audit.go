@@ -0,0 +1,227 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/autobrr/go-qbittorrent"
+	"github.com/go-chi/chi/v5/middleware"
+	bolt "go.etcd.io/bbolt"
+)
+
+/* What caused a client call: the endpoint, the rule behind it and the request id. */
+type auditTrigger struct {
+	Endpoint  string `json:",omitempty"`
+	Rule      string `json:",omitempty"`
+	RequestID string `json:",omitempty"`
+}
+
+type auditTorrent struct {
+	Hash string
+	Name string `json:",omitempty"`
+	Size int64  `json:",omitempty"`
+}
+
+type auditEntry struct {
+	Time     time.Time
+	Action   string
+	Host     string
+	Detail   string `json:",omitempty"`
+	Torrents []auditTorrent
+	Error    string `json:",omitempty"`
+	auditTrigger
+}
+
+/* Attaches the request's logger and audit trigger, called by every handler after decoding. */
+func (c *upgradereq) bind(r *http.Request) {
+	c.log = requestLog(r)
+	c.trigger = auditTrigger{Endpoint: r.URL.Path, RequestID: middleware.GetReqID(r.Context())}
+}
+
+/* Names and sizes come from the cached torrent list, the audit never triggers a fetch of its own. */
+func (c *upgradereq) auditTorrents(hashes []string) []auditTorrent {
+	res := make([]auditTorrent, 0, len(hashes))
+	mp, _ := torrentmap.Get(qbittorrent.Config{Host: c.Host, Username: c.User, Password: c.Password})
+	for _, h := range hashes {
+		var t qbittorrent.Torrent
+		if mp != nil {
+			t, _ = mp.torrent(h)
+		}
+
+		res = append(res, auditTorrent{Hash: h, Name: t.Name, Size: t.Size})
+	}
+
+	return res
+}
+
+/* Deferred by the mutating client wrappers: defer c.audit("delete", "", hashes, &err). */
+func (c *upgradereq) audit(action, detail string, hashes []string, err *error) {
+	e := auditEntry{
+		Time:         globalTime.Now().UTC(),
+		Action:       action,
+		Host:         c.Host,
+		Detail:       detail,
+		Torrents:     c.auditTorrents(hashes),
+		auditTrigger: c.trigger,
+	}
+
+	if *err != nil {
+		e.Error = (*err).Error()
+	}
+
+	if err := recordAudit(e); err != nil {
+		c.logger().Error("Unable to record audit entry", "action", action, "count", len(hashes), "error", err)
+	}
+}
+
+/* Keys are the big-endian nanosecond stamp followed by the bucket sequence, so they sort by time. */
+func recordAudit(e auditEntry) error {
+	if db == nil {
+		return fmt.Errorf("no database")
+	}
+
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("audit"))
+		if err != nil {
+			return err
+		}
+
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		key := binary.BigEndian.AppendUint64(nil, uint64(e.Time.UnixNano()))
+		return b.Put(binary.BigEndian.AppendUint64(key, seq), buf)
+	})
+}
+
+/* Accepts RFC3339 or unix seconds. */
+func parseAuditTime(s string) (time.Time, error) {
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(n, 0), nil
+	}
+
+	return time.Parse(time.RFC3339, s)
+}
+
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	q := r.URL.Query()
+	from, to := time.Unix(0, 0), globalTime.Now().Add(time.Hour)
+	var err error
+	if v := q.Get("from"); len(v) != 0 {
+		if from, err = parseAuditTime(v); err != nil {
+			http.Error(w, fmt.Sprintf("Bad from %q: %q\n", v, err), 469)
+			return
+		}
+	}
+
+	if v := q.Get("to"); len(v) != 0 {
+		if to, err = parseAuditTime(v); err != nil {
+			http.Error(w, fmt.Sprintf("Bad to %q: %q\n", v, err), 469)
+			return
+		}
+	}
+
+	limit := 1000
+	if v := q.Get("limit"); len(v) != 0 {
+		if limit, err = strconv.Atoi(v); err != nil || limit <= 0 {
+			http.Error(w, fmt.Sprintf("Bad limit %q\n", v), 469)
+			return
+		}
+	}
+
+	actions := make(map[string]struct{})
+	for _, a := range q["action"] {
+		for _, s := range strings.Split(a, ",") {
+			actions[Normalize(s)] = struct{}{}
+		}
+	}
+
+	hash := strings.ToLower(q.Get("hash"))
+	entries := make([]auditEntry, 0)
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("audit"))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		end := uint64(to.UnixNano())
+		for k, v := c.Seek(binary.BigEndian.AppendUint64(nil, uint64(max(from.UnixNano(), 0)))); k != nil && len(entries) < limit; k, v = c.Next() {
+			if len(k) < 8 || binary.BigEndian.Uint64(k) > end {
+				break
+			}
+
+			var e auditEntry
+			if err := json.Unmarshal(v, &e); err != nil {
+				slog.Warn("Skipping unreadable audit entry", "error", err)
+				continue
+			}
+
+			if _, ok := actions[e.Action]; len(actions) != 0 && !ok {
+				continue
+			}
+
+			if len(hash) != 0 && !e.touches(hash) {
+				continue
+			}
+
+			entries = append(entries, e)
+		}
+
+		return nil
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read audit log: %q\n", err), 467)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		http.Error(w, err.Error(), 466)
+	}
+}
+
+func (e auditEntry) touches(hash string) bool {
+	for _, t := range e.Torrents {
+		if strings.ToLower(t.Hash) == hash {
+			return true
+		}
+	}
+
+	return false
+}
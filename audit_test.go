@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAuditLog(t *testing.T) {
+	saved := db
+	t.Cleanup(func() { db = saved })
+
+	db = openFixture(t, nil)
+	if _, err := migrateDatabase(db); err != nil {
+		t.Fatalf("migrate: %q", err)
+	}
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, e := range []auditEntry{
+		{Action: "pause", Torrents: []auditTorrent{{Hash: "aaaa"}}},
+		{Action: "deletedata", Torrents: []auditTorrent{{Hash: "bbbb"}}, auditTrigger: auditTrigger{Endpoint: "/api/expression", Rule: "Size > 0"}},
+		{Action: "delete", Torrents: []auditTorrent{{Hash: "AAAA"}}},
+		{Action: "deletedata", Torrents: []auditTorrent{{Hash: "cccc"}}},
+	} {
+		e.Time = base.Add(time.Duration(i) * time.Hour)
+		if err := recordAudit(e); err != nil {
+			t.Fatalf("record: %q", err)
+		}
+	}
+
+	/* The same instant twice must not overwrite. */
+	if err := recordAudit(auditEntry{Time: base, Action: "resume"}); err != nil {
+		t.Fatalf("record: %q", err)
+	}
+
+	var failed error = errors.New("boom")
+	c := upgradereq{}
+	c.Host = "http://qbit"
+	c.audit("recheck", "", []string{"dddd"}, &failed)
+
+	for _, tc := range []struct {
+		query string
+		want  []string
+	}{
+		{"", []string{"pause", "resume", "deletedata", "delete", "deletedata", "recheck"}},
+		{"?action=deletedata", []string{"deletedata", "deletedata"}},
+		{"?action=pause,delete", []string{"pause", "delete"}},
+		{"?from=" + base.Add(time.Hour).Format(time.RFC3339) + "&to=" + base.Add(2*time.Hour).Format(time.RFC3339), []string{"deletedata", "delete"}},
+		{"?hash=aaaa", []string{"pause", "delete"}},
+		{"?limit=2", []string{"pause", "resume"}},
+	} {
+		w := httptest.NewRecorder()
+		handleAudit(w, httptest.NewRequest("GET", "/api/audit"+tc.query, nil))
+		if w.Code != 200 {
+			t.Fatalf("%q: code %d: %s", tc.query, w.Code, w.Body)
+		}
+
+		var got []auditEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%q: %q", tc.query, err)
+		}
+
+		if len(got) != len(tc.want) {
+			t.Fatalf("%q: got %d entries, want %d", tc.query, len(got), len(tc.want))
+		}
+
+		for i, e := range got {
+			if e.Action != tc.want[i] {
+				t.Fatalf("%q: entry %d is %q, want %q", tc.query, i, e.Action, tc.want[i])
+			}
+		}
+
+		if len(tc.query) == 0 {
+			if got[2].Rule != "Size > 0" || got[2].Endpoint != "/api/expression" {
+				t.Fatalf("rule not recorded")
+			}
+
+			if last := got[len(got)-1]; last.Error != "boom" || last.Host != "http://qbit" || last.Torrents[0].Hash != "dddd" {
+				t.Fatalf("audit entry not recorded: %+v", last)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	handleAudit(w, httptest.NewRequest("GET", "/api/audit?from=yesterday", nil))
+	if w.Code != 469 {
+		t.Fatalf("bad from accepted: %d", w.Code)
+	}
+}
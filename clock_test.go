@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/autobrr/go-qbittorrent"
+	"github.com/titlerr/upgraderr/pkg/timecache"
+	bolt "go.etcd.io/bbolt"
+)
+
+func fakeTime(t *testing.T, now time.Time) *timecache.FakeClock {
+	t.Helper()
+	saved := globalTime
+	t.Cleanup(func() { globalTime = saved })
+
+	clock := timecache.NewFakeClock(now)
+	globalTime = timecache.New(timecache.Options{}.Clock(clock))
+	return clock
+}
+
+func TestCleanAged(t *testing.T) {
+	clock := fakeTime(t, time.Unix(1700000000, 0))
+	done := qbittorrent.Torrent{CompletionOn: 1700000000}
+	if cleanAged(done) || cleanAged(qbittorrent.Torrent{}) {
+		t.Fatalf("fresh or incomplete torrent aged")
+	}
+
+	clock.Advance(14*24*time.Hour - 2*time.Second)
+	if cleanAged(done) {
+		t.Fatalf("aged a day early")
+	}
+
+	clock.Advance(2 * time.Second)
+	if !cleanAged(done) {
+		t.Fatalf("not aged after two weeks")
+	}
+}
+
+func TestQueryStamped(t *testing.T) {
+	clock := fakeTime(t, time.Unix(1700000000, 0))
+	d := openFixture(t, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("queries"))
+		if err != nil {
+			return err
+		}
+
+		ib, err := b.CreateBucket([]byte("someindexer"))
+		if err != nil {
+			return err
+		}
+
+		return ib.Put([]byte("cat=5000&q=show+name&t=tvsearch"), stamp(1700000000))
+	})
+
+	stamped := func(backend, key string) (ok bool) {
+		d.View(func(tx *bolt.Tx) error {
+			ok = queryStamped(tx, backend, key, 3600)
+			return nil
+		})
+
+		return ok
+	}
+
+	if !stamped("someindexer", "cat=5000&q=show+name&t=tvsearch") {
+		t.Fatalf("fresh stamp ignored")
+	}
+
+	if stamped("otherindexer", "cat=5000&q=show+name&t=tvsearch") || stamped("someindexer", "q=other") {
+		t.Fatalf("stamp leaked")
+	}
+
+	clock.Advance(time.Hour)
+	if stamped("someindexer", "cat=5000&q=show+name&t=tvsearch") {
+		t.Fatalf("stale stamp honoured")
+	}
+}
@@ -0,0 +1,423 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+type upgraderrConfig struct {
+	Unregistered unregisteredConfig
+	Search       searchConfig
+	RSS          rssConfig
+	Database     databaseConfig
+	Log          logConfig
+	Quarantine   quarantineConfig
+}
+
+/* When enabled, deletedata moves torrents under Path instead, marked with Category and Tag, and purges them once Grace has passed. */
+type quarantineConfig struct {
+	Enabled  bool
+	Path     string
+	Category string
+	Tag      string
+	Grace    duration
+}
+
+/* Level is debug, info, warn or error. Format is text or json. */
+type logConfig struct {
+	Level  string
+	Format string
+}
+
+/* Path overrides the /config, ./ and /tmp fallbacks. Retention is keyed by bucket name and applies per indexer, or to the whole of hits and ids. */
+type databaseConfig struct {
+	Path      string
+	Compact   bool
+	Caches    bool
+	Interval  duration
+	Retention map[string]retentionRule
+}
+
+/* Zero disables a limit. */
+type retentionRule struct {
+	MaxAge     duration
+	MaxEntries uint
+}
+
+/* Feeds are polled in the background and matches injected into the qBittorrent at Host. */
+type rssConfig struct {
+	Interval duration
+	Host     string
+	User     string
+	Password string
+	Feeds    []rssFeed
+}
+
+/* Torznab feeds are queried with an empty search, anything else is fetched as is. Indexer names the buckets, health and limits. */
+type rssFeed struct {
+	Indexer  string
+	URL      string
+	APIKey   string
+	Torznab  bool
+	Interval duration
+}
+
+/* Accepts either a Go duration string ("90s", "12h") or a number of seconds. */
+type duration time.Duration
+
+type searchConfig struct {
+	RequestsPerMinute float64
+	Concurrency       uint
+	FailureThreshold  uint
+	BackoffBase       duration
+	BackoffMax        duration
+	QueryTTL          duration
+	AgeTTLs           []ageTTL
+	RetryInterval     duration
+	Indexers          map[string]indexerConfig
+}
+
+/* Releases completed within MaxAge are re-searched once TTL has passed. */
+type ageTTL struct {
+	MaxAge duration
+	TTL    duration
+}
+
+/* Zero values fall back to the search defaults, indexers sharing a Backend share their query stamps. */
+type indexerConfig struct {
+	RequestsPerMinute float64
+	Concurrency       uint
+	QueryTTL          duration
+	Backend           string
+}
+
+type unregisteredConfig struct {
+	Patterns          []string
+	Allowlist         []string
+	Observations      uint
+	Trackers          map[string]unregisteredRule
+	Workers           uint
+	RequestsPerSecond float64
+
+	patterns  []pattern
+	allowlist []pattern
+}
+
+/* Per tracker host overrides, Patterns replace the global list while Allowlist is added to it. */
+type unregisteredRule struct {
+	Patterns     []string
+	Allowlist    []string
+	Observations uint
+
+	patterns  []pattern
+	allowlist []pattern
+}
+
+var config = defaultConfig()
+
+func defaultConfig() *upgraderrConfig {
+	return &upgraderrConfig{
+		Unregistered: unregisteredConfig{
+			Patterns: []string{
+				"unregistered",
+				"not registered",
+				"not found",
+				"not exist",
+				"unknown",
+				"uploaded",
+				"upgraded",
+				"season pack",
+				"packs are available",
+				"pack is available",
+				"internal available",
+				"season pack out",
+				"dead",
+				"dupe",
+				"complete season uploaded",
+				"problem with",
+				"specifically banned",
+				"trumped",
+				"i'm sorry dave, i can't do that", // weird stuff from racingforme
+			},
+			Observations:      1,
+			Workers:           8,
+			RequestsPerSecond: 50,
+		},
+		Search: searchConfig{
+			RequestsPerMinute: 30,
+			Concurrency:       2,
+			FailureThreshold:  3,
+			BackoffBase:       duration(time.Minute * 5),
+			BackoffMax:        duration(time.Hour * 24),
+			QueryTTL:          duration(time.Second * 720),
+			RetryInterval:     duration(time.Hour * 24),
+		},
+		RSS: rssConfig{
+			Interval: duration(time.Minute * 15),
+		},
+		Log: logConfig{
+			Level:  "info",
+			Format: "text",
+		},
+		Quarantine: quarantineConfig{
+			Category: "upgraderr-quarantine",
+			Tag:      "upgraderr-quarantine",
+			Grace:    duration(time.Hour * 24 * 7),
+		},
+		Database: databaseConfig{
+			Compact:  true,
+			Caches:   true,
+			Interval: duration(time.Hour * 24),
+			Retention: map[string]retentionRule{
+				"torrents":   {MaxAge: duration(time.Hour * 24 * 30), MaxEntries: 1000},
+				"enclosures": {MaxAge: duration(time.Hour * 24 * 90)},
+				"titles":     {MaxAge: duration(time.Hour * 24 * 90)},
+				"queries":    {MaxAge: duration(time.Hour * 24 * 30)},
+				"attempts":   {MaxAge: duration(time.Hour * 24 * 7)},
+				"hits":       {MaxAge: duration(time.Hour * 24 * 90)},
+			},
+		},
+	}
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var v any
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	switch t := v.(type) {
+	case float64:
+		*d = duration(time.Duration(t * float64(time.Second)))
+	case string:
+		p, err := time.ParseDuration(t)
+		if err != nil {
+			return err
+		}
+
+		*d = duration(p)
+	default:
+		return fmt.Errorf("invalid duration %s", b)
+	}
+
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (s *searchConfig) indexer(id string) indexerConfig {
+	ic := s.Indexers[id]
+	if ic.RequestsPerMinute == 0 {
+		ic.RequestsPerMinute = s.RequestsPerMinute
+	}
+
+	if ic.Concurrency == 0 {
+		ic.Concurrency = s.Concurrency
+	}
+
+	if len(ic.Backend) == 0 {
+		ic.Backend = id
+	}
+
+	return ic
+}
+
+/* Results that failed to inject are tried again once RetryInterval has passed since the last attempt, never without one. */
+func (s *searchConfig) retryDue(attempted, nt int64) bool {
+	return s.RetryInterval != 0 && nt-int64(time.Duration(s.RetryInterval)/time.Second) >= attempted
+}
+
+/* The indexer's own TTL overrides everything, otherwise the first age rule covering the release wins. */
+func (s *searchConfig) queryTTL(ic indexerConfig, age time.Duration) time.Duration {
+	if ic.QueryTTL != 0 {
+		return time.Duration(ic.QueryTTL)
+	}
+
+	ttl := time.Duration(s.QueryTTL)
+	for _, a := range s.AgeTTLs {
+		if age <= time.Duration(a.MaxAge) {
+			ttl = time.Duration(a.TTL)
+			break
+		}
+	}
+
+	return ttl
+}
+
+/* A configuration that does not parse or compile stops startup, falling back to defaults would bring back patterns it removed. */
+func initConfig() {
+	paths := []string{"/config/upgraderr.json", "upgraderr.json"}
+	if p := os.Getenv("UPGRADERR_CONFIG"); len(p) != 0 {
+		paths = []string{p}
+	}
+
+	c, err := loadConfig(paths)
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	config = c
+}
+
+/* The first path that exists is read over the defaults, none existing leaves the defaults. */
+func loadConfig(paths []string) (*upgraderrConfig, error) {
+	c := defaultConfig()
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			continue
+		}
+
+		err = json.NewDecoder(f).Decode(c)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+
+		break
+	}
+
+	if err := c.compile(); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *upgraderrConfig) compile() error {
+	var err error
+	u := &c.Unregistered
+	if u.patterns, err = compilePatterns(u.Patterns); err != nil {
+		return err
+	}
+
+	if u.allowlist, err = compilePatterns(u.Allowlist); err != nil {
+		return err
+	}
+
+	trackers := make(map[string]unregisteredRule, len(u.Trackers))
+	for host, rule := range u.Trackers {
+		if rule.patterns, err = compilePatterns(rule.Patterns); err != nil {
+			return err
+		}
+
+		if rule.allowlist, err = compilePatterns(rule.Allowlist); err != nil {
+			return err
+		}
+
+		trackers[Normalize(host)] = rule
+	}
+
+	u.Trackers = trackers
+
+	if q := c.Quarantine; q.Enabled && (len(q.Path) == 0 || len(q.Category) == 0 || len(q.Tag) == 0) {
+		return fmt.Errorf("quarantine needs a path, category and tag")
+	}
+
+	sort.SliceStable(c.Search.AgeTTLs, func(i, j int) bool {
+		return c.Search.AgeTTLs[i].MaxAge < c.Search.AgeTTLs[j].MaxAge
+	})
+
+	return nil
+}
+
+/* A tracker message pattern along with the text it was configured as, for reporting. */
+type pattern struct {
+	text string
+	re   *regexp.Regexp
+}
+
+/* Patterns match case-insensitively as plain substrings, a "re:" prefix makes the rest a regular expression. */
+func compilePatterns(patterns []string) ([]pattern, error) {
+	res := make([]pattern, 0, len(patterns))
+	for _, p := range patterns {
+		expr, ok := strings.CutPrefix(p, "re:")
+		if !ok {
+			expr = regexp.QuoteMeta(p)
+		}
+
+		r, err := regexp.Compile("(?i)" + expr)
+		if err != nil {
+			return nil, fmt.Errorf("bad pattern %q: %w", p, err)
+		}
+
+		res = append(res, pattern{text: p, re: r})
+	}
+
+	return res, nil
+}
+
+/* Finds the rule for a tracker host, falling back to its parent domains. */
+func (u *unregisteredConfig) rule(host string) (unregisteredRule, bool) {
+	for len(host) != 0 {
+		if r, ok := u.Trackers[host]; ok {
+			return r, true
+		}
+
+		idx := strings.IndexByte(host, '.')
+		if idx == -1 {
+			break
+		}
+
+		host = host[idx+1:]
+	}
+
+	return unregisteredRule{}, false
+}
+
+/* Returns the pattern matching an unregistered tracker message along with the observations required to act on it. */
+func (u *unregisteredConfig) match(tracker, message string) (string, uint, bool) {
+	patterns, allowlist, observations := u.patterns, u.allowlist, u.Observations
+	if r, ok := u.rule(trackerHost(tracker)); ok {
+		if len(r.patterns) != 0 {
+			patterns = r.patterns
+		}
+
+		if r.Observations != 0 {
+			observations = r.Observations
+		}
+
+		allowlist = append(append([]pattern{}, allowlist...), r.allowlist...)
+	}
+
+	for _, a := range allowlist {
+		if a.re.MatchString(message) {
+			return "", 0, false
+		}
+	}
+
+	for _, p := range patterns {
+		if p.re.MatchString(message) {
+			return p.text, max(observations, 1), true
+		}
+	}
+
+	return "", 0, false
+}
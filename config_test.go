@@ -0,0 +1,176 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUnregisteredPatterns(t *testing.T) {
+	c := defaultConfig()
+	c.Unregistered.Patterns = []string{"Not Found (v2)", "re:torrent (has been )?deleted", "a+b"}
+	c.Unregistered.Allowlist = []string{"tracker is down."}
+	if err := c.compile(); err != nil {
+		t.Fatalf("compile: %q", err)
+	}
+
+	for msg, want := range map[string]string{
+		"torrent not found (v2) on tracker": "Not Found (v2)",
+		"Torrent has been deleted":          "re:torrent (has been )?deleted",
+		"torrent deleted":                   "re:torrent (has been )?deleted",
+		"seen a+b here":                     "a+b",
+		"not found v2":                      "",
+		"aab":                               "",
+		"tracker is down. not found (v2)":   "",
+	} {
+		if p, _, _ := c.Unregistered.match("https://tracker.example/announce", msg); p != want {
+			t.Fatalf("%q matched %q, want %q", msg, p, want)
+		}
+	}
+
+	c.Unregistered.Patterns = []string{"re:broken("}
+	if err := c.compile(); err == nil {
+		t.Fatalf("bad regular expression accepted")
+	}
+}
+
+func TestUnregisteredTrackers(t *testing.T) {
+	c := defaultConfig()
+	c.Unregistered.Patterns = []string{"unregistered"}
+	c.Unregistered.Allowlist = []string{"maintenance"}
+	c.Unregistered.Observations = 2
+	c.Unregistered.Trackers = map[string]unregisteredRule{
+		" Example.org ":   {Patterns: []string{"re:^gone$"}, Observations: 3},
+		"eu.example.org":  {Allowlist: []string{"gone"}},
+		"other.example":   {Observations: 5},
+		"strict.example ": {Allowlist: []string{"re:^unregistered$"}},
+	}
+
+	if err := c.compile(); err != nil {
+		t.Fatalf("compile: %q", err)
+	}
+
+	for _, tc := range []struct {
+		tracker, message, pattern string
+		observations              uint
+	}{
+		/* No override, the global patterns and observations apply. */
+		{"https://tracker.example/announce", "Unregistered torrent", "unregistered", 2},
+		{"https://tracker.example/announce", "gone", "", 0},
+		{"https://tracker.example/announce", "unregistered, maintenance", "", 0},
+		/* Patterns replace the global list. */
+		{"https://example.org/announce", "gone", "re:^gone$", 3},
+		{"https://example.org/announce", "unregistered", "", 0},
+		/* Subdomains fall back to their parent domains until a rule is found. */
+		{"https://tracker.example.org:443/announce?passkey=x", "gone", "re:^gone$", 3},
+		{"https://a.b.example.org/announce", "gone", "re:^gone$", 3},
+		/* The most specific rule wins, without merging in its parent. */
+		{"https://eu.example.org/announce", "gone", "", 0},
+		{"https://eu.example.org/announce", "unregistered", "unregistered", 2},
+		{"https://x.eu.example.org/announce", "unregistered", "unregistered", 2},
+		/* Only the observations are overridden. */
+		{"https://other.example/announce", "unregistered", "unregistered", 5},
+		{"https://notother.example/announce", "unregistered", "unregistered", 2},
+		/* Allowlists are added to the global one. */
+		{"https://strict.example/announce", "unregistered", "", 0},
+		{"https://strict.example/announce", "unregistered torrent", "unregistered", 2},
+		{"https://strict.example/announce", "unregistered, maintenance", "", 0},
+		{"://bad", "unregistered", "unregistered", 2},
+	} {
+		p, n, ok := c.Unregistered.match(tc.tracker, tc.message)
+		if p != tc.pattern || n != tc.observations || ok != (len(tc.pattern) != 0) {
+			t.Errorf("%q %q: got %q %d %v, want %q %d", tc.tracker, tc.message, p, n, ok, tc.pattern, tc.observations)
+		}
+	}
+
+	c.Unregistered.Observations = 0
+	if _, n, _ := c.Unregistered.match("https://tracker.example/announce", "unregistered"); n != 1 {
+		t.Fatalf("no observations required %d", n)
+	}
+
+	c.Unregistered.Trackers = map[string]unregisteredRule{"x.example": {Allowlist: []string{"re:("}}}
+	if err := c.compile(); err == nil {
+		t.Fatalf("bad tracker allowlist accepted")
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, body string) string {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, []byte(body), 0600); err != nil {
+			t.Fatalf("write: %q", err)
+		}
+
+		return p
+	}
+
+	c, err := loadConfig([]string{filepath.Join(dir, "missing.json"), write("ok.json", `{"unregistered":{"allowlist":["re:tracker (is )?down"]}}`)})
+	if err != nil || len(c.Unregistered.allowlist) != 1 {
+		t.Fatalf("valid configuration: %v", err)
+	}
+
+	if c, err := loadConfig([]string{filepath.Join(dir, "missing.json")}); err != nil || len(c.Unregistered.patterns) == 0 {
+		t.Fatalf("defaults without a file: %v", err)
+	}
+
+	for _, body := range []string{
+		`{"unregistered":{"allowlist":["re:broken("]}}`,
+		`{"unregistered":{"trackers":{"tracker.example":{"patterns":["re:(("]}}}}`,
+		`{"unregistered":`,
+		`{"quarantine":{"enabled":true,"path":""}}`,
+		`{"quarantine":{"enabled":true,"path":"/data/quarantine","tag":""}}`,
+	} {
+		if c, err := loadConfig([]string{write("bad.json", body)}); err == nil {
+			t.Fatalf("%s loaded with %d patterns", body, len(c.Unregistered.patterns))
+		}
+	}
+}
+
+func TestQueryTTL(t *testing.T) {
+	s := defaultConfig().Search
+	s.QueryTTL = duration(time.Minute * 12)
+	s.AgeTTLs = []ageTTL{
+		{MaxAge: duration(time.Hour * 48), TTL: duration(time.Hour)},
+		{MaxAge: duration(time.Hour * 720), TTL: duration(time.Hour * 24)},
+	}
+
+	for _, tc := range []struct {
+		ic   indexerConfig
+		age  time.Duration
+		want time.Duration
+	}{
+		{indexerConfig{}, time.Hour, time.Hour},
+		{indexerConfig{}, time.Hour * 48, time.Hour},
+		{indexerConfig{}, time.Hour * 100, time.Hour * 24},
+		{indexerConfig{}, time.Hour * 1000, time.Minute * 12},
+		/* Shorter and longer than the age rule alike. */
+		{indexerConfig{QueryTTL: duration(time.Minute)}, time.Hour * 100, time.Minute},
+		{indexerConfig{QueryTTL: duration(time.Hour * 6)}, time.Hour, time.Hour * 6},
+		{indexerConfig{QueryTTL: duration(time.Minute)}, time.Hour * 1000, time.Minute},
+	} {
+		if got := s.queryTTL(tc.ic, tc.age); got != tc.want {
+			t.Errorf("%v at %v: got %v, want %v", time.Duration(tc.ic.QueryTTL), tc.age, got, tc.want)
+		}
+	}
+}
+
+func TestRetryDue(t *testing.T) {
+	s := defaultConfig().Search
+	nt := int64(1700000000)
+	day := int64(time.Hour * 24 / time.Second)
+	if s.retryDue(nt-day+1, nt) || !s.retryDue(nt-day, nt) || !s.retryDue(0, nt) {
+		t.Fatalf("default interval not a day")
+	}
+
+	s.RetryInterval = duration(time.Hour)
+	if s.retryDue(nt-3599, nt) || !s.retryDue(nt-3600, nt) {
+		t.Fatalf("hourly retries not honoured")
+	}
+
+	s.RetryInterval = 0
+	if s.retryDue(0, nt) {
+		t.Fatalf("zero interval retried")
+	}
+}
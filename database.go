@@ -0,0 +1,426 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/moistari/rls"
+	"github.com/titlerr/upgraderr/pkg/ttlcache"
+	bolt "go.etcd.io/bbolt"
+)
+
+/* Top level buckets holding one nested bucket per indexer (or backend). */
+var indexerBuckets = []string{"enclosures", "titles", "torrents", "queries", "attempts", "rss"}
+
+/* Top level buckets keyed directly by title, their entries are stamped under the bucket name in stamps. */
+var flatBuckets = map[string]bool{"hits": true, "ids": true}
+
+/* Buckets whose values lead with a little-endian unix stamp. */
+var stampedBuckets = map[string]bool{"queries": true, "attempts": true, "rss": true}
+
+func initDatabase() {
+	path := os.Getenv("UPGRADERR_DB")
+	if len(path) == 0 {
+		path = config.Database.Path
+	}
+
+	var err error
+	if len(path) != 0 {
+		db, err = bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second * 5})
+		if err != nil {
+			slog.Warn("Unable to open Torznab database", "path", path, "error", err)
+		}
+	} else {
+		db, err = bolt.Open("/config/upgraderr.db", 0600, nil)
+		if err != nil {
+			slog.Warn("Unable to open Torznab database on /config", "error", err)
+			db, err = bolt.Open("upgraderr.db", 0600, nil)
+			if err != nil {
+				db, err = bolt.Open("/tmp/upgraderr.db", 0600, nil)
+				if err != nil {
+					slog.Warn("Unable to open Torznab database on /tmp", "error", err)
+				}
+			}
+		}
+	}
+
+	if db == nil {
+		return
+	}
+
+	if _, err := migrateDatabase(db); err != nil {
+		slog.Warn("Unable to migrate database, not using it", "path", db.Path(), "error", err)
+		db.Close()
+		db = nil
+		return
+	}
+
+	if err := pruneDatabase(); err != nil {
+		slog.Error("Unable to apply database retention", "error", err)
+	}
+
+	if config.Database.Compact {
+		if err := compactDatabase(); err != nil {
+			slog.Error("Unable to compact database", "error", err)
+		}
+	}
+}
+
+/* Buckets written by the cache backends, derived data that is never exported. */
+var cacheBuckets = map[string]bool{"titlemap": true, "formattedmap": true}
+
+/* Parses are kept by their original name, a release decoded any other way would lose the tags rls.Compare relies on. */
+type releaseCodec struct{}
+
+func (releaseCodec) Encode(r *rls.Release) ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+func (releaseCodec) Decode(b []byte) (*rls.Release, error) {
+	r := rls.ParseString(string(b))
+	return &r, nil
+}
+
+/* Swaps the title caches for ones written through to the database, warm from the last run. */
+func persistCaches() {
+	if db == nil || !config.Database.Caches {
+		return
+	}
+
+	report := func(bucket string) ttlcache.BoltOptions {
+		return ttlcache.BoltOptions{}.SetErrorFunc(func(err error) {
+			slog.Error("Unable to persist cache", "bucket", bucket, "error", err)
+		})
+	}
+
+	titlemap.Close()
+	titlemap = ttlcache.New(titleOptions.SetBackend(
+		ttlcache.NewBoltBackend[string, *rls.Release](db, "titlemap", ttlcache.StringCodec{}, releaseCodec{}, report("titlemap"))))
+
+	formattedmap.Close()
+	formattedmap = ttlcache.New(formattedOptions.SetBackend(
+		ttlcache.NewBoltBackend[string, string](db, "formattedmap", ttlcache.StringCodec{}, ttlcache.StringCodec{}, report("formattedmap"))))
+
+	caches["titlemap"], caches["formattedmap"] = titlemap, formattedmap
+	slog.Info("Restored caches", "titles", titlemap.Len(), "formatted", formattedmap.Len())
+}
+
+/* Applies the retention policies on an interval, compaction only happens at startup. */
+func maintainDatabase() {
+	if db == nil {
+		return
+	}
+
+	t := time.NewTicker(max(time.Duration(config.Database.Interval), time.Minute))
+	defer t.Stop()
+	for range t.C {
+		if err := pruneDatabase(); err != nil {
+			slog.Error("Unable to apply database retention", "error", err)
+		}
+	}
+}
+
+/* Rewrites the database into a fresh file, reclaiming the pages freed by retention. */
+func compactDatabase() error {
+	path := db.Path()
+	tmp := path + ".compact"
+	os.Remove(tmp)
+
+	dst, err := bolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return err
+	}
+
+	if err := bolt.Compact(dst, db, 1<<20); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := db.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		db, _ = bolt.Open(path, 0600, nil)
+		return err
+	}
+
+	db, err = bolt.Open(path, 0600, nil)
+	return err
+}
+
+/* Records when an entry of a per indexer or flat bucket was written, for buckets not storing a stamp themselves. */
+func stampEntry(tx *bolt.Tx, bucket, indexer string, key []byte, stamp int64) error {
+	sb, err := tx.CreateBucketIfNotExists([]byte("stamps"))
+	if err != nil {
+		return err
+	}
+
+	b, err := sb.CreateBucketIfNotExists([]byte(bucket))
+	if err != nil {
+		return err
+	}
+
+	if len(indexer) == 0 {
+		return b.Put(key, binary.LittleEndian.AppendUint64(nil, uint64(stamp)))
+	}
+
+	c, err := b.CreateBucketIfNotExists([]byte(indexer))
+	if err != nil {
+		return err
+	}
+
+	return c.Put(key, binary.LittleEndian.AppendUint64(nil, uint64(stamp)))
+}
+
+func stampsBucket(tx *bolt.Tx, bucket, indexer string) *bolt.Bucket {
+	sb := tx.Bucket([]byte("stamps"))
+	if sb == nil {
+		return nil
+	}
+
+	b := sb.Bucket([]byte(bucket))
+	if b == nil || len(indexer) == 0 {
+		return b
+	}
+
+	return b.Bucket([]byte(indexer))
+}
+
+func entryStamp(bucket string, stamps *bolt.Bucket, k, v []byte) (int64, bool) {
+	if stampedBuckets[bucket] && len(v) >= 8 {
+		return int64(binary.LittleEndian.Uint64(v)), true
+	}
+
+	if stamps == nil {
+		return 0, false
+	}
+
+	if s := stamps.Get(k); len(s) == 8 {
+		return int64(binary.LittleEndian.Uint64(s)), true
+	}
+
+	return 0, false
+}
+
+func pruneDatabase() error {
+	nt := globalTime.Now().Unix()
+	return db.Update(func(tx *bolt.Tx) error {
+		for name, rule := range config.Database.Retention {
+			pb := tx.Bucket([]byte(name))
+			if pb == nil || (rule.MaxAge == 0 && rule.MaxEntries == 0) {
+				continue
+			}
+
+			if flatBuckets[name] {
+				removed, err := pruneBucket(tx, name, "", rule, nt)
+				if err != nil {
+					return err
+				}
+
+				if removed != 0 {
+					slog.Info("Removed expired entries", "bucket", name, "count", removed)
+				}
+
+				continue
+			}
+
+			indexers := make([]string, 0)
+			if err := pb.ForEachBucket(func(k []byte) error {
+				indexers = append(indexers, string(k))
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			for _, indexer := range indexers {
+				removed, err := pruneBucket(tx, name, indexer, rule, nt)
+				if err != nil {
+					return err
+				}
+
+				if removed != 0 {
+					slog.Info("Removed expired entries", "indexer", indexer, "bucket", name, "count", removed)
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+/* An empty indexer prunes a flat bucket. */
+func pruneBucket(tx *bolt.Tx, name, indexer string, rule retentionRule, nt int64) (int, error) {
+	b := tx.Bucket([]byte(name))
+	if len(indexer) != 0 {
+		b = b.Bucket([]byte(indexer))
+	}
+
+	type entry struct {
+		key   []byte
+		stamp int64
+	}
+
+	stamps := stampsBucket(tx, name, indexer)
+	entries := make([]entry, 0, b.Stats().KeyN)
+	if err := b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			return nil
+		}
+
+		stamp, ok := entryStamp(name, stamps, k, v)
+		if !ok {
+			stamp = nt
+		}
+
+		entries = append(entries, entry{key: bytes.Clone(k), stamp: stamp})
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].stamp > entries[j].stamp
+	})
+
+	keep := len(entries)
+	if rule.MaxEntries != 0 && uint(keep) > rule.MaxEntries {
+		keep = int(rule.MaxEntries)
+	}
+
+	if rule.MaxAge != 0 {
+		cutoff := nt - int64(time.Duration(rule.MaxAge)/time.Second)
+		for keep > 0 && entries[keep-1].stamp < cutoff {
+			keep--
+		}
+	}
+
+	for _, e := range entries[keep:] {
+		if err := b.Delete(e.key); err != nil {
+			return 0, err
+		}
+
+		if stamps != nil {
+			if err := stamps.Delete(e.key); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	return len(entries) - keep, nil
+}
+
+type bucketStats struct {
+	Keys    int
+	Size    int
+	Oldest  *time.Time              `json:",omitempty"`
+	Buckets map[string]*bucketStats `json:",omitempty"`
+}
+
+type databaseStats struct {
+	Path    string
+	Size    int64
+	Buckets map[string]*bucketStats
+}
+
+func collectBucketStats(tx *bolt.Tx, name, indexer string, b *bolt.Bucket) *bucketStats {
+	s := &bucketStats{}
+	stamps := stampsBucket(tx, name, indexer)
+	oldest := int64(0)
+	b.ForEach(func(k, v []byte) error {
+		if v == nil {
+			child := collectBucketStats(tx, name, string(k), b.Bucket(k))
+			if s.Buckets == nil {
+				s.Buckets = make(map[string]*bucketStats)
+			}
+
+			s.Buckets[string(k)] = child
+			s.Keys += child.Keys
+			s.Size += child.Size
+			if child.Oldest != nil && (oldest == 0 || child.Oldest.Unix() < oldest) {
+				oldest = child.Oldest.Unix()
+			}
+
+			return nil
+		}
+
+		s.Keys++
+		s.Size += len(k) + len(v)
+		if len(indexer) == 0 && !flatBuckets[name] {
+			return nil
+		}
+
+		if stamp, ok := entryStamp(name, stamps, k, v); ok && (oldest == 0 || stamp < oldest) {
+			oldest = stamp
+		}
+
+		return nil
+	})
+
+	if oldest != 0 {
+		t := time.Unix(oldest, 0).UTC()
+		s.Oldest = &t
+	}
+
+	return s
+}
+
+func handleDBStats(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	stats := databaseStats{Path: db.Path(), Buckets: make(map[string]*bucketStats)}
+	if fi, err := os.Stat(db.Path()); err == nil {
+		stats.Size = fi.Size()
+	}
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			stats.Buckets[string(name)] = collectBucketStats(tx, string(name), "", b)
+			return nil
+		})
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read database: %q\n", err), 467)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		http.Error(w, err.Error(), 466)
+	}
+}
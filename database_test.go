@@ -0,0 +1,623 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/moistari/rls"
+	"github.com/titlerr/upgraderr/pkg/ttlcache"
+	bolt "go.etcd.io/bbolt"
+)
+
+func openFixture(t *testing.T, build func(tx *bolt.Tx) error) *bolt.DB {
+	t.Helper()
+	d, err := bolt.Open(filepath.Join(t.TempDir(), "upgraderr.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("open: %q", err)
+	}
+
+	t.Cleanup(func() { d.Close() })
+	if build != nil {
+		if err := d.Update(build); err != nil {
+			t.Fatalf("fixture: %q", err)
+		}
+	}
+
+	return d
+}
+
+func stamp(v int64) []byte {
+	return binary.LittleEndian.AppendUint64(nil, uint64(v))
+}
+
+/* The layout shipped before versioning: four buckets, a nested bucket per indexer and cat+q query stamps. */
+func legacyFixture(tx *bolt.Tx) error {
+	for _, name := range []string{"enclosures", "titles", "torrents", "queries"} {
+		b, err := tx.CreateBucket([]byte(name))
+		if err != nil {
+			return err
+		}
+
+		if _, err := b.CreateBucket([]byte("someindexer")); err != nil {
+			return err
+		}
+	}
+
+	put := func(bucket, k string, v []byte) error {
+		return tx.Bucket([]byte(bucket)).Bucket([]byte("someindexer")).Put([]byte(k), v)
+	}
+
+	for _, e := range []struct {
+		bucket, k string
+		v         []byte
+	}{
+		{"titles", "Show.Name.S01E01.1080p.WEB.h264-GRP", []byte("guid1")},
+		{"enclosures", "guid1", []byte("https://indexer.example/dl/1")},
+		{"torrents", "guid1", []byte("d4:infod4:name4:testee")},
+		{"queries", "5000show name s01e01", stamp(1)},
+		{"queries", "cat=5000&q=show+name&t=tvsearch", stamp(2)},
+	} {
+		if err := put(e.bucket, e.k, e.v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func TestMigrateLegacy(t *testing.T) {
+	d := openFixture(t, legacyFixture)
+	from, err := migrateDatabase(d)
+	if err != nil {
+		t.Fatalf("migrate: %q", err)
+	}
+
+	if from != 0 {
+		t.Fatalf("legacy database reported as version %d", from)
+	}
+
+	d.View(func(tx *bolt.Tx) error {
+		if v := getSchemaVersion(tx); v != schemaVersion {
+			t.Fatalf("version %d after migration, want %d", v, schemaVersion)
+		}
+
+		for _, name := range append(indexerBuckets, "ids", "health", "hits", "stamps", "meta") {
+			if tx.Bucket([]byte(name)) == nil {
+				t.Fatalf("missing bucket %q", name)
+			}
+		}
+
+		q := tx.Bucket([]byte("queries")).Bucket([]byte("someindexer"))
+		if q.Get([]byte("5000show name s01e01")) != nil {
+			t.Fatalf("legacy query stamp kept")
+		}
+
+		if q.Get([]byte("cat=5000&q=show+name&t=tvsearch")) == nil {
+			t.Fatalf("current query stamp dropped")
+		}
+
+		for _, name := range []string{"titles", "enclosures", "torrents"} {
+			s := stampsBucket(tx, name, "someindexer")
+			if s == nil || s.Stats().KeyN != 1 {
+				t.Fatalf("%s entries not stamped", name)
+			}
+		}
+
+		if tx.Bucket([]byte("torrents")).Bucket([]byte("someindexer")).Get([]byte("guid1")) == nil {
+			t.Fatalf("torrent lost in migration")
+		}
+
+		return nil
+	})
+}
+
+func TestMigrateFresh(t *testing.T) {
+	d := openFixture(t, nil)
+	if _, err := migrateDatabase(d); err != nil {
+		t.Fatalf("migrate: %q", err)
+	}
+
+	from, err := migrateDatabase(d)
+	if err != nil {
+		t.Fatalf("second migrate: %q", err)
+	}
+
+	if from != schemaVersion {
+		t.Fatalf("second run started at %d, want %d", from, schemaVersion)
+	}
+}
+
+/* Version 1 databases already have every bucket but still carry legacy query stamps and unstamped entries. */
+func TestMigratePartial(t *testing.T) {
+	d := openFixture(t, func(tx *bolt.Tx) error {
+		if err := legacyFixture(tx); err != nil {
+			return err
+		}
+
+		if err := migrateBuckets(tx); err != nil {
+			return err
+		}
+
+		return putSchemaVersion(tx, 1)
+	})
+
+	from, err := migrateDatabase(d)
+	if err != nil {
+		t.Fatalf("migrate: %q", err)
+	}
+
+	if from != 1 {
+		t.Fatalf("started at %d, want 1", from)
+	}
+
+	d.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte("queries")).Bucket([]byte("someindexer")).Get([]byte("5000show name s01e01")) != nil {
+			t.Fatalf("legacy query stamp kept")
+		}
+
+		return nil
+	})
+}
+
+func TestMigrateNewer(t *testing.T) {
+	d := openFixture(t, func(tx *bolt.Tx) error {
+		return putSchemaVersion(tx, schemaVersion+1)
+	})
+
+	if _, err := migrateDatabase(d); err == nil {
+		t.Fatalf("newer schema accepted")
+	}
+}
+
+func TestExportImport(t *testing.T) {
+	src := openFixture(t, legacyFixture)
+	if _, err := migrateDatabase(src); err != nil {
+		t.Fatalf("migrate: %q", err)
+	}
+
+	saved := db
+	t.Cleanup(func() { db = saved })
+
+	db = src
+	buf := &bytes.Buffer{}
+	if err := exportDatabase(buf); err != nil {
+		t.Fatalf("export: %q", err)
+	}
+
+	dst := openFixture(t, func(tx *bolt.Tx) error {
+		if err := migrateBuckets(tx); err != nil {
+			return err
+		}
+
+		return putPath(tx, []string{"ids"}, []byte("keep"), []byte("{}"))
+	})
+
+	if _, err := migrateDatabase(dst); err != nil {
+		t.Fatalf("migrate: %q", err)
+	}
+
+	for _, replace := range []bool{false, true} {
+		scratch := openFixture(t, nil)
+		if _, err := loadArchive(bytes.NewReader(buf.Bytes()), scratch); err != nil {
+			t.Fatalf("load: %q", err)
+		}
+
+		db = dst
+		if err := importDatabase(scratch, replace); err != nil {
+			t.Fatalf("import: %q", err)
+		}
+
+		dst.View(func(tx *bolt.Tx) error {
+			if v := tx.Bucket([]byte("torrents")).Bucket([]byte("someindexer")).Get([]byte("guid1")); string(v) != "d4:infod4:name4:testee" {
+				t.Fatalf("torrent blob not imported: %q", v)
+			}
+
+			if tx.Bucket([]byte("titles")).Bucket([]byte("someindexer")).Get([]byte("Show.Name.S01E01.1080p.WEB.h264-GRP")) == nil {
+				t.Fatalf("title not imported")
+			}
+
+			if kept := tx.Bucket([]byte("ids")).Get([]byte("keep")) != nil; kept == replace {
+				t.Fatalf("replace %t kept existing ids: %t", replace, kept)
+			}
+
+			return nil
+		})
+	}
+}
+
+func TestImportKeepsAudit(t *testing.T) {
+	saved := db
+	t.Cleanup(func() { db = saved })
+
+	at := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, replace := range []bool{false, true} {
+		db = openFixture(t, nil)
+		if _, err := migrateDatabase(db); err != nil {
+			t.Fatalf("migrate: %q", err)
+		}
+
+		if err := recordAudit(auditEntry{Time: at, Action: "delete", Host: "http://local"}); err != nil {
+			t.Fatalf("audit: %q", err)
+		}
+
+		if err := putQuarantine([]quarantineEntry{{Hash: "aaaa", Host: "http://local"}}); err != nil {
+			t.Fatalf("quarantine: %q", err)
+		}
+
+		/* Same time and sequence as the local entry. */
+		key := binary.BigEndian.AppendUint64(binary.BigEndian.AppendUint64(nil, uint64(at.UnixNano())), 1)
+		src := openFixture(t, func(tx *bolt.Tx) error {
+			return putPath(tx, []string{"audit"}, key, []byte(`{"Action":"pause","Host":"http://remote"}`))
+		})
+
+		for i := 0; i < 2; i++ {
+			if err := importDatabase(src, replace); err != nil {
+				t.Fatalf("import: %q", err)
+			}
+		}
+
+		w := httptest.NewRecorder()
+		handleAudit(w, httptest.NewRequest("GET", "/api/audit", nil))
+		var entries []auditEntry
+		if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil || len(entries) != 2 || entries[0].Host != "http://local" || entries[1].Host != "http://remote" {
+			t.Fatalf("replace %t: audit %s, %v", replace, w.Body, err)
+		}
+
+		if e, _ := getQuarantine("http://local", "aaaa"); e == nil {
+			t.Fatalf("replace %t dropped the quarantine", replace)
+		}
+	}
+}
+
+/* Archives from before versioning are migrated on the way in. */
+func TestImportLegacyArchive(t *testing.T) {
+	src := openFixture(t, legacyFixture)
+	saved := db
+	t.Cleanup(func() { db = saved })
+
+	db = src
+	buf := &bytes.Buffer{}
+	if err := exportDatabase(buf); err != nil {
+		t.Fatalf("export: %q", err)
+	}
+
+	scratch := openFixture(t, nil)
+	if _, err := loadArchive(buf, scratch); err != nil {
+		t.Fatalf("load: %q", err)
+	}
+
+	scratch.View(func(tx *bolt.Tx) error {
+		if v := getSchemaVersion(tx); v != schemaVersion {
+			t.Fatalf("archive left at version %d", v)
+		}
+
+		if tx.Bucket([]byte("queries")).Bucket([]byte("someindexer")).Get([]byte("5000show name s01e01")) != nil {
+			t.Fatalf("legacy query stamp kept")
+		}
+
+		return nil
+	})
+}
+
+func TestPersistCaches(t *testing.T) {
+	saved := db
+	t.Cleanup(func() {
+		db = saved
+		titlemap.Close()
+		formattedmap.Close()
+		titlemap = ttlcache.New(titleOptions)
+		formattedmap = ttlcache.New(formattedOptions)
+		caches["titlemap"], caches["formattedmap"] = titlemap, formattedmap
+	})
+
+	db = openFixture(t, nil)
+	persistCaches()
+	name := "Show.Name.S01E01.1080p.WEB.h264-GRP"
+	want := CacheTitle(name)
+	formatted := CacheFormatted(name)
+
+	/* Closing the current caches flushes them before the database is read back. */
+	persistCaches()
+	if titlemap.Len() != 1 || formattedmap.Len() != 1 {
+		t.Fatalf("restored %d titles, %d formatted", titlemap.Len(), formattedmap.Len())
+	}
+
+	if r, ok := titlemap.Get(name); !ok || rls.Compare(*r, *want) != 0 || r.String() != name {
+		t.Fatalf("release not restored: %v", r)
+	}
+
+	if f, ok := formattedmap.Get(name); !ok || f != formatted {
+		t.Fatalf("formatted title not restored: %q", f)
+	}
+
+	if caches["titlemap"] != titlemap {
+		t.Fatalf("metrics still report the replaced cache")
+	}
+}
+
+func TestPruneDatabase(t *testing.T) {
+	saved, savedConfig := db, config
+	t.Cleanup(func() { db, config = saved, savedConfig })
+	now := time.Unix(1700000000, 0)
+	fakeTime(t, now)
+	nt := now.Unix()
+	hour := int64(time.Hour / time.Second)
+
+	config = defaultConfig()
+	config.Database.Retention = map[string]retentionRule{
+		"torrents": {MaxAge: duration(time.Hour * 24 * 10), MaxEntries: 2},
+		"queries":  {MaxAge: duration(time.Hour * 24)},
+		"hits":     {MaxAge: duration(time.Hour * 24), MaxEntries: 2},
+		"ids":      {},
+	}
+
+	db = openFixture(t, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("hits"))
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte("legacy"), []byte(`{"Searches":1}`))
+	})
+
+	if _, err := migrateDatabase(db); err != nil {
+		t.Fatalf("migrate: %q", err)
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		for indexer, entries := range map[string]map[string]int64{
+			"idx1": {"a": nt - hour, "b": nt - 2*hour, "c": nt - 3*hour, "d": nt - 20*24*hour},
+			"idx2": {"x": nt - 20*24*hour, "y": nt - 30*24*hour},
+		} {
+			b, err := tx.Bucket([]byte("torrents")).CreateBucket([]byte(indexer))
+			if err != nil {
+				return err
+			}
+
+			for k, v := range entries {
+				if err := b.Put([]byte(k), []byte("guid")); err != nil {
+					return err
+				}
+
+				if err := stampEntry(tx, "torrents", indexer, []byte(k), v); err != nil {
+					return err
+				}
+			}
+		}
+
+		b, err := tx.Bucket([]byte("torrents")).CreateBucket([]byte("idx3"))
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put([]byte("unstamped"), []byte("guid")); err != nil {
+			return err
+		}
+
+		q, err := tx.Bucket([]byte("queries")).CreateBucket([]byte("idx1"))
+		if err != nil {
+			return err
+		}
+
+		q.Put([]byte("old"), stamp(nt-2*24*hour))
+		q.Put([]byte("new"), stamp(nt-hour))
+		for k, v := range map[string]int64{"old": nt - 2*24*hour, "new": nt - hour, "newer": nt - 60} {
+			if err := recordQueryHit(tx, k, true, v); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatalf("fixture: %q", err)
+	}
+
+	if err := putStoredIDs("movie2020", releaseIDs{IMDB: "tt1"}); err != nil {
+		t.Fatalf("ids: %q", err)
+	}
+
+	if err := pruneDatabase(); err != nil {
+		t.Fatalf("prune: %q", err)
+	}
+
+	keys := func(b *bolt.Bucket) []string {
+		res := make([]string, 0)
+		if b != nil {
+			b.ForEach(func(k, v []byte) error {
+				res = append(res, string(k))
+				return nil
+			})
+		}
+
+		return res
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		torrents := tx.Bucket([]byte("torrents"))
+		for _, c := range []struct {
+			name string
+			b    *bolt.Bucket
+			want string
+		}{
+			/* c only goes over the entry limit, d is also too old. */
+			{"idx1", torrents.Bucket([]byte("idx1")), "[a b]"},
+			{"idx1 stamps", stampsBucket(tx, "torrents", "idx1"), "[a b]"},
+			/* Within the entry limit but too old. */
+			{"idx2", torrents.Bucket([]byte("idx2")), "[]"},
+			{"idx3", torrents.Bucket([]byte("idx3")), "[unstamped]"},
+			{"queries", tx.Bucket([]byte("queries")).Bucket([]byte("idx1")), "[new]"},
+			/* The legacy entry was stamped by the migration, so it is the newest. */
+			{"hits", tx.Bucket([]byte("hits")), "[legacy newer]"},
+			{"hits stamps", stampsBucket(tx, "hits", ""), "[legacy newer]"},
+			{"ids", tx.Bucket([]byte("ids")), "[movie2020]"},
+		} {
+			if got := fmt.Sprint(keys(c.b)); got != c.want {
+				t.Errorf("%s: got %s, want %s", c.name, got, c.want)
+			}
+		}
+
+		return nil
+	})
+}
+
+func TestCompactDatabase(t *testing.T) {
+	saved := db
+	t.Cleanup(func() { db = saved })
+	db = openFixture(t, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("titles"))
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < 2000; i++ {
+			if err := b.Put([]byte(fmt.Sprintf("title%d", i)), bytes.Repeat([]byte("x"), 1000)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("titles"))
+		for i := 1; i < 2000; i++ {
+			if err := b.Delete([]byte(fmt.Sprintf("title%d", i))); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}); err != nil {
+		t.Fatalf("delete: %q", err)
+	}
+
+	path := db.Path()
+	before, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %q", err)
+	}
+
+	if err := compactDatabase(); err != nil {
+		t.Fatalf("compact: %q", err)
+	}
+
+	t.Cleanup(func() { db.Close() })
+	after, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %q", err)
+	}
+
+	if after.Size() >= before.Size() || db.Path() != path {
+		t.Fatalf("compacted %d bytes into %d at %q", before.Size(), after.Size(), db.Path())
+	}
+
+	if _, err := os.Stat(path + ".compact"); !os.IsNotExist(err) {
+		t.Fatalf("temporary file left behind: %v", err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte("titles")).Get([]byte("title0")); len(v) != 1000 {
+			t.Fatalf("entry lost in compaction")
+		}
+
+		return nil
+	})
+}
+
+func TestHandleDBStats(t *testing.T) {
+	saved := db
+	t.Cleanup(func() { db = saved })
+	db = nil
+	rec := httptest.NewRecorder()
+	handleDBStats(rec, httptest.NewRequest("GET", "/api/db/stats", nil))
+	if rec.Code != 480 {
+		t.Fatalf("no database: got %d", rec.Code)
+	}
+
+	nt := int64(1700000000)
+	db = openFixture(t, func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucket([]byte("torrents"))
+		if err != nil {
+			return err
+		}
+
+		c, err := b.CreateBucket([]byte("idx1"))
+		if err != nil {
+			return err
+		}
+
+		for i, k := range []string{"a", "b"} {
+			c.Put([]byte(k), []byte("guid"))
+			if err := stampEntry(tx, "torrents", "idx1", []byte(k), nt-int64(i)); err != nil {
+				return err
+			}
+		}
+
+		q, err := tx.CreateBucket([]byte("queries"))
+		if err != nil {
+			return err
+		}
+
+		c, err = q.CreateBucket([]byte("idx1"))
+		if err != nil {
+			return err
+		}
+
+		c.Put([]byte("q"), stamp(nt-100))
+		h, err := tx.CreateBucket([]byte("hits"))
+		if err != nil {
+			return err
+		}
+
+		h.Put([]byte("title"), []byte("{}"))
+		return stampEntry(tx, "hits", "", []byte("title"), nt-50)
+	})
+
+	rec = httptest.NewRecorder()
+	handleDBStats(rec, httptest.NewRequest("GET", "/api/db/stats", nil))
+	if rec.Code != 200 {
+		t.Fatalf("got %d: %s", rec.Code, rec.Body)
+	}
+
+	var stats databaseStats
+	if err := json.Unmarshal(rec.Body.Bytes(), &stats); err != nil {
+		t.Fatalf("decode: %q", err)
+	}
+
+	if stats.Path != db.Path() || stats.Size == 0 {
+		t.Fatalf("bad header: %+v", stats)
+	}
+
+	oldest := func(s *bucketStats) int64 {
+		if s == nil || s.Oldest == nil {
+			return 0
+		}
+
+		return s.Oldest.Unix()
+	}
+
+	torrents := stats.Buckets["torrents"]
+	if torrents == nil || torrents.Keys != 2 || torrents.Size != 2*len("aguid") || oldest(torrents) != nt-1 || oldest(torrents.Buckets["idx1"]) != nt-1 {
+		t.Fatalf("bad torrents stats: %+v", torrents)
+	}
+
+	if s := stats.Buckets["queries"]; s == nil || s.Keys != 1 || oldest(s) != nt-100 {
+		t.Fatalf("bad queries stats: %+v", s)
+	}
+
+	if s := stats.Buckets["hits"]; s == nil || s.Keys != 1 || s.Buckets != nil || oldest(s) != nt-50 {
+		t.Fatalf("bad hits stats: %+v", s)
+	}
+
+	/* The stamps themselves carry no age. */
+	if s := stats.Buckets["stamps"]; s == nil || s.Keys != 3 || oldest(s) != 0 {
+		t.Fatalf("bad stamps stats: %+v", s)
+	}
+}
@@ -0,0 +1,411 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+Archives are a gzipped tar holding manifest.json, entries.jsonl with one line per key,
+and the cached .torrent files under blobs/<bucket>/<indexer>/<key>, hex encoded.
+*/
+type exportManifest struct {
+	Version  uint64
+	Exported time.Time
+}
+
+type exportEntry struct {
+	Path  []string
+	Key   []byte
+	Value []byte `json:",omitempty"`
+	Blob  string `json:",omitempty"`
+}
+
+func blobName(path []string, key []byte) string {
+	parts := []string{"blobs"}
+	for _, p := range path {
+		parts = append(parts, hex.EncodeToString([]byte(p)))
+	}
+
+	return strings.Join(append(parts, hex.EncodeToString(key)), "/")
+}
+
+func parseBlobName(name string) ([]string, []byte, error) {
+	parts := strings.Split(name, "/")
+	if len(parts) < 3 || parts[0] != "blobs" {
+		return nil, nil, fmt.Errorf("bad blob name %q", name)
+	}
+
+	path := make([]string, 0, len(parts)-2)
+	for _, p := range parts[1 : len(parts)-1] {
+		b, err := hex.DecodeString(p)
+		if err != nil {
+			return nil, nil, fmt.Errorf("bad blob name %q: %w", name, err)
+		}
+
+		path = append(path, string(b))
+	}
+
+	key, err := hex.DecodeString(parts[len(parts)-1])
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad blob name %q: %w", name, err)
+	}
+
+	return path, key, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, b []byte, mod time.Time) error {
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0600, Size: int64(len(b)), ModTime: mod}); err != nil {
+		return err
+	}
+
+	_, err := tw.Write(b)
+	return err
+}
+
+func exportDatabase(w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	nt := globalTime.Now().UTC()
+
+	if err := db.View(func(tx *bolt.Tx) error {
+		manifest, err := json.Marshal(exportManifest{Version: getSchemaVersion(tx), Exported: nt})
+		if err != nil {
+			return err
+		}
+
+		if err := writeTarFile(tw, "manifest.json", manifest, nt); err != nil {
+			return err
+		}
+
+		lines := &bytes.Buffer{}
+		enc := json.NewEncoder(lines)
+		var walk func(path []string, b *bolt.Bucket) error
+		walk = func(path []string, b *bolt.Bucket) error {
+			return b.ForEach(func(k, v []byte) error {
+				if v == nil {
+					return walk(append(path[:len(path):len(path)], string(k)), b.Bucket(k))
+				}
+
+				e := exportEntry{Path: path, Key: k, Value: v}
+				if path[0] == "torrents" {
+					e.Value, e.Blob = nil, blobName(path, k)
+					if err := writeTarFile(tw, e.Blob, v, nt); err != nil {
+						return err
+					}
+				}
+
+				return enc.Encode(e)
+			})
+		}
+
+		if err := tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) == "meta" || cacheBuckets[string(name)] {
+				return nil
+			}
+
+			return walk([]string{string(name)}, b)
+		}); err != nil {
+			return err
+		}
+
+		return writeTarFile(tw, "entries.jsonl", lines.Bytes(), nt)
+	}); err != nil {
+		return err
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+func putPath(tx *bolt.Tx, path []string, k, v []byte) error {
+	if len(path) == 0 {
+		return fmt.Errorf("entry without a bucket")
+	}
+
+	b, err := tx.CreateBucketIfNotExists([]byte(path[0]))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range path[1:] {
+		if b, err = b.CreateBucketIfNotExists([]byte(p)); err != nil {
+			return err
+		}
+	}
+
+	return b.Put(k, v)
+}
+
+/* Loads an archive into a scratch database and migrates it, so older exports land in the current layout. */
+func loadArchive(r io.Reader, d *bolt.DB) (int, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return 0, err
+	}
+
+	defer gz.Close()
+	var manifest *exportManifest
+	count := 0
+	if err := d.Update(func(tx *bolt.Tx) error {
+		tr := tar.NewReader(gz)
+		for {
+			h, err := tr.Next()
+			if err == io.EOF {
+				break
+			} else if err != nil {
+				return err
+			}
+
+			switch {
+			case h.Name == "manifest.json":
+				manifest = &exportManifest{}
+				if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+					return err
+				}
+			case h.Name == "entries.jsonl":
+				s := bufio.NewScanner(tr)
+				s.Buffer(nil, 64<<20)
+				for s.Scan() {
+					var e exportEntry
+					if err := json.Unmarshal(s.Bytes(), &e); err != nil {
+						return err
+					}
+
+					if len(e.Blob) != 0 {
+						continue
+					}
+
+					if err := putPath(tx, e.Path, e.Key, e.Value); err != nil {
+						return err
+					}
+
+					count++
+				}
+
+				if err := s.Err(); err != nil {
+					return err
+				}
+			case strings.HasPrefix(h.Name, "blobs/"):
+				path, key, err := parseBlobName(h.Name)
+				if err != nil {
+					return err
+				}
+
+				v, err := io.ReadAll(tr)
+				if err != nil {
+					return err
+				}
+
+				if err := putPath(tx, path, key, v); err != nil {
+					return err
+				}
+
+				count++
+			}
+		}
+
+		if manifest == nil {
+			return fmt.Errorf("archive has no manifest")
+		}
+
+		if manifest.Version > schemaVersion {
+			return fmt.Errorf("archive schema %d is newer than supported %d", manifest.Version, schemaVersion)
+		}
+
+		return putSchemaVersion(tx, manifest.Version)
+	}); err != nil {
+		return 0, err
+	}
+
+	if _, err := migrateDatabase(d); err != nil {
+		return 0, err
+	}
+
+	return count, nil
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil {
+			child, err := dst.CreateBucketIfNotExists(k)
+			if err != nil {
+				return err
+			}
+
+			return copyBucket(child, src.Bucket(k))
+		}
+
+		return dst.Put(k, v)
+	})
+}
+
+/* Survive a replace: the audit log is append-only, and quarantine entries describe torrents still sitting in the client. */
+var keptBuckets = map[string]bool{"meta": true, "audit": true, "quarantine": true}
+
+/*
+Merge keeps everything not in the archive, replace drops every bucket but the kept ones first. Archive entries win either way,
+except audit entries, which are appended under fresh keys so they never overwrite local ones.
+*/
+func importDatabase(src *bolt.DB, replace bool) error {
+	return src.View(func(stx *bolt.Tx) error {
+		return db.Update(func(tx *bolt.Tx) error {
+			if replace {
+				names := make([][]byte, 0)
+				if err := tx.ForEach(func(name []byte, _ *bolt.Bucket) error {
+					if !keptBuckets[string(name)] {
+						names = append(names, bytes.Clone(name))
+					}
+
+					return nil
+				}); err != nil {
+					return err
+				}
+
+				for _, name := range names {
+					if err := tx.DeleteBucket(name); err != nil {
+						return err
+					}
+				}
+
+				if err := migrateBuckets(tx); err != nil {
+					return err
+				}
+			}
+
+			return stx.ForEach(func(name []byte, b *bolt.Bucket) error {
+				if string(name) == "meta" {
+					return nil
+				}
+
+				dst, err := tx.CreateBucketIfNotExists(name)
+				if err != nil {
+					return err
+				}
+
+				if string(name) == "audit" {
+					return importAudit(dst, b)
+				}
+
+				return copyBucket(dst, b)
+			})
+		})
+	})
+}
+
+/* Keeps the time half of each key and takes a local sequence, skipping entries already present at the same time. */
+func importAudit(dst, src *bolt.Bucket) error {
+	return src.ForEach(func(k, v []byte) error {
+		if v == nil || len(k) < 8 {
+			return nil
+		}
+
+		stamp := k[:8]
+		c := dst.Cursor()
+		for ck, cv := c.Seek(stamp); ck != nil && bytes.HasPrefix(ck, stamp); ck, cv = c.Next() {
+			if bytes.Equal(cv, v) {
+				return nil
+			}
+		}
+
+		seq, err := dst.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		return dst.Put(binary.BigEndian.AppendUint64(bytes.Clone(stamp), seq), v)
+	})
+}
+
+func handleDBExport(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "upgraderr-"+globalTime.Now().UTC().Format("20060102-150405")+".tar.gz"))
+	if err := exportDatabase(w); err != nil {
+		/* Headers are already out, all that's left is to cut the stream short. */
+		requestLog(r).Error("Unable to export database", "error", err)
+	}
+}
+
+func handleDBImport(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	replace := false
+	switch Normalize(r.URL.Query().Get("mode")) {
+	case "", "merge":
+	case "replace":
+		replace = true
+	default:
+		http.Error(w, fmt.Sprintf("Unknown mode %q\n", r.URL.Query().Get("mode")), 469)
+		return
+	}
+
+	dir, err := os.MkdirTemp("", "upgraderr-import")
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create scratch database: %q\n", err), 468)
+		return
+	}
+
+	defer os.RemoveAll(dir)
+	scratch, err := bolt.Open(filepath.Join(dir, "import.db"), 0600, nil)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to create scratch database: %q\n", err), 468)
+		return
+	}
+
+	defer scratch.Close()
+	count, err := loadArchive(r.Body, scratch)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read archive: %q\n", err), 470)
+		return
+	}
+
+	if err := importDatabase(scratch, replace); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to import archive: %q\n", err), 467)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("Imported %d entries\n", count), 200)
+}
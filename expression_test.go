@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/autobrr/go-qbittorrent"
+)
+
+/* Posts body to h with the fake client's host filled in, returning the status and the body of the reply. */
+func callHandler(t *testing.T, h http.HandlerFunc, req upgradereq, body map[string]any) (int, string) {
+	t.Helper()
+	body["host"] = req.Host
+	buf, err := json.Marshal(body)
+	if err != nil {
+		t.Fatalf("marshal: %q", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(buf)))
+	return rec.Code, strings.TrimSpace(rec.Body.String())
+}
+
+func expressionTorrents() map[string]qbittorrent.Torrent {
+	return map[string]qbittorrent.Torrent{
+		"a": {Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", ContentPath: "/data/Show.Name.S01E01.1080p.WEB.h264-GRP", Tracker: "https://one.example/announce", SeedingTime: 100, Size: 10},
+		"b": {Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", ContentPath: "/data/Show.Name.S01E01.1080p.WEB.h264-GRP", Tracker: "https://eu.other.example/announce", SeedingTime: 5, Size: 20},
+		"c": {Name: "Movie.Name.2020.1080p.BluRay.x264-GRP", ContentPath: "/data/Movie.Name.2020.1080p.BluRay.x264-GRP", Tracker: "https://one.example/announce", SeedingTime: 100, Size: 30},
+	}
+}
+
+func TestExpressionGroups(t *testing.T) {
+	req := newFakeClient(t, &fakeClient{live: expressionTorrents()})
+	for _, tc := range []struct {
+		query, groupby, want string
+	}{
+		{"GroupAll('SeedingTime > 50')", "", "Processed: 1"},
+		{"GroupAny('SeedingTime > 50')", "", "Processed: 3"},
+		{"GroupAny('SeedingTime > 500')", "", "Processed: 0"},
+		{"GroupCount() > 1", "", "Processed: 2"},
+		{"GroupHasTracker('other.example')", "", "Processed: 2"},
+		{"GroupHasTracker('example')", "", "Processed: 3"},
+		{"GroupMaxSize() == 20", "", "Processed: 2"},
+		{"GroupCount() > 1", "tracker", "Processed: 2"},
+		{"GroupMaxSize() == 30", "tracker", "Processed: 2"},
+		{"GroupAll('SeedingTime > 50') && GroupCount() == 2", "tracker", "Processed: 2"},
+		{"GroupCount() == 2", "contentpath", "Processed: 2"},
+		{"DisableCrossseed() && GroupAny('Size > 15') && Size > 15", "", "Processed: 2"},
+	} {
+		code, body := callHandler(t, handleExpression, req, map[string]any{"query": tc.query, "groupby": tc.groupby})
+		if code != 200 || body != tc.want {
+			t.Fatalf("%q by %q: %d %q, want %q", tc.query, tc.groupby, code, body, tc.want)
+		}
+	}
+
+	if code, _ := callHandler(t, handleExpression, req, map[string]any{"query": "true", "groupby": "tag"}); code != 474 {
+		t.Fatalf("unknown grouping answered %d", code)
+	}
+}
+
+func TestExpressionDeleteDataShared(t *testing.T) {
+	f := &fakeClient{live: expressionTorrents()}
+	req := newFakeClient(t, f)
+	code, body := callHandler(t, handleExpression, req, map[string]any{"query": "GroupHasTracker('one.example')", "groupby": "tracker", "action": "deletedata"})
+	if code != 200 || body != "Processed: 2" {
+		t.Fatalf("deletedata: %d %q", code, body)
+	}
+
+	/* a shares its content with b, which stays behind. */
+	want := []string{"torrents/delete deleteFiles=false&hashes=a", "torrents/delete deleteFiles=true&hashes=c"}
+	if !slices.Equal(f.calls, want) {
+		t.Fatalf("calls %q, want %q", f.calls, want)
+	}
+}
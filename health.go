@@ -0,0 +1,198 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/titlerr/upgraderr/pkg/ratelimit"
+	"github.com/titlerr/upgraderr/pkg/ttlcache"
+	bolt "go.etcd.io/bbolt"
+)
+
+type indexerHealth struct {
+	Failures      uint
+	LastError     string
+	LastFailure   time.Time
+	LastSuccess   time.Time
+	CooldownUntil time.Time
+}
+
+func (h indexerHealth) coolingDown(now time.Time) bool {
+	return h.CooldownUntil.After(now)
+}
+
+func getIndexerHealth(id string) indexerHealth {
+	var h indexerHealth
+	if db == nil {
+		return h
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("health"))
+		if b == nil {
+			return nil
+		}
+
+		if v := b.Get([]byte(id)); v != nil {
+			return json.Unmarshal(v, &h)
+		}
+
+		return nil
+	})
+
+	return h
+}
+
+/* Failures past FailureThreshold back off exponentially from BackoffBase up to BackoffMax, a success clears them. */
+func recordIndexerResult(id string, result error) {
+	if db == nil {
+		return
+	}
+
+	if err := db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("health"))
+		if err != nil {
+			return err
+		}
+
+		var h indexerHealth
+		if v := b.Get([]byte(id)); v != nil {
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+		}
+
+		now := globalTime.Now()
+		if result == nil {
+			h.Failures = 0
+			h.LastSuccess = now
+			h.CooldownUntil = time.Time{}
+		} else {
+			h.Failures++
+			h.LastError = result.Error()
+			h.LastFailure = now
+
+			if h.Failures > config.Search.FailureThreshold {
+				backoff := time.Duration(config.Search.BackoffBase)
+				for i := config.Search.FailureThreshold + 1; i < h.Failures && backoff < time.Duration(config.Search.BackoffMax); i++ {
+					backoff *= 2
+				}
+
+				h.CooldownUntil = now.Add(min(backoff, time.Duration(config.Search.BackoffMax)))
+			}
+		}
+
+		buf, err := json.Marshal(h)
+		if err != nil {
+			return err
+		}
+
+		return b.Put([]byte(id), buf)
+	}); err != nil {
+		slog.Error("Failed to record indexer health", "indexer", id, "error", err)
+	}
+}
+
+func getIndexerLimiter(id string, ic indexerConfig) *ratelimit.Limiter {
+	l, _ := limitermap.GetOrSet("indexer|"+id, ratelimit.PerSecond(ic.RequestsPerMinute/60, int(max(ic.Concurrency, 1))), ttlcache.DefaultTTL)
+	return l
+}
+
+func handleIndexerHealth(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	res := make(map[string]indexerHealth)
+	if err := db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("health"))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var h indexerHealth
+			if err := json.Unmarshal(v, &h); err != nil {
+				return err
+			}
+
+			res[string(k)] = h
+			return nil
+		})
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read indexer health: %q\n", err), 467)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to encode indexer health: %q\n", err), 465)
+	}
+}
+
+func handleIndexerHealthReset(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	var req struct {
+		Indexer string
+	}
+
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 470)
+		return
+	}
+
+	count := 0
+	if err := db.Update(func(tx *bolt.Tx) error {
+		if len(req.Indexer) != 0 {
+			b := tx.Bucket([]byte("health"))
+			if b == nil || b.Get([]byte(req.Indexer)) == nil {
+				return nil
+			}
+
+			count++
+			return b.Delete([]byte(req.Indexer))
+		}
+
+		if b := tx.Bucket([]byte("health")); b != nil {
+			count = b.Stats().KeyN
+		}
+
+		if err := tx.DeleteBucket([]byte("health")); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+
+		_, err := tx.CreateBucket([]byte("health"))
+		return err
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to reset indexer health: %q\n", err), 466)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("Reset: %d\n", count), 200)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestIndexerBackoff(t *testing.T) {
+	saved := db
+	t.Cleanup(func() { db = saved })
+
+	db = openFixture(t, nil)
+	now := time.Unix(1700000000, 0)
+	fakeTime(t, now)
+
+	cooldown := func() time.Duration {
+		h := getIndexerHealth("someindexer")
+		if !h.coolingDown(now) {
+			return 0
+		}
+
+		return h.CooldownUntil.Sub(now)
+	}
+
+	fail := errors.New("timeout")
+	for i := 0; i < 3; i++ {
+		recordIndexerResult("someindexer", fail)
+		if d := cooldown(); d != 0 {
+			t.Fatalf("cooling down for %s after %d failures", d, i+1)
+		}
+	}
+
+	for _, want := range []time.Duration{5 * time.Minute, 10 * time.Minute, 20 * time.Minute} {
+		recordIndexerResult("someindexer", fail)
+		if d := cooldown(); d != want {
+			t.Fatalf("cooling down for %s, want %s", d, want)
+		}
+	}
+
+	recordIndexerResult("someindexer", nil)
+	if h := getIndexerHealth("someindexer"); h.Failures != 0 || h.coolingDown(now) {
+		t.Fatalf("success kept %d failures", h.Failures)
+	}
+
+	recordIndexerResult("someindexer", fail)
+	if cooldown() != 0 {
+		t.Fatalf("threshold not restored after a success")
+	}
+}
@@ -0,0 +1,292 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/autobrr/autobrr/pkg/sharedhttp"
+	"github.com/autobrr/go-qbittorrent"
+	"github.com/moistari/rls"
+	bolt "go.etcd.io/bbolt"
+)
+
+type releaseIDs struct {
+	IMDB string `json:",omitempty"`
+	TVDB string `json:",omitempty"`
+	TMDB string `json:",omitempty"`
+}
+
+/* Optional *arr instances used to resolve ids that aren't tagged or mapped. */
+type arrConfig struct {
+	SonarrHost   string
+	SonarrAPIKey string
+	RadarrHost   string
+	RadarrAPIKey string
+}
+
+type idResolver struct {
+	arrConfig
+	cache map[string]releaseIDs
+}
+
+/* Matches the tag and folder conventions used by the *arrs, e.g. "imdb:tt0000001", "{tvdb-12345}" or "[tmdbid-678]". */
+var idFilter = regexp.MustCompile(`(?i)\b(imdb|tvdb|tmdb)(?:id)?[-:=_]?(tt\d+|\d+)\b`)
+
+func (i releaseIDs) empty() bool {
+	return len(i.IMDB) == 0 && len(i.TVDB) == 0 && len(i.TMDB) == 0
+}
+
+func (i *releaseIDs) merge(o releaseIDs) {
+	if len(i.IMDB) == 0 {
+		i.IMDB = o.IMDB
+	}
+
+	if len(i.TVDB) == 0 {
+		i.TVDB = o.TVDB
+	}
+
+	if len(i.TMDB) == 0 {
+		i.TMDB = o.TMDB
+	}
+}
+
+/* Ids are tracked per show or movie, not per episode. */
+func idKey(r *rls.Release) string {
+	return fmt.Sprintf("%s%04d", rls.MustNormalize(r.Title), r.Year)
+}
+
+func parseIDs(s string) releaseIDs {
+	var ids releaseIDs
+	for _, m := range idFilter.FindAllStringSubmatch(s, -1) {
+		switch strings.ToLower(m[1]) {
+		case "imdb":
+			if strings.HasPrefix(strings.ToLower(m[2]), "tt") {
+				ids.merge(releaseIDs{IMDB: strings.ToLower(m[2])})
+			}
+		case "tvdb":
+			ids.merge(releaseIDs{TVDB: m[2]})
+		case "tmdb":
+			ids.merge(releaseIDs{TMDB: m[2]})
+		}
+	}
+
+	return ids
+}
+
+func newIDResolver(c arrConfig) *idResolver {
+	return &idResolver{arrConfig: c, cache: make(map[string]releaseIDs)}
+}
+
+/* Resolves ids from the torrent's tags, category and paths, then the ids bucket, then the *arrs. */
+func (i *idResolver) resolve(t qbittorrent.Torrent, r *rls.Release) releaseIDs {
+	ids := parseIDs(strings.Join([]string{t.Tags, t.Category, t.SavePath, t.ContentPath}, " "))
+	key := idKey(r)
+	if cached, ok := i.cache[key]; ok {
+		ids.merge(cached)
+		return ids
+	}
+
+	stored := getStoredIDs(key)
+	ids.merge(stored)
+	if ids.empty() {
+		found, err := i.lookup(r)
+		if err != nil {
+			slog.Warn("Unable to lookup ids", "title", r.Title, "error", err)
+		}
+
+		ids.merge(found)
+	}
+
+	if !ids.empty() && ids != stored {
+		if err := putStoredIDs(key, ids); err != nil {
+			slog.Error("Unable to store ids", "title", r.Title, "error", err)
+		}
+	}
+
+	i.cache[key] = ids
+	return ids
+}
+
+func (i *idResolver) lookup(r *rls.Release) (releaseIDs, error) {
+	var host, apikey, endpoint string
+	switch r.Type {
+	case rls.Episode, rls.Series:
+		host, apikey, endpoint = i.SonarrHost, i.SonarrAPIKey, "/api/v3/series/lookup"
+	case rls.Movie:
+		host, apikey, endpoint = i.RadarrHost, i.RadarrAPIKey, "/api/v3/movie/lookup"
+	}
+
+	if len(host) == 0 {
+		return releaseIDs{}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), providerTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimSuffix(host, "/")+endpoint+"?term="+url.QueryEscape(r.Title), nil)
+	if err != nil {
+		return releaseIDs{}, err
+	}
+
+	req.Header.Set("X-Api-Key", apikey)
+	res, err := sharedhttp.Client.Do(req)
+	if err != nil {
+		return releaseIDs{}, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return releaseIDs{}, fmt.Errorf("bad code from %s: %d", host, res.StatusCode)
+	}
+
+	var results []struct {
+		Title  string
+		Year   int
+		ImdbID string
+		TvdbID int
+		TmdbID int
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&results); err != nil {
+		return releaseIDs{}, err
+	}
+
+	title := rls.MustNormalize(r.Title)
+	for _, e := range results {
+		if rls.MustNormalize(e.Title) != title || (r.Year != 0 && e.Year != 0 && r.Year != e.Year) {
+			continue
+		}
+
+		ids := releaseIDs{IMDB: e.ImdbID}
+		if e.TvdbID != 0 {
+			ids.TVDB = fmt.Sprintf("%d", e.TvdbID)
+		}
+
+		if e.TmdbID != 0 {
+			ids.TMDB = fmt.Sprintf("%d", e.TmdbID)
+		}
+
+		return ids, nil
+	}
+
+	return releaseIDs{}, nil
+}
+
+func getStoredIDs(key string) releaseIDs {
+	var ids releaseIDs
+	if db == nil {
+		return ids
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("ids"))
+		if b == nil {
+			return nil
+		}
+
+		if v := b.Get([]byte(key)); v != nil {
+			return json.Unmarshal(v, &ids)
+		}
+
+		return nil
+	})
+
+	return ids
+}
+
+func putStoredIDs(key string, ids releaseIDs) error {
+	if db == nil {
+		return fmt.Errorf("no database")
+	}
+
+	buf, err := json.Marshal(ids)
+	if err != nil {
+		return err
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("ids"))
+		if err != nil {
+			return err
+		}
+
+		if err := b.Put([]byte(key), buf); err != nil {
+			return err
+		}
+
+		return stampEntry(tx, "ids", "", []byte(key), globalTime.Now().Unix())
+	})
+}
+
+type idMapping struct {
+	Title string
+	releaseIDs
+}
+
+func handleIDs(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	var req idMapping
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 470)
+		return
+	}
+
+	if len(req.Title) == 0 {
+		http.Error(w, fmt.Sprintf("No title passed.\n"), 469)
+		return
+	}
+
+	key := idKey(CacheTitle(req.Title))
+	if req.empty() {
+		if err := db.Update(func(tx *bolt.Tx) error {
+			if stamps := stampsBucket(tx, "ids", ""); stamps != nil {
+				if err := stamps.Delete([]byte(key)); err != nil {
+					return err
+				}
+			}
+
+			return tx.Bucket([]byte("ids")).Delete([]byte(key))
+		}); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to remove mapping: %q\n", err), 466)
+			return
+		}
+
+		http.Error(w, fmt.Sprintf("Removed: %q\n", key), 200)
+		return
+	}
+
+	if err := putStoredIDs(key, req.releaseIDs); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to store mapping: %q\n", err), 467)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("Stored: %q\n", key), 200)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/autobrr/go-qbittorrent"
+	"github.com/moistari/rls"
+)
+
+func TestParseIDs(t *testing.T) {
+	for _, c := range []struct {
+		in   string
+		want releaseIDs
+	}{
+		{"", releaseIDs{}},
+		{"imdb:tt0000001", releaseIDs{IMDB: "tt0000001"}},
+		{"IMDB:TT0000001", releaseIDs{IMDB: "tt0000001"}},
+		{"/data/tv/Show Name {tvdb-12345}/Season 01", releaseIDs{TVDB: "12345"}},
+		{"/data/movies/Movie (2020) [tmdbid-678]", releaseIDs{TMDB: "678"}},
+		{"tvdbid=1, imdb_tt2, tmdb3", releaseIDs{IMDB: "tt2", TVDB: "1", TMDB: "3"}},
+		{"tvdb-1 tvdb-2", releaseIDs{TVDB: "1"}},
+		{"imdb-12345", releaseIDs{}},
+		{"/data/tmdb 2024 collection/Movie", releaseIDs{}},
+		{"/data/tmdb2000s/Movie", releaseIDs{}},
+		{"/data/mytvdb-1/Show", releaseIDs{}},
+		{"/data/tv_tvdb-1/Show", releaseIDs{}},
+		{"/data/tvdb-12345x/Show", releaseIDs{}},
+		{"/data/tvdb/Show.S01", releaseIDs{}},
+		{"Movie.imdb.tt0000001.1080p", releaseIDs{}},
+	} {
+		if got := parseIDs(c.in); got != c.want {
+			t.Errorf("%q: got %+v, want %+v", c.in, got, c.want)
+		}
+	}
+}
+
+func TestIDResolver(t *testing.T) {
+	saved := db
+	t.Cleanup(func() { db = saved })
+	db = openFixture(t, nil)
+
+	var lookups []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "key" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		lookups = append(lookups, r.URL.Path+" "+r.URL.Query().Get("term"))
+		json.NewEncoder(w).Encode([]map[string]any{
+			{"title": "Other Show", "year": 2020, "tvdbId": 1},
+			{"title": "Show Name", "year": 2019, "tvdbId": 2},
+			{"title": "Show Name", "year": 2020, "tvdbId": 3, "imdbId": "tt0000003"},
+		})
+	}))
+	t.Cleanup(srv.Close)
+
+	show := rls.ParseString("Show.Name.2020.S01E02.1080p.WEB.h264-GRP")
+	other := rls.ParseString("Other.Show.2021.S01E02.1080p.WEB.h264-GRP")
+	old := rls.ParseString("Show.Name.2018.S01E01.1080p.WEB.h264-GRP")
+	movie := rls.ParseString("Movie.2020.1080p.BluRay.x264-GRP")
+
+	i := newIDResolver(arrConfig{SonarrHost: srv.URL + "/", SonarrAPIKey: "key"})
+	if got := i.resolve(qbittorrent.Torrent{}, &show); got != (releaseIDs{IMDB: "tt0000003", TVDB: "3"}) {
+		t.Fatalf("lookup: got %+v", got)
+	}
+
+	if got := i.resolve(qbittorrent.Torrent{}, &show); got != (releaseIDs{IMDB: "tt0000003", TVDB: "3"}) || len(lookups) != 1 {
+		t.Fatalf("cached: got %+v after %q", got, lookups)
+	}
+
+	if lookups[0] != "/api/v3/series/lookup Show Name" {
+		t.Fatalf("bad lookup %q", lookups[0])
+	}
+
+	/* Ids in the torrent win over the cache, which only fills the gaps. */
+	if got := i.resolve(qbittorrent.Torrent{Tags: "tvdb:9"}, &show); got != (releaseIDs{IMDB: "tt0000003", TVDB: "9"}) {
+		t.Fatalf("tagged: got %+v", got)
+	}
+
+	/* A fresh resolver reads the ids bucket before asking the *arrs. */
+	i = newIDResolver(arrConfig{SonarrHost: srv.URL, SonarrAPIKey: "key"})
+	if got := i.resolve(qbittorrent.Torrent{}, &show); got != (releaseIDs{IMDB: "tt0000003", TVDB: "3"}) || len(lookups) != 1 {
+		t.Fatalf("stored: got %+v after %q", got, lookups)
+	}
+
+	if got := i.resolve(qbittorrent.Torrent{SavePath: "/data/tv/Other Show {tmdb-5}"}, &other); got != (releaseIDs{TMDB: "5"}) || len(lookups) != 1 {
+		t.Fatalf("path: got %+v after %q", got, lookups)
+	}
+
+	if got := getStoredIDs(idKey(&other)); got != (releaseIDs{TMDB: "5"}) {
+		t.Fatalf("path ids not stored: %+v", got)
+	}
+
+	/* No match for the year, and no radarr for movies. */
+	if got := i.resolve(qbittorrent.Torrent{}, &old); !got.empty() {
+		t.Fatalf("year mismatch: got %+v", got)
+	}
+
+	if got := i.resolve(qbittorrent.Torrent{}, &movie); !got.empty() || len(lookups) != 2 {
+		t.Fatalf("movie: got %+v after %q", got, lookups)
+	}
+}
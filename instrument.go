@@ -0,0 +1,143 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/titlerr/upgraderr/pkg/metrics"
+	"github.com/titlerr/upgraderr/pkg/ttlcache"
+)
+
+var (
+	httpResponses = metrics.Default.NewCounterVec("upgraderr_http_responses_total",
+		"Responses per route and status code, the codes carry each endpoint's outcome.", "route", "code")
+	httpDuration = metrics.Default.NewHistogramVec("upgraderr_http_request_duration_seconds",
+		"Time spent serving each route.", metrics.DefBuckets, "route")
+	upgradeResults = metrics.Default.NewCounterVec("upgraderr_upgrade_results_total",
+		"Outcomes of /api/upgrade: unique, cross, upgrade or notupgrade.", "result")
+	crossResults = metrics.Default.NewCounterVec("upgraderr_cross_results_total",
+		"Cross injections per resulting code, 200 being success.", "code")
+	torrentActions = metrics.Default.NewCounterVec("upgraderr_torrent_actions_total",
+		"Torrents acted on per endpoint and action.", "endpoint", "action")
+	clientDuration = metrics.Default.NewHistogramVec("upgraderr_qbittorrent_request_duration_seconds",
+		"qBittorrent API latency per host and call.", metrics.DefBuckets, "host", "call")
+	clientErrors = metrics.Default.NewCounterVec("upgraderr_qbittorrent_errors_total",
+		"Failed qBittorrent API calls per host and call.", "host", "call")
+	_ = metrics.Default.NewCounterFunc("upgraderr_cache_requests_total",
+		"Cache lookups per cache, result is hit or miss.", func(emit func(v float64, values ...string)) {
+			for name, c := range caches {
+				s := c.Stats()
+				emit(float64(s.Hits), name, "hit")
+				emit(float64(s.Misses), name, "miss")
+			}
+		}, "cache", "result")
+	_ = metrics.Default.NewCounterFunc("upgraderr_cache_evictions_total",
+		"Entries leaving each cache, reason is expired, deleted or evicted.", func(emit func(v float64, values ...string)) {
+			for name, c := range caches {
+				s := c.Stats()
+				emit(float64(s.Expirations), name, "expired")
+				emit(float64(s.Deletions), name, "deleted")
+				emit(float64(s.Evictions), name, "evicted")
+			}
+		}, "cache", "reason")
+	_ = metrics.Default.NewGaugeFunc("upgraderr_cache_entries",
+		"Entries held by each cache.", func(emit func(v float64, values ...string)) {
+			for name, c := range caches {
+				emit(float64(c.Len()), name)
+			}
+		}, "cache")
+	indexerRequests = metrics.Default.NewCounterVec("upgraderr_indexer_requests_total",
+		"Indexer requests per indexer and kind (search, enclosure, rss), result is ok or error.", "indexer", "kind", "result")
+)
+
+func instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		/* Raw paths of requests matching no route would give every probe its own series. */
+		route := "unmatched"
+		if rc := chi.RouteContext(r.Context()); rc != nil && len(rc.RoutePattern()) != 0 {
+			route = rc.RoutePattern()
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		httpResponses.Inc(route, strconv.Itoa(status))
+		httpDuration.Observe(time.Since(start).Seconds(), route)
+	})
+}
+
+/* Deferred by the client wrappers: defer observeClient(c.Host, "call", time.Now(), &err). */
+func observeClient(host, call string, start time.Time, err *error) {
+	clientDuration.Observe(time.Since(start).Seconds(), host, call)
+	if *err != nil {
+		clientErrors.Inc(host, call)
+	}
+}
+
+type cacheStats interface {
+	Len() int
+	Stats() ttlcache.Stats
+}
+
+/* The global caches by name, reported on /metrics and /api/debug/caches. */
+var caches = map[string]cacheStats{
+	"clientmap":       clientmap,
+	"torrentmap":      torrentmap,
+	"titlemap":        titlemap,
+	"formattedmap":    formattedmap,
+	"unregisteredmap": unregisteredmap,
+	"limitermap":      limitermap,
+}
+
+type cacheReport struct {
+	Entries int
+	ttlcache.Stats
+}
+
+func handleDebugCaches(w http.ResponseWriter, r *http.Request) {
+	res := make(map[string]cacheReport, len(caches))
+	for name, c := range caches {
+		res[name] = cacheReport{Entries: c.Len(), Stats: c.Stats()}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(res); err != nil {
+		http.Error(w, err.Error(), 466)
+	}
+}
+
+func countIndexerRequest(indexer, kind string, err error) {
+	if err != nil {
+		indexerRequests.Inc(indexer, kind, "error")
+	} else {
+		indexerRequests.Inc(indexer, kind, "ok")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func TestInstrumentHandler(t *testing.T) {
+	r := chi.NewRouter()
+	r.Use(instrumentHandler)
+	r.Get("/api/instrumented/{id}", func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "nope", 467)
+	})
+
+	before := httpResponses.Value("unmatched", "404")
+	for _, path := range []string{"/api/instrumented/1", "/api/instrumented/2", "/random/probe", "/.env"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	}
+
+	if v := httpResponses.Value("/api/instrumented/{id}", "467"); v != 2 {
+		t.Fatalf("route counted %v times", v)
+	}
+
+	if v := httpResponses.Value("unmatched", "404") - before; v != 2 {
+		t.Fatalf("unmatched counted %v times", v)
+	}
+
+	if v := httpResponses.Value("/random/probe", "404") + httpResponses.Value("/.env", "404"); v != 0 {
+		t.Fatalf("raw paths used as labels")
+	}
+}
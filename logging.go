@@ -0,0 +1,96 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"log/slog"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+func initLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.Log.Level)); err != nil {
+		level = slog.LevelInfo
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler = slog.NewTextHandler(os.Stdout, opts)
+	if Normalize(config.Log.Format) == "json" {
+		h = slog.NewJSONHandler(os.Stdout, opts)
+	}
+
+	slog.SetDefault(slog.New(h))
+}
+
+/* The request's logger, carrying chi's request id. */
+func requestLog(r *http.Request) *slog.Logger {
+	if id := middleware.GetReqID(r.Context()); len(id) != 0 {
+		return slog.Default().With("request_id", id)
+	}
+
+	return slog.Default()
+}
+
+/* The request logger annotated with whatever the request knows about its client and torrent. */
+func (c *upgradereq) logger() *slog.Logger {
+	l := c.log
+	if l == nil {
+		l = slog.Default()
+	}
+
+	if len(c.Host) != 0 {
+		l = l.With("host", c.Host)
+	}
+
+	if len(c.Name) != 0 {
+		l = l.With("name", c.Name)
+	}
+
+	if len(c.Hash) != 0 {
+		l = l.With("hash", c.Hash)
+	}
+
+	return l
+}
+
+/* Replaces middleware.Logger, one line per request at info. */
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+		next.ServeHTTP(ww, r)
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		requestLog(r).Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", status,
+			"bytes", ww.BytesWritten(),
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr)
+	})
+}
@@ -22,13 +22,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/base64"
-	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"log/slog"
+	"maps"
 	"net/http"
 	"net/http/httputil"
+	"net/url"
 	"os"
+	"path"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
@@ -43,10 +47,11 @@ import (
 	"github.com/expr-lang/expr/vm"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
-	"github.com/kylesanderson/go-jackett"
 	"github.com/moistari/rls"
 	"github.com/pkg/errors"
 	du "github.com/ricochet2200/go-disk-usage/du"
+	"github.com/titlerr/upgraderr/pkg/metrics"
+	"github.com/titlerr/upgraderr/pkg/ratelimit"
 	"github.com/titlerr/upgraderr/pkg/timecache"
 	"github.com/titlerr/upgraderr/pkg/ttlcache"
 	bolt "go.etcd.io/bbolt"
@@ -71,18 +76,17 @@ type upgradereq struct {
 	Hash    string
 	Torrent json.RawMessage
 	Client  *qbittorrent.Client
-}
 
-type timeentry struct {
-	e map[string][]qbittorrent.Torrent
-	m sync.RWMutex
+	log     *slog.Logger
+	trigger auditTrigger
 }
 
 var db *bolt.DB
 var clientmap = ttlcache.New[qbittorrent.Config, *qbittorrent.Client](
 	ttlcache.Options[qbittorrent.Config, *qbittorrent.Client]{}.
 		SetDefaultTTL(time.Minute * 5).
-		SetTimerResolution(time.Minute * 1))
+		SetTimerResolution(time.Minute * 1).
+		SetErrorTTL(time.Second * 10))
 
 var torrentmap = ttlcache.New[qbittorrent.Config, *timeentry](
 	ttlcache.Options[qbittorrent.Config, *timeentry]{}.
@@ -90,20 +94,42 @@ var torrentmap = ttlcache.New[qbittorrent.Config, *timeentry](
 		SetTimerResolution(time.Second * 1).
 		DisableUpdateTime(true))
 
-var titlemap = ttlcache.New[string, *rls.Release](
-	ttlcache.Options[string, *rls.Release]{}.
-		SetDefaultTTL(time.Minute * 15).
-		SetTimerResolution(time.Minute * 5))
+var titleOptions = ttlcache.Options[string, *rls.Release]{}.
+	SetDefaultTTL(time.Minute * 15).
+	SetTimerResolution(time.Minute * 5).
+	SetMaxEntries(50000)
+
+var formattedOptions = ttlcache.Options[string, string]{}.
+	SetDefaultTTL(time.Minute * 15).
+	SetTimerResolution(time.Minute * 5).
+	SetMaxEntries(50000)
+
+/* Replaced by persistCaches at startup when the database keeps them. */
+var titlemap = ttlcache.New[string, *rls.Release](titleOptions)
+var formattedmap = ttlcache.New[string, string](formattedOptions)
+
+/* Consecutive unregistered observations per host and hash. */
+var unregisteredmap = ttlcache.New[string, uint](
+	ttlcache.Options[string, uint]{}.
+		SetDefaultTTL(time.Hour * 24).
+		SetTimerResolution(time.Minute * 5).
+		DisableUpdateTime(true))
 
-var formattedmap = ttlcache.New[string, string](
-	ttlcache.Options[string, string]{}.
-		SetDefaultTTL(time.Minute * 15).
-		SetTimerResolution(time.Minute * 5))
+/* qBittorrent request limiters per host. */
+var limitermap = ttlcache.New[string, *ratelimit.Limiter](
+	ttlcache.Options[string, *ratelimit.Limiter]{}.
+		SetDefaultTTL(time.Minute * 5).
+		SetTimerResolution(time.Minute * 1))
 
 var globalTime = timecache.New(timecache.Options{})
 
 func main() {
+	initConfig()
+	initLogging()
 	initDatabase()
+	persistCaches()
+	startRSS()
+	go maintainDatabase()
 
 	go func() {
 		http.ListenAndServe(":6060", nil)
@@ -113,22 +139,40 @@ func main() {
 
 	r.Use(middleware.RequestID)
 	r.Use(middleware.RealIP)
-	r.Use(middleware.Logger)
+	r.Use(logRequests)
 	r.Use(middleware.Recoverer)
+	r.Use(instrumentHandler)
 	r.Use(middleware.URLFormat)
-	r.Use(middleware.Timeout(60 * time.Second))
-
-	r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.Write([]byte("k8s"))
-	})
 
-	r.Post("/api/upgrade", handleUpgrade)
-	r.Post("/api/cross", handleCross)
-	r.Post("/api/clean", handleClean)
-	r.Post("/api/unregistered", handleUnregistered)
-	r.Post("/api/expression", handleExpression)
-	r.Post("/api/autobrr/filterupdate", handleAutobrrFilterUpdate)
+	/* Injecting every search result can retry for most of a minute per torrent, so the search trigger runs until it is done. */
 	r.Post("/api/jackett/searchtrigger", handleTorznabCrossSearch)
+
+	r.Group(func(r chi.Router) {
+		r.Use(middleware.Timeout(60 * time.Second))
+
+		r.Get("/healthz", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("k8s"))
+		})
+
+		r.Handle("/metrics", metrics.Default.Handler())
+		r.Post("/api/upgrade", handleUpgrade)
+		r.Post("/api/cross", handleCross)
+		r.Post("/api/clean", handleClean)
+		r.Post("/api/unregistered", handleUnregistered)
+		r.Post("/api/expression", handleExpression)
+		r.Post("/api/autobrr/filterupdate", handleAutobrrFilterUpdate)
+		r.Post("/api/ids", handleIDs)
+		r.Get("/api/indexers/health", handleIndexerHealth)
+		r.Post("/api/indexers/health/reset", handleIndexerHealthReset)
+		r.Get("/api/db/stats", handleDBStats)
+		r.Get("/api/debug/caches", handleDebugCaches)
+		r.Get("/api/audit", handleAudit)
+		r.Get("/api/quarantine", handleQuarantine)
+		r.Post("/api/quarantine/restore", handleQuarantineRestore)
+		r.Post("/api/quarantine/purge", handleQuarantinePurge)
+		r.Get("/api/db/export", handleDBExport)
+		r.Post("/api/db/import", handleDBImport)
+	})
 	http.ListenAndServe(":6940", r) /* immutable. this is b's favourite positive 4digit number not starting with a 0. */
 }
 
@@ -139,15 +183,17 @@ func getClient(req *upgradereq) error {
 		Password: req.Password,
 	}
 
-	c, ok := clientmap.Get(s)
-	if !ok {
-		c = qbittorrent.NewClient(s)
-
+	c, err := clientmap.GetOrLoad(s, func(s qbittorrent.Config) (*qbittorrent.Client, time.Duration, error) {
+		c := qbittorrent.NewClient(s)
 		if err := c.Login(); err != nil {
-			return err
+			return nil, 0, err
 		}
 
-		clientmap.Set(s, c, ttlcache.DefaultTTL)
+		return c, ttlcache.DefaultTTL, nil
+	})
+
+	if err != nil {
+		return err
 	}
 
 	req.Client = c
@@ -158,118 +204,168 @@ func heartbeat(w http.ResponseWriter, r *http.Request) {
 	http.Error(w, "Alive", 200)
 }
 
+/*
+Each client's snapshot is kept up to date from sync/maindata deltas, concurrent callers share a single sync.
+A snapshot is reused while fresh, CacheBypass always syncs.
+*/
 func (c *upgradereq) getAllTorrents() (*timeentry, error) {
+	return c.getSnapshot(c.CacheBypass == 1)
+}
+
+func (c *upgradereq) getSnapshot(sync bool) (*timeentry, error) {
 	set := qbittorrent.Config{
 		Host:     c.Host,
 		Username: c.User,
 		Password: c.Password,
 	}
 
-	getOrInitialize := func() ttlcache.Item[*timeentry] {
-		it, ok := torrentmap.GetOrSetItem(set, &timeentry{}, ttlcache.DefaultTTL)
-		if !ok {
-			return torrentmap.SetItem(set, &timeentry{}, ttlcache.DefaultTTL)
-		}
-
-		if c.CacheBypass == 1 {
-			val := it.GetValue()
-			val.m.RLock()
-			defer val.m.RUnlock()
-			if val.e != nil {
-				return torrentmap.SetItem(set, &timeentry{}, ttlcache.DefaultTTL)
-			}
-		}
-
-		return it
+	prev, ok := torrentmap.Get(set)
+	if ok && !sync && prev.fresh() {
+		return prev, nil
 	}
 
-	var te ttlcache.Item[*timeentry]
-	var val *timeentry
-
-	err := GetOrUpdate(func() *sync.RWMutex {
-		te = getOrInitialize()
-		val = te.GetValue()
-		return &val.m
-	}, func() bool {
-		return val.e != nil
-	}, func() error {
-		if val.e != nil {
-			return nil
-		}
-
-		torrents, err := c.Client.GetTorrents(qbittorrent.TorrentFilterOptions{})
-		if err != nil {
-			return err
-		}
-
-		val.e = make(map[string][]qbittorrent.Torrent)
-
-		for _, t := range torrents {
-			s := CacheFormatted(t.Name)
-			val.e[s] = append(val.e[s], t)
-		}
-
-		dur := globalTime.Now().Sub(te.GetTime().Add(-te.GetDuration()))
-		if dur < time.Second*1 {
-			dur = time.Second * 1
-		}
-
-		torrentmap.Set(set, val, dur)
-		return nil
+	return torrentmap.Reload(set, func(set qbittorrent.Config) (*timeentry, time.Duration, error) {
+		prev, _ := torrentmap.Get(set)
+		val, err := c.syncTorrents(prev)
+		return val, ttlcache.DefaultTTL, err
 	})
+}
 
-	return val, err
+func (c *upgradereq) getTorrents(opts qbittorrent.TorrentFilterOptions) (t []qbittorrent.Torrent, err error) {
+	defer observeClient(c.Host, "torrents", time.Now(), &err)
+	return c.Client.GetTorrents(opts)
 }
 
-func (c *upgradereq) getFiles(hash string) (*qbittorrent.TorrentFiles, error) {
+func (c *upgradereq) getFiles(hash string) (f *qbittorrent.TorrentFiles, err error) {
+	defer observeClient(c.Host, "files", time.Now(), &err)
 	return c.Client.GetFilesInformation(hash)
 }
 
-func (c *upgradereq) getCategories() (map[string]qbittorrent.Category, error) {
+func (c *upgradereq) getCategories() (m map[string]qbittorrent.Category, err error) {
+	defer observeClient(c.Host, "categories", time.Now(), &err)
 	return c.Client.GetCategories()
 }
 
-func (c *upgradereq) createCategory(cat, savePath string) error {
+func (c *upgradereq) createCategory(cat, savePath string) (err error) {
+	defer observeClient(c.Host, "createcategory", time.Now(), &err)
+	defer c.audit("createcategory", cat, nil, &err)
 	return c.Client.CreateCategory(cat, savePath)
 }
 
 func (c *upgradereq) recheckTorrent() error {
-	return c.Client.Recheck([]string{c.Hash})
+	return c.recheckTorrents([]string{c.Hash})
 }
 
-func (c *upgradereq) setTorrentManagement(enable bool) error {
+func (c *upgradereq) recheckTorrents(hashes []string) (err error) {
+	defer observeClient(c.Host, "recheck", time.Now(), &err)
+	defer c.audit("recheck", "", hashes, &err)
+	return c.Client.Recheck(hashes)
+}
+
+func (c *upgradereq) setTorrentManagement(enable bool) (err error) {
+	defer observeClient(c.Host, "automanagement", time.Now(), &err)
+	defer c.audit("automanagement", strconv.FormatBool(enable), []string{c.Hash}, &err)
 	return c.Client.SetAutoManagement([]string{c.Hash}, enable)
 }
 
 func (c *upgradereq) resumeTorrent() error {
-	return c.Client.Resume([]string{c.Hash})
+	return c.resumeTorrents([]string{c.Hash})
+}
+
+func (c *upgradereq) resumeTorrents(hashes []string) (err error) {
+	defer observeClient(c.Host, "resume", time.Now(), &err)
+	defer c.audit("resume", "", hashes, &err)
+	return c.Client.Resume(hashes)
 }
 
 func (c *upgradereq) pauseTorrent() error {
-	return c.Client.Pause([]string{c.Hash})
+	return c.pauseTorrents([]string{c.Hash})
+}
+
+func (c *upgradereq) pauseTorrents(hashes []string) (err error) {
+	defer observeClient(c.Host, "pause", time.Now(), &err)
+	defer c.audit("pause", "", hashes, &err)
+	return c.Client.Pause(hashes)
+}
+
+func (c *upgradereq) setForceStart(hashes []string, enable bool) (err error) {
+	defer observeClient(c.Host, "forcestart", time.Now(), &err)
+	defer c.audit("forcestart", strconv.FormatBool(enable), hashes, &err)
+	return c.Client.SetForceStart(hashes, enable)
 }
 
 func (c *upgradereq) setLocationTorrent(location string) error {
-	return c.Client.SetLocation([]string{c.Hash}, location)
+	return c.setLocation([]string{c.Hash}, location)
+}
+
+func (c *upgradereq) setLocation(hashes []string, location string) (err error) {
+	defer observeClient(c.Host, "setlocation", time.Now(), &err)
+	defer c.audit("setlocation", location, hashes, &err)
+	return c.Client.SetLocation(hashes, location)
+}
+
+func (c *upgradereq) exportTorrent(hash string) (b []byte, err error) {
+	defer observeClient(c.Host, "export", time.Now(), &err)
+	return c.Client.ExportTorrent(hash)
 }
 
 func (c *upgradereq) deleteTorrent() error {
-	return c.Client.DeleteTorrents([]string{c.Hash}, false)
+	return c.deleteTorrents([]string{c.Hash}, false)
+}
+
+func (c *upgradereq) deleteTorrents(hashes []string, deleteFiles bool) (err error) {
+	defer observeClient(c.Host, "delete", time.Now(), &err)
+	if deleteFiles {
+		defer c.audit("deletedata", "", hashes, &err)
+	} else {
+		defer c.audit("delete", "", hashes, &err)
+	}
+
+	return c.Client.DeleteTorrents(hashes, deleteFiles)
+}
+
+func (c *upgradereq) setCategory(hashes []string, category string) (err error) {
+	defer observeClient(c.Host, "setcategory", time.Now(), &err)
+	defer c.audit("setcategory", category, hashes, &err)
+	return c.Client.SetCategory(hashes, category)
+}
+
+func (c *upgradereq) addTags(hashes []string, tags string) (err error) {
+	defer observeClient(c.Host, "addtags", time.Now(), &err)
+	defer c.audit("addtags", tags, hashes, &err)
+	return c.Client.AddTags(hashes, tags)
+}
+
+func (c *upgradereq) removeTags(hashes []string, tags string) (err error) {
+	defer observeClient(c.Host, "removetags", time.Now(), &err)
+	defer c.audit("removetags", tags, hashes, &err)
+	return c.Client.RemoveTags(hashes, tags)
 }
 
-func (c *upgradereq) renameFile(hash, oldPath, newPath string) error {
+func (c *upgradereq) renameFile(hash, oldPath, newPath string) (err error) {
+	defer observeClient(c.Host, "renamefile", time.Now(), &err)
+	defer c.audit("renamefile", oldPath+" => "+newPath, []string{hash}, &err)
 	return c.Client.RenameFile(hash, oldPath, newPath)
 }
 
-func (c *upgradereq) getTrackers() ([]qbittorrent.TorrentTracker, error) {
+func (c *upgradereq) getTrackers() (t []qbittorrent.TorrentTracker, err error) {
+	defer observeClient(c.Host, "trackers", time.Now(), &err)
 	return c.Client.GetTorrentTrackers(c.Hash)
 }
 
 func (c *upgradereq) announceTrackers() error {
-	return c.Client.ReAnnounceTorrents([]string{c.Hash})
+	return c.reannounceTorrents([]string{c.Hash})
+}
+
+func (c *upgradereq) reannounceTorrents(hashes []string) (err error) {
+	defer observeClient(c.Host, "reannounce", time.Now(), &err)
+	defer c.audit("reannounce", "", hashes, &err)
+	return c.Client.ReAnnounceTorrents(hashes)
 }
 
-func (c *upgradereq) submitTorrent(opts *qbittorrent.TorrentAddOptions) error {
+func (c *upgradereq) submitTorrent(opts *qbittorrent.TorrentAddOptions) (err error) {
+	defer observeClient(c.Host, "add", time.Now(), &err)
+	defer c.audit("add", c.Name, []string{c.Hash}, &err)
 	f, err := os.CreateTemp("", "upgraderr-sub.")
 	if err != nil {
 		return fmt.Errorf("Unable to tmpfile: %q", err)
@@ -286,33 +382,26 @@ func (c *upgradereq) submitTorrent(opts *qbittorrent.TorrentAddOptions) error {
 		return fmt.Errorf("Unable to sync (%q): %q", err, f.Name())
 	}
 
-	return c.Client.AddTorrentFromFile(f.Name(), opts.Prepare())
+	err = c.Client.AddTorrentFromFile(f.Name(), opts.Prepare())
+	return err
 }
 
+/* Always syncs first, callers poll this while qBittorrent works on the torrent. */
 func (c *upgradereq) getTorrent() (qbittorrent.Torrent, error) {
-	if len(c.Hash) != 0 {
-		torrents, err := c.Client.GetTorrents(qbittorrent.TorrentFilterOptions{Hashes: []string{c.Hash}})
-		if err != nil {
-			return qbittorrent.Torrent{}, err
-		} else if len(torrents) == 0 {
-			return qbittorrent.Torrent{}, fmt.Errorf("Unable to find Hash: %q", c.Hash)
-		}
+	mp, err := c.getSnapshot(true)
+	if err != nil {
+		return qbittorrent.Torrent{}, err
+	}
 
-		for _, t := range torrents {
-			if t.Hash == c.Hash {
-				return t, nil
-			}
+	if len(c.Hash) != 0 {
+		if t, ok := mp.torrent(c.Hash); ok {
+			return t, nil
 		}
 
-		return qbittorrent.Torrent{}, fmt.Errorf("Unable to find Hash after lookup: %q", c.Hash)
-	}
-
-	t, err := c.Client.GetTorrents(qbittorrent.TorrentFilterOptions{})
-	if err != nil {
-		return qbittorrent.Torrent{}, err
+		return qbittorrent.Torrent{}, fmt.Errorf("Unable to find Hash: %q", c.Hash)
 	}
 
-	for _, v := range t {
+	for _, v := range mp.e[CacheFormatted(c.Name)] {
 		switch v.State {
 		case qbittorrent.TorrentStateError, qbittorrent.TorrentStateMissingFiles,
 			qbittorrent.TorrentStatePausedDl, qbittorrent.TorrentStatePausedUp,
@@ -323,7 +412,7 @@ func (c *upgradereq) getTorrent() (qbittorrent.Torrent, error) {
 			}
 		default:
 			if c.Name == v.Name {
-				fmt.Printf("Found non-conforming: %q | %q\n", v.Name, v.State)
+				c.logger().Warn("Found non-conforming", "state", v.State, "hash", v.Hash)
 			}
 		}
 	}
@@ -338,6 +427,8 @@ func handleUpgrade(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.bind(r)
+
 	if len(req.Name) == 0 {
 		http.Error(w, fmt.Sprintf("No title passed.\n"), 469)
 		return
@@ -356,6 +447,7 @@ func handleUpgrade(w http.ResponseWriter, r *http.Request) {
 
 	v, ok := mp.e[CacheFormatted(req.Name)]
 	if !ok {
+		upgradeResults.Inc("unique")
 		http.Error(w, fmt.Sprintf("Unique submission: %q\n", req.Name), 200)
 		return
 	}
@@ -400,10 +492,13 @@ func handleUpgrade(w http.ResponseWriter, r *http.Request) {
 	}
 
 	if code >= 240 && code <= 250 {
+		upgradeResults.Inc("cross")
 		http.Error(w, fmt.Sprintf("Cross submission: %q\n", req.Name), code)
 	} else if code > 200 && code < 240 {
+		upgradeResults.Inc("notupgrade")
 		http.Error(w, fmt.Sprintf("Not an upgrade submission: %q => %q\n", req.Name, parent.t.Name), code)
 	} else {
+		upgradeResults.Inc("upgrade")
 		http.Error(w, fmt.Sprintf("Upgrade submission: %q\n", req.Name), 200)
 	}
 }
@@ -415,6 +510,8 @@ func handleClean(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.bind(r)
+
 	if err := getClient(&req); err != nil {
 		http.Error(w, fmt.Sprintf("Unable to get client: %q\n", err), 471)
 		return
@@ -426,7 +523,7 @@ func handleClean(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	t := globalTime.Now().Unix()
+	log := req.logger()
 	hashes := make([]string, 0)
 	for _, v := range mp.e {
 		if len(v) == 0 {
@@ -483,7 +580,7 @@ func handleClean(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 
-		fmt.Printf("Parent: %q\n", parentName)
+		log.Debug("Parent", "parent", parentName)
 
 		parentrls := *CacheTitle(parentName)
 		for _, child := range v {
@@ -499,12 +596,12 @@ func handleClean(w http.ResponseWriter, r *http.Request) {
 					continue
 				}
 
-				if subChild.CompletionOn < 1 || t-int64(subChild.CompletionOn) < 1209600 {
+				if !cleanAged(subChild) {
 					bContinue = true
 					break
 				}
 
-				fmt.Printf("Removing: %q\n", subChild.Name)
+				log.Info("Removing", "name", subChild.Name, "hash", subChild.Hash, "parent", parentName)
 				childHashes = append(childHashes, subChild.Hash)
 			}
 
@@ -521,14 +618,36 @@ func handleClean(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := req.Client.DeleteTorrents(hashes, true); err != nil {
+	if config.Quarantine.Enabled {
+		if err := req.quarantineTorrents(mp, hashes); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to quarantine %d torrents: %s", len(hashes), err), 420)
+			return
+		}
+
+		torrentActions.Add(float64(len(hashes)), "clean", "quarantine")
+		if _, err := req.purgeQuarantine(); err != nil {
+			log.Error("Unable to purge quarantine", "error", err)
+		}
+
+		http.Error(w, fmt.Sprintf("Quarantined %d torrents.", len(hashes)), 200)
+		return
+	}
+
+	if err := req.deleteTorrents(hashes, true); err != nil {
 		http.Error(w, fmt.Sprintf("Failed to submit %d torrents to remove: %s", len(hashes), err), 420)
 		return
 	}
 
+	torrentActions.Add(float64(len(hashes)), "clean", "deletedata")
+
 	http.Error(w, fmt.Sprintf("Removed %d torrents.", len(hashes)), 200)
 }
 
+/* Clean leaves anything that has not finished, or finished less than two weeks ago. */
+func cleanAged(t qbittorrent.Torrent) bool {
+	return t.CompletionOn > 0 && globalTime.Now().Unix()-t.CompletionOn >= int64(14*24*time.Hour/time.Second)
+}
+
 func handleCross(w http.ResponseWriter, r *http.Request) {
 	var req upgradereq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
@@ -536,6 +655,8 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.bind(r)
+
 	if len(req.Name) == 0 {
 		http.Error(w, fmt.Sprintf("No title passed.\n"), 499)
 		return
@@ -552,13 +673,6 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	requestrls := Entry{r: CacheTitle(req.Name)}
-	v, ok := mp.e[CacheFormatted(req.Name)]
-	if !ok {
-		http.Error(w, fmt.Sprintf("Not a cross-submission: %q\n", req.Name), 420)
-		return
-	}
-
 	if t, err := base64.StdEncoding.DecodeString(strings.Trim(strings.TrimSpace(string(req.Torrent)), `"`)); err == nil {
 		req.Torrent = t
 	} else {
@@ -580,15 +694,31 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	code, msg := req.crossTorrent(mp)
+	http.Error(w, msg, code)
+}
+
+/* Injects req.Torrent next to a completed, matching torrent, returning the http code and message. */
+func (c *upgradereq) crossTorrent(mp *timeentry) (code int, msg string) {
+	defer func() {
+		crossResults.Inc(strconv.Itoa(code))
+	}()
+
+	requestrls := Entry{r: CacheTitle(c.Name)}
+	v, ok := mp.e[CacheFormatted(c.Name)]
+	if !ok {
+		return 420, fmt.Sprintf("Not a cross-submission: %q\n", c.Name)
+	}
+
 	for _, childtor := range v {
 		child := Entry{t: childtor, r: CacheTitle(childtor.Name)}
 		if rls.Compare(*requestrls.r, *child.r) != 0 || child.t.Progress != 1.0 {
 			continue
 		}
 
-		m, err := req.getFiles(child.t.Hash)
+		m, err := c.getFiles(child.t.Hash)
 		if err != nil {
-			fmt.Printf("Failed to get Files %q: %q\n", req.Name, err)
+			c.logger().Error("Failed to get files", "parent", child.t.Hash, "error", err)
 			continue
 		}
 
@@ -600,10 +730,9 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 
 		cat := child.t.Category
 		if strings.Contains(cat, ".cross-seed") == false {
-			cats, err := req.getCategories()
+			cats, err := c.getCategories()
 			if err != nil {
-				http.Error(w, fmt.Sprintf("Failed to get categories (%q): %q\n", child.t.Name, err), 496)
-				return
+				return 496, fmt.Sprintf("Failed to get categories (%q): %q\n", child.t.Name, err)
 			}
 
 			if v, ok := cats[cat]; ok {
@@ -615,9 +744,8 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 				cat += ".cross-seed"
 
 				if _, ok := cats[cat]; !ok {
-					if err := req.createCategory(cat, save); err != nil {
-						http.Error(w, fmt.Sprintf("Failed to create new category (%q): %q\n", cat, err), 495)
-						return
+					if err := c.createCategory(cat, save); err != nil {
+						return 495, fmt.Sprintf("Failed to create new category (%q): %q\n", cat, err)
 					}
 				}
 			}
@@ -637,35 +765,34 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 		}
 
 		if err = retry.Do(func() error {
-			return req.submitTorrent(opts)
+			return c.submitTorrent(opts)
 		},
-			retry.OnRetry(func(n uint, err error) { fmt.Printf("%q: submission attempt %d - %v\n", err, n, req.Name) }),
+			retry.OnRetry(func(n uint, err error) { c.logger().Debug("Submission attempt failed", "attempt", n, "error", err) }),
 			retry.Delay(time.Second*1),
 			retry.Attempts(7),
 			retry.MaxJitter(time.Second*1)); err != nil {
-			http.Error(w, fmt.Sprintf("Failed to cross: %q\n", req.Name), 490)
-			return
+			return 490, fmt.Sprintf("Failed to cross: %q\n", c.Name)
 		}
 
 		err = retry.Do(func() error {
-			t, err := req.getTorrent()
+			t, err := c.getTorrent()
 			if err != nil {
 				return errors.Wrap(err, "423 Unable to find torrent")
 			}
 
 			switch t.State {
 			case qbittorrent.TorrentStateStalledUp, qbittorrent.TorrentStateUploading:
-				req.announceTrackers()
+				c.announceTrackers()
 				return nil /* Nice. */
 			case qbittorrent.TorrentStateStalledDl, qbittorrent.TorrentStateDownloading:
-				req.announceTrackers()
-				fmt.Printf("Considering successful. Downloading: %q", req.Name)
+				c.announceTrackers()
+				c.logger().Info("Considering successful, downloading")
 				return nil
 			case qbittorrent.TorrentStateMissingFiles:
-				req.recheckTorrent()
+				c.recheckTorrent()
 				return errors.New("469 Rechecking")
 			case qbittorrent.TorrentStatePausedUp:
-				if err := req.resumeTorrent(); err != nil {
+				if err := c.resumeTorrent(); err != nil {
 					return errors.Wrap(err, "468 Unable to resume torrent")
 				}
 				return errors.New("467 PausedUp")
@@ -674,7 +801,7 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 					return retry.Unrecoverable(errors.New("466 Name matched, data did not on cross"))
 				}
 
-				files, err := req.getFiles(req.Hash)
+				files, err := c.getFiles(c.Hash)
 				if err != nil {
 					return errors.Wrap(err, "465 Unable to get Files")
 				}
@@ -690,15 +817,15 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 				}
 
 				if damage == false {
-					if err := req.resumeTorrent(); err != nil {
+					if err := c.resumeTorrent(); err != nil {
 						return errors.Wrap(err, "464 Unable to resume valid cross")
 					}
 
-					req.announceTrackers()
+					c.announceTrackers()
 					return nil /* Nice! */
 				}
 
-				if err := req.deleteTorrent(); err != nil {
+				if err := c.deleteTorrent(); err != nil {
 					return errors.Wrap(err, "463 Unable to delete existing torrent")
 				}
 
@@ -706,12 +833,12 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 				atm := t.AutoManaged
 				oldpath := t.SavePath
 				opts.SavePath = t.SavePath + "/.tmp"
-				if err := req.submitTorrent(opts); err != nil {
-					req.deleteTorrent()
+				if err := c.submitTorrent(opts); err != nil {
+					c.deleteTorrent()
 					return errors.Wrap(err, "450 Failed to adv cross")
 				}
 
-				for t.State = "check"; strings.Contains(string(t.State), "check"); t, err = req.getTorrent() {
+				for t.State = "check"; strings.Contains(string(t.State), "check"); t, err = c.getTorrent() {
 					if err != nil {
 						t.State = "check"
 					}
@@ -731,35 +858,35 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 						if idx := strings.LastIndex(f.Name, "/"); idx != -1 {
 							np = f.Name[:idx]
 							if len(f.Name) > idx+1 {
-								np += "/" + req.Hash + "_" + f.Name[idx+1:]
+								np += "/" + c.Hash + "_" + f.Name[idx+1:]
 							}
 						} else {
-							np = req.Hash + "/" + f.Name
+							np = c.Hash + "/" + f.Name
 						}
 
-						req.renameFile(req.Hash, f.Name, np) /* if it fails. so be it. */
+						c.renameFile(c.Hash, f.Name, np) /* if it fails. so be it. */
 					}
 				}
 
-				if err := req.setLocationTorrent(oldpath); err != nil {
+				if err := c.setLocationTorrent(oldpath); err != nil {
 					return errors.Wrap(err, "435 Failed to change save location")
 				}
 
 				if t.AutoManaged != atm {
-					if err := req.setTorrentManagement(atm); err != nil {
+					if err := c.setTorrentManagement(atm); err != nil {
 						return errors.Wrap(err, "433 Failed to ATM")
 					}
 				}
 
-				if err := req.recheckTorrent(); err != nil {
+				if err := c.recheckTorrent(); err != nil {
 					return errors.Wrap(err, "431 Failed to Recheck")
 				}
 
-				if err := req.resumeTorrent(); err != nil {
+				if err := c.resumeTorrent(); err != nil {
 					return errors.Wrap(err, "429 Failed to Resume")
 				}
 
-				req.announceTrackers()
+				c.announceTrackers()
 				return nil
 			case qbittorrent.TorrentStateCheckingUp, qbittorrent.TorrentStateCheckingDl, qbittorrent.TorrentStateCheckingResumeData:
 				return fmt.Errorf("412 Still Checking: %q", t.State)
@@ -768,109 +895,380 @@ func handleCross(w http.ResponseWriter, r *http.Request) {
 			return fmt.Errorf("410 End of loop. Continuing: %q", t.State)
 
 		},
-			retry.OnRetry(func(n uint, err error) { fmt.Printf("%q: attempt %d - %v\n", err, n, req.Name) }),
+			retry.OnRetry(func(n uint, err error) { c.logger().Debug("Cross attempt failed", "attempt", n, "error", err) }),
 			retry.Delay(time.Second*1),
 			retry.Attempts(47),
 			retry.MaxJitter(time.Second*1),
 		)
 
 		if err == nil {
-			http.Error(w, fmt.Sprintf("Crossed Successfully: %q", req.Name), 200)
-			return
+			return 200, fmt.Sprintf("Crossed Successfully: %q", c.Name)
 		}
 
-		req.deleteTorrent()
+		c.deleteTorrent()
 		if ret, _, _ := Atoi(fmt.Sprintf("%s", err)); ret >= 400 {
-			http.Error(w, fmt.Sprintf("Failed to cross %q %q", req.Name, err), ret)
-		} else {
-			http.Error(w, fmt.Sprintf("Failed to cross generic %q %q", req.Name, err), 415)
+			return ret, fmt.Sprintf("Failed to cross %q %q", c.Name, err)
 		}
 
-		return
+		return 415, fmt.Sprintf("Failed to cross generic %q %q", c.Name, err)
 	}
 
-	http.Error(w, fmt.Sprintf("Failed to cross: %q\n", req.Name), 414)
+	return 414, fmt.Sprintf("Failed to cross: %q\n", c.Name)
+}
+
+type unregisteredReq struct {
+	Action   string
+	Subject  string
+	Thorough bool
+	upgradereq
+}
+
+type unregisteredMatch struct {
+	Hash     string
+	Name     string
+	Tracker  string
+	Message  string
+	Pattern  string
+	Observed uint
+	Required uint
 }
 
 func handleUnregistered(w http.ResponseWriter, r *http.Request) {
-	var req upgradereq
+	var req unregisteredReq
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, err.Error(), 470)
 		return
 	}
 
-	if err := getClient(&req); err != nil {
+	req.bind(r)
+
+	action := strings.Trim(strings.ToLower(req.Action), `"' `)
+	switch action {
+	case "":
+		action = "delete"
+	case "delete", "deletedata", "pause", "test":
+	case "tag", "category":
+		if len(req.Subject) == 0 {
+			req.Subject = "unregistered"
+		}
+	default:
+		http.Error(w, fmt.Sprintf("Unknown action: %q\n", req.Action), 472)
+		return
+	}
+
+	dryRun := action == "test"
+
+	tmp := upgradereq{
+		Host:     req.Host,
+		User:     req.User,
+		Password: req.Password,
+	}
+
+	if err := getClient(&tmp); err != nil {
 		http.Error(w, fmt.Sprintf("Unable to get client: %q\n", err), 471)
 		return
 	}
 
+	req.Client = tmp.Client
+
 	mp, err := req.getAllTorrents()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Unable to get result: %q\n", err), 468)
 		return
 	}
 
-	deadTracker := []string{
-		"unregistered",
-		"not registered",
-		"not found",
-		"not exist",
-		"unknown",
-		"uploaded",
-		"upgraded",
-		"season pack",
-		"packs are available",
-		"pack is available",
-		"internal available",
-		"season pack out",
-		"dead",
-		"dupe",
-		"complete season uploaded",
-		"problem with",
-		"specifically banned",
-		"trumped",
-		"i'm sorry dave, i can't do that", // weird stuff from racingforme
-	}
-
-	count := 0
+	/* Torrents without trackers carry no messages, builds that never count trackers get everything inspected. */
+	var tracked map[string]struct{}
+	if !req.Thorough {
+		for _, set := range mp.e {
+			for _, t := range set {
+				if t.TrackersCount == 0 {
+					continue
+				}
+
+				if tracked == nil {
+					tracked = make(map[string]struct{})
+				}
+
+				tracked[t.Hash] = struct{}{}
+			}
+		}
+	}
+
+	type inspection struct {
+		t     qbittorrent.Torrent
+		match *unregisteredMatch
+		alive bool
+	}
+
+	var wg sync.WaitGroup
+	var lock sync.Mutex
+	results := make([]inspection, 0)
+	failed := 0
+	jobs := make(chan qbittorrent.Torrent)
+	limiter := getLimiter(req.Host)
+	for i := uint(0); i < max(config.Unregistered.Workers, 1); i++ {
+		wg.Add(1)
+		go func(child upgradereq) {
+			defer wg.Done()
+			for t := range jobs {
+				/* Torrents left uninspected keep their observations for the next run. */
+				if err := limiter.Wait(r.Context()); err != nil {
+					lock.Lock()
+					failed++
+					lock.Unlock()
+					continue
+				}
+
+				child.Hash = t.Hash
+				trackers, err := child.getTrackers()
+				if err != nil {
+					child.logger().Error("Unable to get trackers", "error", err)
+					lock.Lock()
+					failed++
+					lock.Unlock()
+					continue
+				}
+
+				match, alive := inspectTrackers(t, trackers)
+
+				lock.Lock()
+				results = append(results, inspection{t: t, match: match, alive: alive})
+				lock.Unlock()
+			}
+		}(req.upgradereq)
+	}
+
 	for _, set := range mp.e {
 		for _, t := range set {
-			req.Hash = t.Hash
-			if len(req.Hash) == 0 {
+			if len(t.Hash) == 0 {
 				continue
 			}
 
-			trackers, _ := req.getTrackers()
-			alive := false
-
-			for _, tracker := range trackers {
-				if tracker.Status == qbittorrent.TrackerStatusDisabled {
-					continue
-				} else if tracker.Status == qbittorrent.TrackerStatusOK {
-					alive = true
-				} else if tracker.Status == qbittorrent.TrackerStatusNotWorking {
-				} else {
+			if tracked != nil {
+				if _, ok := tracked[t.Hash]; !ok {
+					lock.Lock()
+					results = append(results, inspection{t: t, alive: true})
+					lock.Unlock()
 					continue
 				}
+			}
 
-				for _, z := range deadTracker {
-					if strings.Contains(strings.ToLower(tracker.Message), z) {
-						count++
-						req.deleteTorrent()
-						alive = false
-						break
-					}
+			jobs <- t
+		}
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	pending := 0
+	matches := make([]unregisteredMatch, 0)
+	dead := make(map[string]struct{})
+	for _, res := range results {
+		key := req.Host + "|" + res.t.Hash
+		if match := res.match; match == nil {
+			if !dryRun {
+				unregisteredmap.Delete(key)
+			}
+		} else if seen, _ := unregisteredmap.Get(key); dryRun {
+			match.Observed = seen + 1
+			matches = append(matches, *match)
+		} else if match.Observed = seen + 1; match.Observed < match.Required {
+			unregisteredmap.Set(key, match.Observed, ttlcache.DefaultTTL)
+			pending++
+		} else {
+			unregisteredmap.Delete(key)
+			matches = append(matches, *match)
+			res.alive = false
+		}
+
+		if !res.alive {
+			dead[res.t.Hash] = struct{}{}
+		}
+	}
+
+	if dryRun {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(matches); err != nil {
+			http.Error(w, fmt.Sprintf("Unable to encode matches: %q\n", err), 465)
+		}
+
+		return
+	}
+
+	hashes := make([]string, 0, len(matches))
+	unregistered := make(map[string]struct{}, len(matches))
+	patterns := make([]string, 0)
+	for _, m := range matches {
+		hashes = append(hashes, m.Hash)
+		unregistered[m.Hash] = struct{}{}
+		if !slices.Contains(patterns, m.Pattern) {
+			patterns = append(patterns, m.Pattern)
+		}
+	}
+
+	req.trigger.Rule = strings.Join(patterns, ", ")
+
+	removedData, keptData := 0, 0
+	if len(hashes) != 0 {
+		switch action {
+		case "delete":
+			err = req.deleteTorrents(hashes, false)
+		case "deletedata":
+			withData, withoutData := splitSharedData(mp, unregistered)
+			removedData, keptData = len(withData), len(withoutData)
+			if len(withoutData) != 0 {
+				err = req.deleteTorrents(withoutData, false)
+			}
+
+			if err == nil && len(withData) != 0 {
+				err = req.deleteTorrents(withData, true)
+			}
+		case "pause":
+			err = req.pauseTorrents(hashes)
+		case "tag":
+			err = req.addTags(hashes, req.Subject)
+		case "category":
+			var cats map[string]qbittorrent.Category
+			if cats, err = req.getCategories(); err == nil {
+				if _, ok := cats[req.Subject]; !ok {
+					err = req.createCategory(req.Subject, "")
 				}
 			}
 
-			if !alive {
-				child := req
-				go child.announceTrackers()
+			if err == nil {
+				err = req.setCategory(hashes, req.Subject)
+			}
+		}
+
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Unable to %s %d unregistered torrents: %q\n", action, len(hashes), err), 420)
+			return
+		}
+
+		torrentActions.Add(float64(len(hashes)), "unregistered", action)
+	}
+
+	if action == "delete" || action == "deletedata" || action == "pause" {
+		for _, h := range hashes {
+			delete(dead, h)
+		}
+	}
+
+	if len(dead) != 0 {
+		announce := make([]string, 0, len(dead))
+		for h := range dead {
+			announce = append(announce, h)
+		}
+
+		err := limiter.Wait(r.Context())
+		if err == nil {
+			err = req.reannounceTorrents(announce)
+		}
+
+		if err != nil {
+			req.logger().Error("Unable to reannounce", "count", len(announce), "error", err)
+		}
+	}
+
+	if failed != 0 {
+		req.logger().Warn("Unable to inspect unregistered torrents", "count", failed)
+	}
+
+	switch action {
+	case "delete":
+		http.Error(w, fmt.Sprintf("Unregistered torrents deleted: %d", len(hashes)), 200)
+		return
+	case "deletedata":
+		http.Error(w, fmt.Sprintf("Unregistered torrents processed (%s): %d (%d with data, %d without data still in use) (%d pending observation, %d failed to inspect)", action, len(hashes), removedData, keptData, pending, failed), 200)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("Unregistered torrents processed (%s): %d (%d pending observation, %d failed to inspect)", action, len(hashes), pending, failed), 200)
+}
+
+/*
+Splits hashes by whether their data is still needed by a torrent outside of the set, one whose content path
+equals, contains or is contained by theirs. Siblings of the same release elsewhere on disk don't hold data back.
+*/
+func splitSharedData(mp *timeentry, hashes map[string]struct{}) (withData, withoutData []string) {
+	survivors := make([]string, 0, len(mp.content))
+	for p, set := range mp.content {
+		for _, h := range set {
+			if _, ok := hashes[h]; !ok {
+				survivors = append(survivors, p)
+				break
 			}
 		}
 	}
 
-	http.Error(w, fmt.Sprintf("Unregistered torrents deleted: %d", count), 200)
+	candidates := make([]qbittorrent.Torrent, 0, len(hashes))
+	for _, h := range slices.Sorted(maps.Keys(hashes)) {
+		if t, ok := mp.torrent(h); ok {
+			candidates = append(candidates, t)
+		}
+	}
+
+	sort.Strings(survivors)
+	for _, t := range candidates {
+		if len(t.ContentPath) == 0 || sharesContent(path.Clean(t.ContentPath), survivors) {
+			withoutData = append(withoutData, t.Hash)
+		} else {
+			withData = append(withData, t.Hash)
+		}
+	}
+
+	return withData, withoutData
+}
+
+/* True if content equals, contains or is contained by any of the sorted paths. */
+func sharesContent(content string, sorted []string) bool {
+	for p := content; ; p = path.Dir(p) {
+		if i := sort.SearchStrings(sorted, p); i < len(sorted) && sorted[i] == p {
+			return true
+		}
+
+		if parent := path.Dir(p); parent == p {
+			break
+		}
+	}
+
+	prefix := strings.TrimSuffix(content, "/") + "/"
+	i := sort.SearchStrings(sorted, prefix)
+	return i < len(sorted) && strings.HasPrefix(sorted[i], prefix)
+}
+
+/* Returns the first unregistered match on the trackers, and whether any tracker is working. */
+func inspectTrackers(t qbittorrent.Torrent, trackers []qbittorrent.TorrentTracker) (*unregisteredMatch, bool) {
+	alive := false
+	for _, tracker := range trackers {
+		if tracker.Status == qbittorrent.TrackerStatusDisabled {
+			continue
+		} else if tracker.Status == qbittorrent.TrackerStatusOK {
+			alive = true
+		} else if tracker.Status == qbittorrent.TrackerStatusNotWorking {
+		} else {
+			continue
+		}
+
+		if pattern, n, ok := config.Unregistered.match(tracker.Url, tracker.Message); ok {
+			return &unregisteredMatch{
+				Hash:     t.Hash,
+				Name:     t.Name,
+				Tracker:  tracker.Url,
+				Message:  tracker.Message,
+				Pattern:  pattern,
+				Required: n,
+			}, alive
+		}
+	}
+
+	return nil, alive
+}
+
+func getLimiter(host string) *ratelimit.Limiter {
+	l, _ := limitermap.GetOrSet(host, ratelimit.PerSecond(config.Unregistered.RequestsPerSecond, int(max(config.Unregistered.Workers, 1))), ttlcache.DefaultTTL)
+	return l
 }
 
 func getFormattedTitle(title string) string {
@@ -906,7 +1304,7 @@ func checkExtension(requestrls, child *Entry) *Entry {
 
 		if i == 0 {
 			if len(e.Ext) != 0 {
-				fmt.Printf("UNKNOWNEXT: %q\n", e.Ext)
+				slog.Info("UNKNOWNEXT", "value", e.Ext, "title", e.Title)
 			}
 
 			i = sm["divx"]
@@ -945,7 +1343,7 @@ func checkLanguage(requestrls, child *Entry) *Entry {
 
 		if i == 0 {
 			if len(e.Language) != 0 {
-				fmt.Printf("UNKNOWNLANGUAGE: %q\n", e.Language)
+				slog.Info("UNKNOWNLANGUAGE", "value", e.Language, "title", e.Title)
 			} else {
 				i = sm["ENGLiSH"]
 			}
@@ -980,7 +1378,7 @@ func checkReplacement(requestrls, child *Entry) *Entry {
 		}
 
 		if i == 0 && len(e.Other) != 0 {
-			fmt.Printf("UNKNOWNOTHER: %q\n", e.Other)
+			slog.Info("UNKNOWNOTHER", "value", e.Other, "title", e.Title)
 		}
 
 		return i
@@ -1018,7 +1416,7 @@ func checkAudio(requestrls, child *Entry) *Entry {
 
 		if i == 0 {
 			if len(e.Audio) != 0 {
-				fmt.Printf("UNKNOWNAUDIO: %q\n", e.Audio)
+				slog.Info("UNKNOWNAUDIO", "value", e.Audio, "title", e.Title)
 			}
 
 			i = sm["DUAL.AUDIO"]
@@ -1058,7 +1456,7 @@ func checkSource(requestrls, child *Entry) *Entry {
 
 		if i == 0 {
 			if len(e.Source) != 0 {
-				fmt.Printf("UNKNOWNSRC: %q\n", e.Source)
+				slog.Info("UNKNOWNSRC", "value", e.Source, "title", e.Title)
 			}
 
 			i = sm["TS"]
@@ -1106,7 +1504,7 @@ func checkHDR(requestrls, child *Entry) *Entry {
 
 		if i == 0 {
 			if len(e.HDR) != 0 {
-				fmt.Printf("UNKNOWNHDR: %q\n", e.HDR)
+				slog.Info("UNKNOWNHDR", "value", e.HDR, "title", e.Title)
 			}
 
 			i = sm["SDR"]
@@ -1144,6 +1542,36 @@ func compareResults(requestrls, child *Entry, f func(*rls.Release) int) *Entry {
 	return nil
 }
 
+/*
+Groups torrents by the requested key, title grouping reuses the CacheFormatted buckets.
+Torrents without a content path, save path, tracker or category are left out of those groupings.
+*/
+func groupTorrents(mp *timeentry, by string) (map[string][]qbittorrent.Torrent, error) {
+	switch Normalize(by) {
+	case "", "title":
+		return mp.e, nil
+	case "contentpath":
+		return mp.groups(mp.content), nil
+	case "savepath":
+		return mp.groups(mp.save), nil
+	case "tracker":
+		return mp.groups(mp.tracker), nil
+	case "category":
+		return mp.groups(mp.category), nil
+	}
+
+	return nil, fmt.Errorf("unknown grouping %q", by)
+}
+
+func trackerHost(tracker string) string {
+	u, err := url.Parse(tracker)
+	if err != nil {
+		return ""
+	}
+
+	return Normalize(u.Hostname())
+}
+
 func Normalize(buf string) string {
 	return strings.ToLower(strings.TrimSpace(strings.ToValidUTF8(buf, "")))
 }
@@ -1197,6 +1625,8 @@ func handleAutobrrFilterUpdate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.bind(r)
+
 	if req.FilterID == 0 {
 		http.Error(w, fmt.Sprintf("Missing FilterID\n"), 473)
 		return
@@ -1297,6 +1727,7 @@ type upgraderrExpression struct {
 	Action  string
 	Subject string
 	Sort    string
+	GroupBy string
 	upgradereq
 }
 
@@ -1313,6 +1744,8 @@ func handleExpression(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	req.bind(r)
+
 	bCrossAware := true
 	resultLimit := -1
 	resultSkip := -1
@@ -1320,8 +1753,64 @@ func handleExpression(w http.ResponseWriter, r *http.Request) {
 	var contextString string
 	var queryRls *rls.Release
 	var mp *timeentry
+	var group []qbittorrent.Torrent
+	var environment []expr.Option
+	groupprograms := make(map[string]*vm.Program)
+	trackedmap := make(map[string]map[string]struct{})
+
+	/* Group functions only depend on the group, each is worked out once per bucket rather than once per member. */
+	groupcache := make(map[string]any)
+	groupCached := func(key string, f func() (any, error)) (any, error) {
+		if v, ok := groupcache[key]; ok {
+			return v, nil
+		}
+
+		v, err := f()
+		if err == nil {
+			groupcache[key] = v
+		}
+
+		return v, err
+	}
+
+	/* Runs a sub-expression against every member of the current group, true if any result equals want. */
+	groupMatch := func(query string, want bool) (bool, error) {
+		p, ok := groupprograms[query]
+		if !ok {
+			var err error
+			q := query
+			for k, v := range replaceMapExp {
+				q = strings.ReplaceAll(q, k, v)
+			}
+
+			if p, err = expr.Compile(q, append(environment, expr.AsBool())...); err != nil {
+				return false, err
+			}
+
+			groupprograms[query] = p
+		}
 
-	environment := []expr.Option{expr.Env(qbittorrent.Torrent{}),
+		oldRls, oldCrossAware := queryRls, bCrossAware
+		defer func() {
+			queryRls, bCrossAware = oldRls, oldCrossAware
+		}()
+
+		for _, e := range group {
+			queryRls = CacheTitle(e.Name)
+			res, err := expr.Run(p, e)
+			if err != nil {
+				return false, err
+			}
+
+			if res.(bool) == want {
+				return true, nil
+			}
+		}
+
+		return false, nil
+	}
+
+	environment = []expr.Option{expr.Env(qbittorrent.Torrent{}),
 		expr.Function(
 			"ContextGet",
 			func(params ...any) (any, error) {
@@ -1345,6 +1834,70 @@ func handleExpression(w http.ResponseWriter, r *http.Request) {
 			},
 			new(func() bool),
 		),
+		expr.Function(
+			"GroupAll",
+			func(params ...any) (any, error) {
+				return groupCached("all\x00"+params[0].(string), func() (any, error) {
+					res, err := groupMatch(params[0].(string), false)
+					return !res, err
+				})
+			},
+			new(func(string) bool),
+		),
+		expr.Function(
+			"GroupAny",
+			func(params ...any) (any, error) {
+				return groupCached("any\x00"+params[0].(string), func() (any, error) {
+					return groupMatch(params[0].(string), true)
+				})
+			},
+			new(func(string) bool),
+		),
+		expr.Function(
+			"GroupCount",
+			func(params ...any) (any, error) {
+				return len(group), nil
+			},
+			new(func() int),
+		),
+		expr.Function(
+			"GroupHasTracker",
+			func(params ...any) (any, error) {
+				host := Normalize(params[0].(string))
+				return groupCached("tracker\x00"+host, func() (any, error) {
+					tracked, ok := trackedmap[host]
+					if !ok {
+						tracked = mp.trackedBy(host)
+						trackedmap[host] = tracked
+					}
+
+					for _, e := range group {
+						if _, ok := tracked[e.Hash]; ok {
+							return true, nil
+						}
+					}
+
+					return false, nil
+				})
+			},
+			new(func(string) bool),
+		),
+		expr.Function(
+			"GroupMaxSize",
+			func(params ...any) (any, error) {
+				return groupCached("maxsize", func() (any, error) {
+					size := int64(0)
+					for _, e := range group {
+						if e.Size > size {
+							size = e.Size
+						}
+					}
+
+					return size, nil
+				})
+			},
+			new(func() int64),
+		),
 		expr.Function(
 			"ResultLimit",
 			func(params ...any) (any, error) {
@@ -1418,6 +1971,7 @@ func handleExpression(w http.ResponseWriter, r *http.Request) {
 		),
 	}
 
+	req.trigger.Rule = req.Query
 	for k, v := range replaceMapExp {
 		req.Query = strings.ReplaceAll(req.Query, k, v)
 	}
@@ -1456,8 +2010,16 @@ func handleExpression(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	buckets, err := groupTorrents(mp, req.GroupBy)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to group torrents: %q\n", err), 474)
+		return
+	}
+
 	hashmap := make(map[int64][]string)
-	for _, te := range mp.e {
+	for _, te := range buckets {
+		group = te
+		clear(groupcache)
 		filterhash := make([]string, 0, len(te))
 		priority := int64(-int64(^uint64(0)>>1) - 1)
 		for _, e := range te {
@@ -1465,7 +2027,7 @@ func handleExpression(w http.ResponseWriter, r *http.Request) {
 			queryRls = CacheTitle(e.Name)
 			res, err := expr.Run(queryp, e)
 			if err != nil {
-				fmt.Printf("Query Error: %q\n", err)
+				req.logger().Error("Query Error", "name", e.Name, "hash", e.Hash, "error", err)
 				filterhash = nil
 				break
 			} else if res == false {
@@ -1484,7 +2046,7 @@ func handleExpression(w http.ResponseWriter, r *http.Request) {
 
 				sortprio, err := expr.Run(sortp, e)
 				if err != nil {
-					fmt.Printf("Sort Error: %q\n", err)
+					req.logger().Error("Sort Error", "name", e.Name, "hash", e.Hash, "error", err)
 					filterhash = nil
 					break
 				}
@@ -1540,471 +2102,117 @@ func handleExpression(w http.ResponseWriter, r *http.Request) {
 		hashes = hashes[:resultLimit]
 	}
 
-	switch strings.Trim(strings.ToLower(req.Action), `"' `) {
+	action := strings.Trim(strings.ToLower(req.Action), `"' `)
+	switch action {
 	case "delete":
-		if err := req.Client.DeleteTorrents(hashes, false); err != nil {
+		if err := req.deleteTorrents(hashes, false); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to delete torrents: %q\n", err), 419)
 			return
 		}
 	case "deletedata":
-		if err := req.Client.DeleteTorrents(hashes, true); err != nil {
-			http.Error(w, fmt.Sprintf("Unable to deletedata torrents: %q\n", err), 418)
-			return
+		if config.Quarantine.Enabled {
+			if err := req.quarantineTorrents(mp, hashes); err != nil {
+				http.Error(w, fmt.Sprintf("Unable to quarantine torrents: %q\n", err), 418)
+				return
+			}
+
+			action = "quarantine"
+			if _, err := req.purgeQuarantine(); err != nil {
+				req.logger().Error("Unable to purge quarantine", "error", err)
+			}
+		} else {
+			/* Groupings other than title and content path split cross-seeds apart, data still in use elsewhere stays. */
+			set := make(map[string]struct{}, len(hashes))
+			for _, h := range hashes {
+				set[h] = struct{}{}
+			}
+
+			withData, withoutData := splitSharedData(mp, set)
+			if len(withoutData) != 0 {
+				if err := req.deleteTorrents(withoutData, false); err != nil {
+					http.Error(w, fmt.Sprintf("Unable to delete torrents: %q\n", err), 418)
+					return
+				}
+			}
+
+			if len(withData) != 0 {
+				if err := req.deleteTorrents(withData, true); err != nil {
+					http.Error(w, fmt.Sprintf("Unable to deletedata torrents: %q\n", err), 418)
+					return
+				}
+			}
 		}
 	case "forcestart":
-		if err := req.Client.SetForceStart(hashes, true); err != nil {
+		if err := req.setForceStart(hashes, true); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to forcestart torrents: %q\n", err), 417)
 			return
 		}
 	case "normalstart":
-		if err := req.Client.SetForceStart(hashes, false); err != nil {
+		if err := req.setForceStart(hashes, false); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to normalstart torrents: %q\n", err), 416)
 			return
 		}
 	case "start":
-		if err := req.Client.Resume(hashes); err != nil {
+		if err := req.resumeTorrents(hashes); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to resume torrents: %q\n", err), 415)
 			return
 		}
 	case "pause":
-		if err := req.Client.Pause(hashes); err != nil {
+		if err := req.pauseTorrents(hashes); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to pause torrents: %q\n", err), 414)
 			return
 		}
 	case "reannounce":
-		if err := req.Client.ReAnnounceTorrents(hashes); err != nil {
+		if err := req.reannounceTorrents(hashes); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to reannounce torrents: %q\n", err), 413)
 			return
 		}
 	case "recheck":
-		if err := req.Client.Recheck(hashes); err != nil {
+		if err := req.recheckTorrents(hashes); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to recheck torrents: %q\n", err), 412)
 			return
 		}
 	case "category":
-		if err := req.Client.SetCategory(hashes, req.Subject); err != nil {
+		if err := req.setCategory(hashes, req.Subject); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to category torrents %q: %q\n", req.Subject, err), 411)
 			return
 		}
 	case "tagadd":
-		if err := req.Client.AddTags(hashes, req.Subject); err != nil {
+		if err := req.addTags(hashes, req.Subject); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to addtag torrents %q: %q\n", req.Subject, err), 410)
 			return
 		}
 	case "tagdel":
-		if err := req.Client.RemoveTags(hashes, req.Subject); err != nil {
+		if err := req.removeTags(hashes, req.Subject); err != nil {
 			http.Error(w, fmt.Sprintf("Unable to tagdel torrents %q: %q\n", req.Subject, err), 409)
 			return
 		}
 	default:
 		for _, h := range hashes {
-			req.Hash = h
-			t, _ := req.getTorrent()
-			fmt.Printf("Matched: %q\n", t.Name)
+			t, _ := mp.torrent(h)
+			req.logger().Info("Matched", "name", t.Name, "hash", h)
 		}
-		fmt.Printf("TEST count: %d\n", len(hashes))
+		req.logger().Info("TEST", "count", len(hashes))
+		action = "test"
 	}
 
+	torrentActions.Add(float64(len(hashes)), "expression", action)
 	http.Error(w, fmt.Sprintf("Processed: %d\n", len(hashes)), 200)
 }
 
-func initDatabase() {
-	var err error
-	db, err = bolt.Open("/config/upgraderr.db", 0600, nil)
-	if err != nil {
-		fmt.Printf("WARNING: Unable to open Torznab database on /config. %q\n", err)
-		db, err = bolt.Open("upgraderr.db", 0600, nil)
-		if err != nil {
-			db, err = bolt.Open("/tmp/upgraderr.db", 0600, nil)
-			if err != nil {
-				fmt.Printf("WARNING: Unable to open Torznab database /tmp. %q\n", err)
-			}
-		}
-	}
-
-	if db == nil {
-		return
-	}
-
-	if err := db.Update(func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists([]byte("enclosures")); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte("titles")); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte("torrents")); err != nil {
-			return err
-		}
-		if _, err := tx.CreateBucketIfNotExists([]byte("queries")); err != nil {
-			return err
-		}
-
-		return nil
-	}); err != nil {
-		fmt.Printf("Unable to create bucket: %q\n", err)
-	}
-}
-
-type torznabCrossSearch struct {
-	APIKey      string
-	JackettHost string
-	AgeLimit    uint
-	upgradereq
-}
-
-func handleTorznabCrossSearch(w http.ResponseWriter, r *http.Request) {
-	if db == nil {
-		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
-		return
-	}
-
-	var req torznabCrossSearch
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, err.Error(), 470)
-		return
-	}
-
-	if len(req.JackettHost) == 0 {
-		http.Error(w, fmt.Sprintf("Missing Jackett Host"), 473)
-		return
-	}
-
-	jc := jackett.NewClient(jackett.Config{Host: req.JackettHost, APIKey: req.APIKey, Timeout: 180})
-	indexers, err := jc.GetIndexers()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to get indexers from Jackett: %q\n", err), 472)
-		return
-	}
-
-	tmp := upgradereq{
-		Host:     req.Host,
-		User:     req.User,
-		Password: req.Password,
-	}
-
-	if err := getClient(&tmp); err != nil {
-		http.Error(w, fmt.Sprintf("Unable to get client: %q\n", err), 471)
-		return
-	}
-
-	req.Client = tmp.Client
-	mp, err := req.getAllTorrents()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Unable to get result: %q\n", err), 468)
-		return
-	}
-
-	processlist := make(map[string]string)
-	regexseason := regexp.MustCompile("(S\\d+)")
-	nt := globalTime.Now().Unix()
-	for _, e := range mp.e {
-		for _, torrent := range e {
-			if req.AgeLimit != 0 && nt-int64(req.AgeLimit) > torrent.CompletionOn {
-				continue
-			}
-
-			r := CacheTitle(torrent.Name)
-
-			q := strings.ToLower(r.Title)
-			y := ""
-			if r.Year != 0 {
-				y = fmt.Sprintf("%d", r.Year)
-			}
-
-			s := ""
-			if r.Series != 0 || r.Episode != 0 {
-				if regexseason.MatchString(torrent.Name) {
-					s = fmt.Sprintf("S%02d", r.Series)
-					if r.Episode != 0 {
-						s += fmt.Sprintf("E%02d", r.Episode)
-					}
-				} else if strings.Contains(strings.ToLower(torrent.Name), "season") {
-					s = fmt.Sprintf("season %d", r.Series)
-				}
-			} else if r.Month != 0 {
-				s = fmt.Sprintf("%02d", r.Month)
-			}
-
-			if len(y) != 0 {
-				q += " " + y
-			}
-			if len(s) != 0 {
-				q += " " + s
-			}
-
-			processlist[q] = torrent.Name
-		}
-	}
-
-	regexadult := regexp.MustCompile("(XXX)")
-	failmap := make(map[string]uint)
-	var faillock sync.RWMutex
-	var wg sync.WaitGroup
-	for k, v := range processlist {
-		fmt.Printf("Searching: %q\n", v)
-		r := CacheTitle(v)
-		adult := regexadult.MatchString(v)
-		for _, indexer := range indexers.Indexer {
-			faillock.RLock()
-			if num := failmap[indexer.ID]; num > 3 {
-				faillock.RUnlock()
-				continue
-			}
-			faillock.RUnlock()
-
-			if err := db.Update(func(tx *bolt.Tx) error {
-				for _, bucket := range []*bolt.Bucket{
-					tx.Bucket([]byte("enclosures")),
-					tx.Bucket([]byte("titles")),
-					tx.Bucket([]byte("torrents")),
-					tx.Bucket([]byte("queries"))} {
-					if _, err := bucket.CreateBucketIfNotExists([]byte(indexer.ID)); err != nil {
-						return err
-					}
-				}
-
-				return nil
-			}); err != nil {
-				fmt.Printf("%q: Failed to create initial indexer buckets: %q\n", indexer.ID, err)
-			}
-
-			cat := ""
-			if adult {
-				for _, cl := range indexer.Caps.Categories.Category {
-					id, _ := strconv.Atoi(cl.ID)
-					if id >= 6000 && id <= 6999 {
-						cat = "6000"
-						break
-					}
-				}
-
-				if len(cat) == 0 {
-					continue
-				}
-			} else if r.Type == rls.Episode || r.Type == rls.Series {
-				if indexer.Caps.Searching.TvSearch.Available != "yes" {
-					continue
-				}
-				cat = "5000"
-			} else if r.Type == rls.Movie {
-				if indexer.Caps.Searching.MovieSearch.Available != "yes" {
-					continue
-				}
-				cat = "2000"
-			} else if r.Type == rls.Music || r.Type == rls.Audiobook {
-				if indexer.Caps.Searching.MusicSearch.Available != "yes" && indexer.Caps.Searching.AudioSearch.Available != "yes" {
-					continue
-				}
-				cat = "3000"
-			} else if r.Type == rls.Book || r.Type == rls.Comic || r.Type == rls.Education || r.Type == rls.Magazine {
-				if indexer.Caps.Searching.BookSearch.Available != "yes" {
-					continue
-				}
-				cat = "7000"
-			}
-
-			wg.Add(1)
-			go func(id string, m map[string]string) {
-				defer wg.Done()
-
-				if err := db.View(func(tx *bolt.Tx) error {
-					pb := tx.Bucket([]byte("queries"))
-					if pb == nil {
-						fmt.Printf("No queries bucket %q\n", m["cat"]+m["q"])
-						return nil
-					}
-
-					b := pb.Bucket([]byte(id))
-					if b == nil {
-						return nil
-					}
-
-					stamp := b.Get([]byte(m["cat"] + m["q"]))
-					if stamp == nil {
-						return nil
-					}
-
-					if nt-720 < int64(binary.LittleEndian.Uint64(stamp)) {
-						return fmt.Errorf("cache found for %q", m["cat"]+m["q"])
-					}
-
-					return nil
-				}); err != nil {
-					fmt.Printf("%q: %q Skipping result.\n", id, err)
-					return
-				}
-
-				res, err := jc.GetTorrents(id, m)
-				if err != nil {
-					fmt.Printf("%q: Fatal acquisition: %q\n", id, err)
-					faillock.Lock()
-					i := failmap[id]
-					failmap[id] = (i + 1)
-					faillock.Unlock()
-					return
-				}
-
-				faillock.Lock()
-				failmap[id] = 0
-				faillock.Unlock()
-
-				if err := db.Update(func(tx *bolt.Tx) error {
-					{
-						tb := tx.Bucket([]byte("titles"))
-						if tb == nil {
-							return fmt.Errorf("titles: Failed to find bucket")
-						}
-
-						b := tb.Bucket([]byte(id))
-						if b == nil {
-							return fmt.Errorf("%q: Failed to find title bucket", id)
-						}
-
-						eb := tx.Bucket([]byte("enclosures"))
-						if eb == nil {
-							return fmt.Errorf("enclosures: Failed to find bucket")
-						}
-
-						c := eb.Bucket([]byte(id))
-						if c == nil {
-							return fmt.Errorf("%q: Failed to find enclosure bucket", id)
-						}
-
-						for _, ch := range res.Channel.Item {
-							if err := b.Put([]byte(ch.Title), []byte(ch.Guid)); err != nil {
-								return err
-							}
-
-							if err := c.Put([]byte(ch.Guid), []byte(ch.Enclosure.URL)); err != nil {
-								return err
-							}
-						}
-					}
-					{
-						pb := tx.Bucket([]byte("queries"))
-						if pb == nil {
-							return fmt.Errorf("queries: Failed to find bucket")
-						}
-
-						b := pb.Bucket([]byte(id))
-						if b == nil {
-							return fmt.Errorf("%q: Failed to find queries bucket", id)
-						}
-
-						if err := b.Put([]byte(m["cat"]+m["q"]), binary.LittleEndian.AppendUint64(nil, uint64(nt))); err != nil {
-							return err
-						}
-					}
-
-					return nil
-				}); err != nil {
-					fmt.Printf("%q: Failed to commit database transaction: %q\n", id, err)
-				}
-			}(indexer.ID, map[string]string{"q": k, "cat": cat})
-		}
-
-		wg.Wait()
-		break
-	}
-
-	if err := db.Update(func(tx *bolt.Tx) error {
-		titb := tx.Bucket([]byte("titles"))
-		if titb == nil {
-			return fmt.Errorf("missing parent titles bucket")
-		}
-
-		eb := tx.Bucket([]byte("enclosures"))
-		if eb == nil {
-			return fmt.Errorf("missing parent enclosures bucket")
-		}
-
-		torb := tx.Bucket([]byte("torrents"))
-		if torb == nil {
-			return fmt.Errorf("missing torrents enclosures bucket")
-		}
-
-		titb.ForEachBucket(func(k []byte) error {
-			ibc := titb.Bucket(k)
-			ebc := eb.Bucket(k)
-			tbc := torb.Bucket(k)
-
-			ibc.ForEach(func(kc, v []byte) error {
-				ent, ok := mp.e[CacheFormatted(string(kc))]
-				if !ok {
-					return nil
-				}
-
-				r := CacheTitle(string(kc))
-				for _, e := range ent {
-					if rls.Compare(*r, *CacheTitle(e.Name)) != 0 {
-						continue
-					}
-
-					torrentbinary := tbc.Get(v)
-					if torrentbinary == nil {
-						enclosure := ebc.Get(v)
-						if enclosure == nil {
-							continue
-						}
-
-						torrentbinary, err = jc.GetEnclosure(string(enclosure))
-						if err != nil {
-							fmt.Printf("%q: error snatching %q: %q\n", k, kc, err)
-							continue
-						}
-
-						tbc.Put(v, torrentbinary)
-					}
-
-					req.Torrent = []byte(base64.RawStdEncoding.EncodeToString(torrentbinary))
-
-				}
-
-				return nil
-			})
-			return nil
-		})
-		return nil
-	}); err != nil {
-	}
-
-	http.Error(w, fmt.Sprintf("Processed: %d\n", len(processlist)), 200)
-}
-
 func CacheFormatted(title string) string {
-	r, ok := formattedmap.Get(title)
-	if !ok {
-		r = getFormattedTitle(title)
-		formattedmap.Set(title, r, ttlcache.DefaultTTL)
-	}
+	r, _ := formattedmap.GetOrLoad(title, func(title string) (string, time.Duration, error) {
+		return getFormattedTitle(title), ttlcache.DefaultTTL, nil
+	})
 
 	return r
 }
 
 func CacheTitle(title string) *rls.Release {
-	r, ok := titlemap.Get(title)
-	if !ok {
-		local := rls.ParseString(title)
-		r = &local
-
-		titlemap.Set(title, r, ttlcache.DefaultTTL)
-	}
+	r, _ := titlemap.GetOrLoad(title, func(title string) (*rls.Release, time.Duration, error) {
+		r := rls.ParseString(title)
+		return &r, ttlcache.DefaultTTL, nil
+	})
 
 	return r
 }
-
-func GetOrUpdate(mutex func() *sync.RWMutex, read func() bool, update func() error) error {
-	m := mutex()
-	m.RLock()
-	if read() {
-		m.RUnlock()
-		return nil
-	}
-	m.RUnlock()
-
-	m = mutex()
-	m.Lock()
-	defer m.Unlock()
-	return update()
-}
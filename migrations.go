@@ -0,0 +1,227 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net/url"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type migration struct {
+	version uint64
+	name    string
+	apply   func(tx *bolt.Tx) error
+}
+
+/*
+Databases without a meta bucket are version 0: enclosures, titles, torrents and queries
+with a nested bucket per indexer, query stamps keyed by cat+q. Migrations run in order,
+each in its own transaction alongside the version bump, and must never be edited once released.
+*/
+var migrations = []migration{
+	{1, "create buckets", migrateBuckets},
+	{2, "drop legacy query stamps", migrateQueryKeys},
+	{3, "stamp existing entries", migrateEntryStamps},
+	{4, "create audit bucket", migrateAudit},
+	{5, "create quarantine bucket", migrateQuarantine},
+	{6, "stamp flat entries", migrateFlatStamps},
+}
+
+var schemaVersion = migrations[len(migrations)-1].version
+
+func getSchemaVersion(tx *bolt.Tx) uint64 {
+	b := tx.Bucket([]byte("meta"))
+	if b == nil {
+		return 0
+	}
+
+	v := b.Get([]byte("version"))
+	if len(v) != 8 {
+		return 0
+	}
+
+	return binary.LittleEndian.Uint64(v)
+}
+
+func putSchemaVersion(tx *bolt.Tx, version uint64) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("meta"))
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte("version"), binary.LittleEndian.AppendUint64(nil, version))
+}
+
+/* Brings the database up to schemaVersion, returning the version it started at. */
+func migrateDatabase(d *bolt.DB) (uint64, error) {
+	var from uint64
+	if err := d.View(func(tx *bolt.Tx) error {
+		from = getSchemaVersion(tx)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+
+	if from > schemaVersion {
+		return from, fmt.Errorf("database schema %d is newer than supported %d", from, schemaVersion)
+	}
+
+	for _, m := range migrations {
+		if m.version <= from {
+			continue
+		}
+
+		if err := d.Update(func(tx *bolt.Tx) error {
+			if err := m.apply(tx); err != nil {
+				return err
+			}
+
+			return putSchemaVersion(tx, m.version)
+		}); err != nil {
+			return from, fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+
+		slog.Info("Migrated database", "version", m.version, "migration", m.name)
+	}
+
+	return from, nil
+}
+
+func migrateBuckets(tx *bolt.Tx) error {
+	for _, name := range append(indexerBuckets, "ids", "health", "hits", "stamps") {
+		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/* Query stamps used to be keyed by cat+q, they are now the encoded Torznab query and can never match again. */
+func migrateQueryKeys(tx *bolt.Tx) error {
+	pb := tx.Bucket([]byte("queries"))
+	return pb.ForEachBucket(func(k []byte) error {
+		b := pb.Bucket(k)
+		legacy := make([][]byte, 0)
+		if err := b.ForEach(func(kc, v []byte) error {
+			if q, err := url.ParseQuery(string(kc)); err != nil || !q.Has("t") {
+				legacy = append(legacy, bytes.Clone(kc))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, kc := range legacy {
+			if err := b.Delete(kc); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+/* Entries written before the stamps bucket existed start ageing from the migration. */
+func migrateEntryStamps(tx *bolt.Tx) error {
+	nt := globalTime.Now().Unix()
+	for _, name := range indexerBuckets {
+		if stampedBuckets[name] {
+			continue
+		}
+
+		pb := tx.Bucket([]byte(name))
+		if err := pb.ForEachBucket(func(k []byte) error {
+			stamps := stampsBucket(tx, name, string(k))
+			missing := make([][]byte, 0)
+			if err := pb.Bucket(k).ForEach(func(kc, v []byte) error {
+				if v == nil {
+					return nil
+				}
+
+				if stamps == nil || stamps.Get(kc) == nil {
+					missing = append(missing, bytes.Clone(kc))
+				}
+
+				return nil
+			}); err != nil {
+				return err
+			}
+
+			for _, kc := range missing {
+				if err := stampEntry(tx, name, string(k), kc, nt); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func migrateAudit(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte("audit"))
+	return err
+}
+
+func migrateQuarantine(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte("quarantine"))
+	return err
+}
+
+/* Hits and ids entries written before they were stamped start ageing from the migration. */
+func migrateFlatStamps(tx *bolt.Tx) error {
+	nt := globalTime.Now().Unix()
+	for name := range flatBuckets {
+		b := tx.Bucket([]byte(name))
+		if b == nil {
+			continue
+		}
+
+		stamps := stampsBucket(tx, name, "")
+		missing := make([][]byte, 0)
+		if err := b.ForEach(func(k, v []byte) error {
+			if v != nil && (stamps == nil || stamps.Get(k) == nil) {
+				missing = append(missing, bytes.Clone(k))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range missing {
+			if err := stampEntry(tx, name, "", k, nt); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,273 @@
+/* Package metrics is a small Prometheus text exposition registry covering labelled counters and histograms. */
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+var DefBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type collector interface {
+	write(w *bufio.Writer)
+}
+
+type Registry struct {
+	m          sync.Mutex
+	collectors []collector
+}
+
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) register(c collector) {
+	r.m.Lock()
+	defer r.m.Unlock()
+	r.collectors = append(r.collectors, c)
+}
+
+type desc struct {
+	name   string
+	help   string
+	kind   string
+	labels []string
+}
+
+func (d *desc) header(w *bufio.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", d.name, d.help, d.name, d.kind)
+}
+
+func (d *desc) key(values []string) string {
+	if len(values) != len(d.labels) {
+		panic(fmt.Sprintf("metrics: %s expects %d label values, got %d", d.name, len(d.labels), len(values)))
+	}
+
+	return strings.Join(values, "\xff")
+}
+
+func (d *desc) pairs(values []string, extra ...string) string {
+	parts := make([]string, 0, len(values)+1)
+	for i, v := range values {
+		parts = append(parts, d.labels[i]+`="`+labelEscaper.Replace(v)+`"`)
+	}
+
+	parts = append(parts, extra...)
+	if len(parts) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+type counterValue struct {
+	values []string
+	v      float64
+}
+
+type CounterVec struct {
+	desc
+	m sync.Mutex
+	c map[string]*counterValue
+}
+
+func (r *Registry) NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{desc: desc{name: name, help: help, kind: "counter", labels: labels}, c: make(map[string]*counterValue)}
+	r.register(c)
+	return c
+}
+
+func (c *CounterVec) Add(delta float64, values ...string) {
+	if delta < 0 {
+		panic(fmt.Sprintf("metrics: %s cannot decrease", c.name))
+	}
+
+	k := c.key(values)
+	c.m.Lock()
+	defer c.m.Unlock()
+	cv, ok := c.c[k]
+	if !ok {
+		cv = &counterValue{values: append([]string(nil), values...)}
+		c.c[k] = cv
+	}
+
+	cv.v += delta
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Value(values ...string) float64 {
+	k := c.key(values)
+	c.m.Lock()
+	defer c.m.Unlock()
+	if cv, ok := c.c[k]; ok {
+		return cv.v
+	}
+
+	return 0
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.header(w)
+	for _, k := range sortedKeys(c.c) {
+		cv := c.c[k]
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.pairs(cv.values), formatFloat(cv.v))
+	}
+}
+
+type histogramValue struct {
+	values []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type HistogramVec struct {
+	desc
+	buckets []float64
+	m       sync.Mutex
+	h       map[string]*histogramValue
+}
+
+func (r *Registry) NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	b := append([]float64(nil), buckets...)
+	sort.Float64s(b)
+	h := &HistogramVec{desc: desc{name: name, help: help, kind: "histogram", labels: labels}, buckets: b, h: make(map[string]*histogramValue)}
+	r.register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	k := h.key(values)
+	h.m.Lock()
+	defer h.m.Unlock()
+	hv, ok := h.h[k]
+	if !ok {
+		hv = &histogramValue{values: append([]string(nil), values...), counts: make([]uint64, len(h.buckets))}
+		h.h[k] = hv
+	}
+
+	for i, b := range h.buckets {
+		if v <= b {
+			hv.counts[i]++
+		}
+	}
+
+	hv.count++
+	hv.sum += v
+}
+
+func (h *HistogramVec) Count(values ...string) uint64 {
+	k := h.key(values)
+	h.m.Lock()
+	defer h.m.Unlock()
+	if hv, ok := h.h[k]; ok {
+		return hv.count
+	}
+
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	h.m.Lock()
+	defer h.m.Unlock()
+	h.header(w)
+	for _, k := range sortedKeys(h.h) {
+		hv := h.h[k]
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.pairs(hv.values, `le="`+formatFloat(b)+`"`), hv.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.pairs(hv.values, `le="+Inf"`), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.pairs(hv.values), formatFloat(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.pairs(hv.values), hv.count)
+	}
+}
+
+/* Reports whatever collect emits at scrape time, for values kept elsewhere. */
+type FuncVec struct {
+	desc
+	collect func(emit func(v float64, values ...string))
+}
+
+func (r *Registry) NewCounterFunc(name, help string, collect func(emit func(v float64, values ...string)), labels ...string) *FuncVec {
+	return r.newFunc("counter", name, help, collect, labels)
+}
+
+func (r *Registry) NewGaugeFunc(name, help string, collect func(emit func(v float64, values ...string)), labels ...string) *FuncVec {
+	return r.newFunc("gauge", name, help, collect, labels)
+}
+
+func (r *Registry) newFunc(kind, name, help string, collect func(emit func(v float64, values ...string)), labels []string) *FuncVec {
+	f := &FuncVec{desc: desc{name: name, help: help, kind: kind, labels: labels}, collect: collect}
+	r.register(f)
+	return f
+}
+
+func (f *FuncVec) write(w *bufio.Writer) {
+	lines := make(map[string]string)
+	f.collect(func(v float64, values ...string) {
+		lines[f.key(values)] = fmt.Sprintf("%s%s %s\n", f.name, f.pairs(values), formatFloat(v))
+	})
+
+	f.header(w)
+	for _, k := range sortedKeys(lines) {
+		w.WriteString(lines[k])
+	}
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func (r *Registry) Write(w io.Writer) error {
+	r.m.Lock()
+	collectors := append([]collector(nil), r.collectors...)
+	r.m.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, c := range collectors {
+		c.write(bw)
+	}
+
+	return bw.Flush()
+}
+
+func (r *Registry) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		r.Write(w)
+	})
+}
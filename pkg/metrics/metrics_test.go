@@ -0,0 +1,131 @@
+package metrics
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCounter(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	c := r.NewCounterVec("test_total", "Test counter.", "host", "code")
+	c.Inc("a", "200")
+	c.Inc("a", "200")
+	c.Add(3, "b", "420")
+
+	if v := c.Value("a", "200"); v != 2 {
+		t.Fatalf("counter a = %v", v)
+	}
+
+	buf := &strings.Builder{}
+	if err := r.Write(buf); err != nil {
+		t.Fatalf("write: %q", err)
+	}
+
+	for _, want := range []string{
+		"# TYPE test_total counter\n",
+		`test_total{host="a",code="200"} 2` + "\n",
+		`test_total{host="b",code="420"} 3` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestCounterLabels(t *testing.T) {
+	t.Parallel()
+	c := NewRegistry().NewCounterVec("test_total", "Test counter.", "host")
+	defer func() {
+		if recover() == nil {
+			t.Fatalf("mismatched labels accepted")
+		}
+	}()
+
+	c.Inc("a", "b")
+}
+
+func TestHistogram(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	h := r.NewHistogramVec("test_seconds", "Test histogram.", []float64{1, 0.1}, "op")
+	h.Observe(0.05, "get")
+	h.Observe(0.5, "get")
+	h.Observe(5, "get")
+
+	if n := h.Count("get"); n != 3 {
+		t.Fatalf("count = %d", n)
+	}
+
+	buf := &strings.Builder{}
+	r.Write(buf)
+	for _, want := range []string{
+		`test_seconds_bucket{op="get",le="0.1"} 1` + "\n",
+		`test_seconds_bucket{op="get",le="1"} 2` + "\n",
+		`test_seconds_bucket{op="get",le="+Inf"} 3` + "\n",
+		`test_seconds_sum{op="get"} 5.55` + "\n",
+		`test_seconds_count{op="get"} 3` + "\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Fatalf("missing %q in:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test counter.", "name").Inc(`a "quoted" \ name`)
+
+	buf := &strings.Builder{}
+	r.Write(buf)
+	if want := `test_total{name="a \"quoted\" \\ name"} 1`; !strings.Contains(buf.String(), want) {
+		t.Fatalf("missing %q in:\n%s", want, buf.String())
+	}
+}
+
+func TestHandler(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	r.NewCounterVec("test_total", "Test counter.").Inc()
+
+	w := httptest.NewRecorder()
+	r.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain") {
+		t.Fatalf("content type %q", ct)
+	}
+
+	if !strings.Contains(w.Body.String(), "test_total 1\n") {
+		t.Fatalf("unlabelled counter missing:\n%s", w.Body.String())
+	}
+}
+
+func TestFunc(t *testing.T) {
+	t.Parallel()
+	r := NewRegistry()
+	hits := 1.0
+	r.NewCounterFunc("test_hits_total", "Test func counter.", func(emit func(v float64, values ...string)) {
+		emit(hits, "b")
+		emit(2, "a")
+	}, "cache")
+
+	r.NewGaugeFunc("test_entries", "Test func gauge.", func(emit func(v float64, values ...string)) {
+		emit(7)
+	})
+
+	hits = 5
+	buf := &strings.Builder{}
+	if err := r.Write(buf); err != nil {
+		t.Fatalf("write: %q", err)
+	}
+
+	want := "# HELP test_hits_total Test func counter.\n# TYPE test_hits_total counter\n" +
+		`test_hits_total{cache="a"} 2` + "\n" +
+		`test_hits_total{cache="b"} 5` + "\n" +
+		"# HELP test_entries Test func gauge.\n# TYPE test_entries gauge\n" +
+		"test_entries 7\n"
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
@@ -0,0 +1,76 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type Limiter struct {
+	m     sync.Mutex
+	every time.Duration
+	burst int
+	tat   time.Time
+}
+
+/* New allows one event every interval, with up to burst events at once. A zero interval disables limiting. */
+func New(every time.Duration, burst int) *Limiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &Limiter{
+		every: every,
+		burst: burst,
+	}
+}
+
+/* PerSecond is a convenience for New with a rate expressed in events per second. */
+func PerSecond(rate float64, burst int) *Limiter {
+	if rate <= 0 {
+		return New(0, burst)
+	}
+
+	return New(time.Duration(float64(time.Second)/rate), burst)
+}
+
+/* Reserve claims the next slot and returns how long the caller must wait before using it. */
+func (l *Limiter) Reserve() time.Duration {
+	if l == nil || l.every <= 0 {
+		return 0
+	}
+
+	l.m.Lock()
+	defer l.m.Unlock()
+
+	now := time.Now()
+	if l.tat.Before(now) {
+		l.tat = now
+	}
+
+	wait := l.tat.Add(-l.every * time.Duration(l.burst-1)).Sub(now)
+	l.tat = l.tat.Add(l.every)
+	if wait < 0 {
+		return 0
+	}
+
+	return wait
+}
+
+/* Wait blocks until the next slot is available or the context is done. */
+func (l *Limiter) Wait(ctx context.Context) error {
+	d := l.Reserve()
+	if d == 0 {
+		return ctx.Err()
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,58 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestDisabled(t *testing.T) {
+	t.Parallel()
+	l := New(0, 1)
+	for i := 0; i < 100; i++ {
+		if d := l.Reserve(); d != 0 {
+			t.Fatalf("waited on disabled limiter: %s", d)
+		}
+	}
+}
+
+func TestBurst(t *testing.T) {
+	t.Parallel()
+	l := New(time.Hour, 5)
+	for i := 0; i < 5; i++ {
+		if d := l.Reserve(); d != 0 {
+			t.Fatalf("waited inside burst %d: %s", i, d)
+		}
+	}
+
+	if d := l.Reserve(); d < time.Minute*59 {
+		t.Fatalf("burst exceeded without waiting: %s", d)
+	}
+}
+
+func TestWait(t *testing.T) {
+	t.Parallel()
+	l := PerSecond(20, 1)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.Wait(context.Background()); err != nil {
+			t.Fatalf("wait failed: %q", err)
+		}
+	}
+
+	if d := time.Since(start); d < 150*time.Millisecond {
+		t.Fatalf("rate not enforced: %s", d)
+	}
+}
+
+func TestWaitCancel(t *testing.T) {
+	t.Parallel()
+	l := New(time.Hour, 1)
+	l.Reserve()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.Wait(ctx); err == nil {
+		t.Fatalf("wait ignored cancellation")
+	}
+}
@@ -0,0 +1,163 @@
+package timecache
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/* Where caches get their time and timers from, RealClock unless a test says otherwise. */
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+/* C is nil for timers from AfterFunc. */
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+var RealClock Clock = realClock{}
+
+type realClock struct{}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{t: time.NewTimer(d)}
+}
+
+func (realClock) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{t: time.AfterFunc(d, f)}
+}
+
+func (r realTimer) C() <-chan time.Time {
+	return r.t.C
+}
+
+func (r realTimer) Stop() bool {
+	return r.t.Stop()
+}
+
+func (r realTimer) Reset(d time.Duration) bool {
+	return r.t.Reset(d)
+}
+
+/*
+Only moves when told to. Timers due by the new time fire in deadline order within Advance,
+AfterFunc callbacks run on the caller's goroutine, so their effects are visible once it returns.
+*/
+type FakeClock struct {
+	m      sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	c      *FakeClock
+	when   time.Time
+	ch     chan time.Time
+	f      func()
+	active bool
+	queued bool
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{now: now}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.now
+}
+
+func (c *FakeClock) NewTimer(d time.Duration) Timer {
+	return c.add(d, make(chan time.Time, 1), nil)
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	return c.add(d, nil, f)
+}
+
+func (c *FakeClock) add(d time.Duration, ch chan time.Time, f func()) *fakeTimer {
+	c.m.Lock()
+	defer c.m.Unlock()
+	t := &fakeTimer{c: c, when: c.now.Add(d), ch: ch, f: f, active: true, queued: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *FakeClock) Advance(d time.Duration) {
+	c.Set(c.Now().Add(d))
+}
+
+func (c *FakeClock) Set(now time.Time) {
+	c.m.Lock()
+	c.now = now
+	due := make([]*fakeTimer, 0)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.active && t.when.After(now) {
+			pending = append(pending, t)
+			continue
+		}
+
+		t.queued = false
+		if t.active {
+			t.active = false
+			due = append(due, t)
+		}
+	}
+
+	c.timers = pending
+	c.m.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].when.Before(due[j].when) })
+	for _, t := range due {
+		if t.f != nil {
+			t.f()
+			continue
+		}
+
+		select {
+		case t.ch <- t.when:
+		default:
+		}
+	}
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.m.Lock()
+	defer t.c.m.Unlock()
+	was := t.active
+	t.active = false
+	return was
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.m.Lock()
+	defer t.c.m.Unlock()
+	was := t.active
+	t.when = t.c.now.Add(d)
+	if !t.queued {
+		t.c.timers = append(t.c.timers, t)
+		t.queued = true
+	}
+
+	t.active = true
+	return was
+}
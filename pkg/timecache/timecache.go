@@ -13,6 +13,7 @@ type Cache struct {
 
 type Options struct {
 	round time.Duration
+	clock Clock
 }
 
 func New(o Options) *Cache {
@@ -48,17 +49,12 @@ func (t *Cache) update() time.Time {
 		d = time.Second * 1
 	}
 
-	t.t = time.Now().Round(d)
-
-	go func(duration time.Duration) {
-		if t.o.round > time.Nanosecond {
-			duration = t.o.round / 2
-		}
-
-		time.Sleep(duration)
-		t.reset()
-	}(d)
+	t.t = t.o.getClock().Now().Round(d)
+	if t.o.round > time.Nanosecond {
+		d = t.o.round / 2
+	}
 
+	t.o.getClock().AfterFunc(d, t.reset)
 	return t.t
 }
 
@@ -72,3 +68,16 @@ func (o Options) Round(d time.Duration) Options {
 	o.round = d
 	return o
 }
+
+func (o Options) Clock(c Clock) Options {
+	o.clock = c
+	return o
+}
+
+func (o Options) getClock() Clock {
+	if o.clock == nil {
+		return RealClock
+	}
+
+	return o.clock
+}
@@ -47,3 +47,64 @@ func TestResolution(t *testing.T) {
 		t.Fatalf("not enough resolution rounds %d", unique)
 	}
 }
+
+func TestFakeClock(t *testing.T) {
+	t.Parallel()
+	clock := NewFakeClock(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+	tc := New(Options{}.Round(time.Minute).Clock(clock))
+
+	first := tc.Now()
+	if !first.Equal(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("got %s", first)
+	}
+
+	/* Cached until half the resolution has passed. */
+	clock.Advance(29 * time.Second)
+	if now := tc.Now(); !now.Equal(first) {
+		t.Fatalf("refreshed early: %s", now)
+	}
+
+	clock.Advance(2 * time.Second)
+	if now := tc.Now(); !now.Equal(first.Add(time.Minute)) {
+		t.Fatalf("not refreshed and rounded: %s", now)
+	}
+}
+
+func TestFakeTimers(t *testing.T) {
+	t.Parallel()
+	clock := NewFakeClock(time.Unix(0, 0))
+	order := make([]int, 0)
+	clock.AfterFunc(2*time.Second, func() { order = append(order, 2) })
+	clock.AfterFunc(time.Second, func() { order = append(order, 1) })
+	stopped := clock.AfterFunc(time.Second, func() { order = append(order, 0) })
+	if !stopped.Stop() {
+		t.Fatalf("stop on an active timer")
+	}
+
+	timer := clock.NewTimer(3 * time.Second)
+	clock.Advance(2 * time.Second)
+	if len(order) != 2 || order[0] != 1 || order[1] != 2 {
+		t.Fatalf("fired %v", order)
+	}
+
+	select {
+	case <-timer.C():
+		t.Fatalf("fired early")
+	default:
+	}
+
+	timer.Reset(2 * time.Second)
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C():
+		t.Fatalf("reset ignored")
+	default:
+	}
+
+	clock.Advance(time.Second)
+	select {
+	case <-timer.C():
+	default:
+		t.Fatalf("not fired")
+	}
+}
@@ -0,0 +1,113 @@
+package torznab
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+)
+
+type Config struct {
+	URL    string
+	APIKey string
+	Client *http.Client
+}
+
+type Client struct {
+	cfg Config
+}
+
+type Caps struct {
+	XMLName   xml.Name `xml:"caps"`
+	Searching struct {
+		Search      SearchCap `xml:"search"`
+		TvSearch    SearchCap `xml:"tv-search"`
+		MovieSearch SearchCap `xml:"movie-search"`
+		MusicSearch SearchCap `xml:"music-search"`
+		AudioSearch SearchCap `xml:"audio-search"`
+		BookSearch  SearchCap `xml:"book-search"`
+	} `xml:"searching"`
+	Categories struct {
+		Category []Category `xml:"category"`
+	} `xml:"categories"`
+}
+
+type SearchCap struct {
+	Available       string `xml:"available,attr"`
+	SupportedParams string `xml:"supportedParams,attr"`
+}
+
+type Category struct {
+	ID     string     `xml:"id,attr"`
+	Name   string     `xml:"name,attr"`
+	Subcat []Category `xml:"subcat"`
+}
+
+type Item struct {
+	Title     string   `xml:"title"`
+	GUID      string   `xml:"guid"`
+	Link      string   `xml:"link"`
+	PubDate   string   `xml:"pubDate"`
+	Size      string   `xml:"size"`
+	Category  []string `xml:"category"`
+	Enclosure struct {
+		URL    string `xml:"url,attr"`
+		Length string `xml:"length,attr"`
+		Type   string `xml:"type,attr"`
+	} `xml:"enclosure"`
+	Attr []Attr `xml:"attr"`
+}
+
+type Attr struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type Query struct {
+	Type   string
+	Q      string
+	Cat    []string
+	Season string
+	Ep     string
+	IMDBID string
+	TVDBID string
+	TMDBID string
+	Limit  int
+	Offset int
+}
+
+type Error struct {
+	Code        string `xml:"code,attr"`
+	Description string `xml:"description,attr"`
+}
+
+func (e *Error) Error() string {
+	return "torznab error " + e.Code + ": " + e.Description
+}
+
+func (s SearchCap) IsAvailable() bool {
+	return strings.EqualFold(s.Available, "yes")
+}
+
+func (s SearchCap) Supports(param string) bool {
+	if !s.IsAvailable() {
+		return false
+	}
+
+	for _, p := range strings.Split(s.SupportedParams, ",") {
+		if strings.EqualFold(strings.TrimSpace(p), param) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (i Item) GetAttr(name string) string {
+	for _, a := range i.Attr {
+		if strings.EqualFold(a.Name, name) {
+			return a.Value
+		}
+	}
+
+	return ""
+}
@@ -0,0 +1,184 @@
+package torznab
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+func New(cfg Config) *Client {
+	if cfg.Client == nil {
+		cfg.Client = http.DefaultClient
+	}
+
+	cfg.URL = strings.TrimSuffix(cfg.URL, "/")
+	return &Client{cfg: cfg}
+}
+
+func (c *Client) URL() string {
+	return c.cfg.URL
+}
+
+func (c *Client) Caps(ctx context.Context) (Caps, error) {
+	var caps Caps
+	body, err := c.get(ctx, url.Values{"t": {"caps"}})
+	if err != nil {
+		return caps, err
+	}
+
+	return ParseCaps(bytes.NewReader(body))
+}
+
+func (c *Client) Search(ctx context.Context, q Query) ([]Item, error) {
+	body, err := c.get(ctx, q.Values())
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseFeed(bytes.NewReader(body))
+}
+
+func (c *Client) Download(ctx context.Context, enclosure string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, enclosure, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+func (c *Client) get(ctx context.Context, v url.Values) ([]byte, error) {
+	if len(c.cfg.APIKey) != 0 {
+		v.Set("apikey", c.cfg.APIKey)
+	}
+
+	sep := "?"
+	if strings.Contains(c.cfg.URL, "?") {
+		sep = "&"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.cfg.URL+sep+v.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.do(req)
+}
+
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	res, err := c.cfg.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		if e := parseError(body); e != nil {
+			return nil, e
+		}
+
+		return nil, fmt.Errorf("unexpected status %d", res.StatusCode)
+	}
+
+	return body, nil
+}
+
+func parseError(body []byte) *Error {
+	var e struct {
+		XMLName xml.Name `xml:"error"`
+		Error
+	}
+
+	if err := xml.Unmarshal(body, &e); err != nil {
+		return nil
+	}
+
+	return &e.Error
+}
+
+func ParseCaps(r io.Reader) (Caps, error) {
+	var caps Caps
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return caps, err
+	}
+
+	if e := parseError(body); e != nil {
+		return caps, e
+	}
+
+	err = xml.Unmarshal(body, &caps)
+	return caps, err
+}
+
+func ParseFeed(r io.Reader) ([]Item, error) {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if e := parseError(body); e != nil {
+		return nil, e
+	}
+
+	var rss struct {
+		XMLName xml.Name `xml:"rss"`
+		Channel struct {
+			Item []Item `xml:"item"`
+		} `xml:"channel"`
+	}
+
+	if err := xml.Unmarshal(body, &rss); err != nil {
+		return nil, err
+	}
+
+	return rss.Channel.Item, nil
+}
+
+func (q Query) Values() url.Values {
+	v := url.Values{}
+	t := q.Type
+	if len(t) == 0 {
+		t = "search"
+	}
+
+	v.Set("t", t)
+	set := func(k, val string) {
+		if len(val) != 0 {
+			v.Set(k, val)
+		}
+	}
+
+	set("q", q.Q)
+	set("cat", strings.Join(q.Cat, ","))
+	set("season", q.Season)
+	set("ep", q.Ep)
+	set("imdbid", q.IMDBID)
+	set("tvdbid", q.TVDBID)
+	set("tmdbid", q.TMDBID)
+	if q.Limit > 0 {
+		v.Set("limit", strconv.Itoa(q.Limit))
+	}
+
+	if q.Offset > 0 {
+		v.Set("offset", strconv.Itoa(q.Offset))
+	}
+
+	return v
+}
+
+/* Key is a stable representation of the query, suitable for caching. */
+func (q Query) Key() string {
+	return q.Values().Encode()
+}
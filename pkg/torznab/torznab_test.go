@@ -0,0 +1,145 @@
+package torznab
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+const capsXML = `<?xml version="1.0" encoding="UTF-8"?>
+<caps>
+  <server title="Prowlarr" />
+  <limits default="100" max="100" />
+  <searching>
+    <search available="yes" supportedParams="q" />
+    <tv-search available="yes" supportedParams="q,season,ep,imdbid,tvdbid" />
+    <movie-search available="yes" supportedParams="q,imdbid,tmdbid" />
+    <music-search available="no" supportedParams="q" />
+    <book-search available="no" supportedParams="q" />
+  </searching>
+  <categories>
+    <category id="2000" name="Movies">
+      <subcat id="2040" name="Movies/HD" />
+    </category>
+    <category id="5000" name="TV" />
+  </categories>
+</caps>`
+
+const feedXML = `<?xml version="1.0" encoding="UTF-8"?>
+<rss version="2.0" xmlns:atom="http://www.w3.org/2005/Atom" xmlns:torznab="http://torznab.com/schemas/2015/feed">
+  <channel>
+    <title>Indexer</title>
+    <item>
+      <title>Show.S01E02.1080p.WEB.h264-GRP</title>
+      <guid>https://indexer/details/1</guid>
+      <pubDate>Mon, 02 Jan 2006 15:04:05 +0000</pubDate>
+      <size>1234</size>
+      <category>5040</category>
+      <enclosure url="https://indexer/download/1" length="1234" type="application/x-bittorrent" />
+      <torznab:attr name="seeders" value="7" />
+      <torznab:attr name="imdbid" value="tt0000001" />
+    </item>
+    <item>
+      <title>Movie.2020.2160p.BluRay.x265-GRP</title>
+      <guid>https://indexer/details/2</guid>
+      <enclosure url="https://indexer/download/2" length="5678" type="application/x-bittorrent" />
+    </item>
+  </channel>
+</rss>`
+
+func TestParseCaps(t *testing.T) {
+	t.Parallel()
+	caps, err := ParseCaps(strings.NewReader(capsXML))
+	if err != nil {
+		t.Fatalf("parse failed: %q", err)
+	}
+
+	if !caps.Searching.TvSearch.Supports("ep") || !caps.Searching.MovieSearch.Supports("tmdbid") {
+		t.Fatalf("missing supported params: %+v", caps.Searching)
+	}
+
+	if caps.Searching.MusicSearch.Supports("q") || caps.Searching.AudioSearch.IsAvailable() {
+		t.Fatalf("unavailable search reported as supported")
+	}
+
+	if len(caps.Categories.Category) != 2 || len(caps.Categories.Category[0].Subcat) != 1 {
+		t.Fatalf("bad categories: %+v", caps.Categories)
+	}
+}
+
+func TestParseFeed(t *testing.T) {
+	t.Parallel()
+	items, err := ParseFeed(strings.NewReader(feedXML))
+	if err != nil {
+		t.Fatalf("parse failed: %q", err)
+	}
+
+	if len(items) != 2 {
+		t.Fatalf("expected 2 items: %d", len(items))
+	}
+
+	if items[0].Enclosure.URL != "https://indexer/download/1" || items[0].GetAttr("imdbid") != "tt0000001" {
+		t.Fatalf("bad item: %+v", items[0])
+	}
+
+	if items[1].GetAttr("seeders") != "" {
+		t.Fatalf("unexpected attribute")
+	}
+}
+
+func TestParseError(t *testing.T) {
+	t.Parallel()
+	_, err := ParseFeed(strings.NewReader(`<?xml version="1.0"?><error code="100" description="Invalid API Key" />`))
+	if e, ok := err.(*Error); !ok || e.Code != "100" {
+		t.Fatalf("expected torznab error: %v", err)
+	}
+}
+
+func TestQueryValues(t *testing.T) {
+	t.Parallel()
+	q := Query{Type: "tvsearch", Q: "show", Cat: []string{"5000", "5040"}, Season: "1", Ep: "2"}
+	if k := q.Key(); k != "cat=5000%2C5040&ep=2&q=show&season=1&t=tvsearch" {
+		t.Fatalf("bad key: %q", k)
+	}
+
+	if v := (Query{Q: "x"}).Values(); v.Get("t") != "search" {
+		t.Fatalf("default type not search: %q", v.Get("t"))
+	}
+}
+
+func TestClient(t *testing.T) {
+	t.Parallel()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("apikey") != "key" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`<error code="100" description="Invalid API Key" />`))
+			return
+		}
+
+		switch r.URL.Query().Get("t") {
+		case "caps":
+			w.Write([]byte(capsXML))
+		case "tvsearch":
+			w.Write([]byte(feedXML))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	c := New(Config{URL: srv.URL + "/1/api", APIKey: "key"})
+	if _, err := c.Caps(context.Background()); err != nil {
+		t.Fatalf("caps failed: %q", err)
+	}
+
+	items, err := c.Search(context.Background(), Query{Type: "tvsearch", Q: "show"})
+	if err != nil || len(items) != 2 {
+		t.Fatalf("search failed: %d %v", len(items), err)
+	}
+
+	if _, err := New(Config{URL: srv.URL}).Caps(context.Background()); err == nil {
+		t.Fatalf("missing api key accepted")
+	}
+}
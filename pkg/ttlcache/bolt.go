@@ -0,0 +1,209 @@
+package ttlcache
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+Keeps entries in a bucket of its own. Writes are buffered and flushed together on an interval,
+so the cache never waits on the disk, and a crash loses at most one interval.
+*/
+type BoltBackend[K comparable, V any] struct {
+	db     *bolt.DB
+	bucket []byte
+	keys   Codec[K]
+	values Codec[V]
+	o      BoltOptions
+
+	m       sync.Mutex
+	pending map[K]*record[V]
+	done    chan struct{}
+	stopped chan struct{}
+}
+
+/* A nil record in the pending set is a removal. */
+type record[V any] struct {
+	v V
+	d time.Duration
+	t time.Time
+}
+
+type BoltOptions struct {
+	flushInterval time.Duration
+	errorFunc     func(err error)
+}
+
+func NewBoltBackend[K comparable, V any](db *bolt.DB, bucket string, keys Codec[K], values Codec[V], o BoltOptions) *BoltBackend[K, V] {
+	if o.flushInterval <= 0 {
+		o.flushInterval = time.Second * 5
+	}
+
+	b := &BoltBackend[K, V]{
+		db:      db,
+		bucket:  []byte(bucket),
+		keys:    keys,
+		values:  values,
+		o:       o,
+		pending: make(map[K]*record[V]),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go b.run()
+	return b
+}
+
+func (o BoltOptions) SetFlushInterval(d time.Duration) BoltOptions {
+	o.flushInterval = d
+	return o
+}
+
+/* Receives failed flushes and entries that no longer decode. */
+func (o BoltOptions) SetErrorFunc(f func(err error)) BoltOptions {
+	o.errorFunc = f
+	return o
+}
+
+func (b *BoltBackend[K, V]) Load(f func(key K, value V, d time.Duration, t time.Time)) error {
+	broken := make([][]byte, 0)
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bk := tx.Bucket(b.bucket)
+		if bk == nil {
+			return nil
+		}
+
+		return bk.ForEach(func(k, v []byte) error {
+			key, err := b.keys.Decode(k)
+			if err != nil || len(v) < 16 {
+				broken = append(broken, append([]byte(nil), k...))
+				return nil
+			}
+
+			value, err := b.values.Decode(v[16:])
+			if err != nil {
+				broken = append(broken, append([]byte(nil), k...))
+				return nil
+			}
+
+			var t time.Time
+			if n := int64(binary.BigEndian.Uint64(v)); n != 0 {
+				t = time.Unix(0, n)
+			}
+
+			f(key, value, time.Duration(binary.BigEndian.Uint64(v[8:])), t)
+			return nil
+		})
+	})
+
+	if len(broken) != 0 && err == nil {
+		err = b.db.Update(func(tx *bolt.Tx) error {
+			bk := tx.Bucket(b.bucket)
+			for _, k := range broken {
+				if err := bk.Delete(k); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	}
+
+	b.report(err)
+	return err
+}
+
+func (b *BoltBackend[K, V]) Store(key K, value V, d time.Duration, t time.Time) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.pending[key] = &record[V]{v: value, d: d, t: t}
+}
+
+func (b *BoltBackend[K, V]) Delete(key K) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	b.pending[key] = nil
+}
+
+/* Writes everything buffered so far. */
+func (b *BoltBackend[K, V]) Flush() error {
+	b.m.Lock()
+	pending := b.pending
+	b.pending = make(map[K]*record[V])
+	b.m.Unlock()
+
+	if len(pending) == 0 {
+		return nil
+	}
+
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bk, err := tx.CreateBucketIfNotExists(b.bucket)
+		if err != nil {
+			return err
+		}
+
+		for key, r := range pending {
+			k, err := b.keys.Encode(key)
+			if err != nil {
+				b.report(err)
+				continue
+			}
+
+			if r == nil {
+				if err := bk.Delete(k); err != nil {
+					return err
+				}
+
+				continue
+			}
+
+			v, err := b.values.Encode(r.v)
+			if err != nil {
+				b.report(err)
+				continue
+			}
+
+			buf := make([]byte, 16, 16+len(v))
+			if !r.t.IsZero() {
+				binary.BigEndian.PutUint64(buf, uint64(r.t.UnixNano()))
+			}
+
+			binary.BigEndian.PutUint64(buf[8:], uint64(r.d))
+			if err := bk.Put(k, append(buf, v...)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+/* Stops the flush loop after a final flush. The database stays open, it belongs to the caller. */
+func (b *BoltBackend[K, V]) Close() error {
+	close(b.done)
+	<-b.stopped
+	return b.Flush()
+}
+
+func (b *BoltBackend[K, V]) run() {
+	defer close(b.stopped)
+	t := time.NewTicker(b.o.flushInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-t.C:
+			b.report(b.Flush())
+		}
+	}
+}
+
+func (b *BoltBackend[K, V]) report(err error) {
+	if err != nil && b.o.errorFunc != nil {
+		b.o.errorFunc(err)
+	}
+}
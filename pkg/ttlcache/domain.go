@@ -16,6 +16,17 @@ type Cache[K comparable, V any] struct {
 	o  Options[K, V]
 	ch chan time.Time
 	m  map[K]Item[V]
+
+	h    evictionHeap[K]
+	n    map[K]*evictionNode[K]
+	cost int64
+	tick uint64
+
+	lm    sync.Mutex
+	calls map[K]*call[V]
+	errs  map[K]loadError
+
+	s counters
 }
 
 type Item[V any] struct {
@@ -29,6 +40,13 @@ type Options[K comparable, V any] struct {
 	defaultResolution time.Duration
 	deallocationFunc  DeallocationFunc[K, V]
 	noUpdateTime      bool
+	maxEntries        int64
+	costFunc          CostFunc[K, V]
+	evictionPolicy    EvictionPolicy
+	errorTTL          time.Duration
+	refreshAhead      time.Duration
+	clock             timecache.Clock
+	backend           Backend[K, V]
 }
 
 type DeallocationReason int
@@ -36,6 +54,17 @@ type DeallocationReason int
 const (
 	ReasonTimedOut = DeallocationReason(iota)
 	ReasonDeleted  = DeallocationReason(iota)
+	ReasonEvicted  = DeallocationReason(iota)
 )
 
 type DeallocationFunc[K comparable, V any] func(key K, value V, reason DeallocationReason)
+
+/* With a cost function the cache bounds the summed cost of its entries rather than their count. */
+type CostFunc[K comparable, V any] func(key K, value V) int64
+
+type EvictionPolicy int
+
+const (
+	EvictLRU = EvictionPolicy(iota)
+	EvictLFU = EvictionPolicy(iota)
+)
@@ -0,0 +1,114 @@
+package ttlcache
+
+import "container/heap"
+
+/* The heap root is always the next victim: least recently used, or least frequently used with ties going to the oldest. */
+type evictionNode[K comparable] struct {
+	key   K
+	cost  int64
+	freq  uint64
+	tick  uint64
+	index int
+}
+
+type evictionHeap[K comparable] struct {
+	policy EvictionPolicy
+	nodes  []*evictionNode[K]
+}
+
+func (h *evictionHeap[K]) Len() int {
+	return len(h.nodes)
+}
+
+func (h *evictionHeap[K]) Less(i, j int) bool {
+	a, b := h.nodes[i], h.nodes[j]
+	if h.policy == EvictLFU && a.freq != b.freq {
+		return a.freq < b.freq
+	}
+
+	return a.tick < b.tick
+}
+
+func (h *evictionHeap[K]) Swap(i, j int) {
+	h.nodes[i], h.nodes[j] = h.nodes[j], h.nodes[i]
+	h.nodes[i].index = i
+	h.nodes[j].index = j
+}
+
+func (h *evictionHeap[K]) Push(x any) {
+	n := x.(*evictionNode[K])
+	n.index = len(h.nodes)
+	h.nodes = append(h.nodes, n)
+}
+
+func (h *evictionHeap[K]) Pop() any {
+	old := h.nodes
+	n := old[len(old)-1]
+	old[len(old)-1] = nil
+	h.nodes = old[:len(old)-1]
+	n.index = -1
+	return n
+}
+
+func (c *Cache[K, V]) bounded() bool {
+	return c.o.maxEntries > 0
+}
+
+func (c *Cache[K, V]) costOf(key K, value V) int64 {
+	if c.o.costFunc == nil {
+		return 1
+	}
+
+	return max(c.o.costFunc(key, value), 0)
+}
+
+/* Must hold the write lock. */
+func (c *Cache[K, V]) touch(key K) {
+	n, ok := c.n[key]
+	if !ok {
+		return
+	}
+
+	c.tick++
+	n.freq++
+	n.tick = c.tick
+	heap.Fix(&c.h, n.index)
+}
+
+/*
+Must hold the write lock. Makes room for the entry before it goes in, so a fresh entry
+is never its own victim under LFU. Replacing an entry keeps its use count.
+*/
+func (c *Cache[K, V]) admit(key K, value V) {
+	var freq uint64
+	if n, ok := c.n[key]; ok {
+		heap.Remove(&c.h, n.index)
+		delete(c.n, key)
+		c.cost -= n.cost
+		freq = n.freq
+	}
+
+	cost := c.costOf(key, value)
+	for c.h.Len() != 0 && c.cost+cost > c.o.maxEntries {
+		victim := c.h.nodes[0].key
+		c.deleteUnsafe(victim, c.m[victim], ReasonEvicted)
+	}
+
+	c.tick++
+	n := &evictionNode[K]{key: key, cost: cost, freq: max(freq, 1), tick: c.tick}
+	heap.Push(&c.h, n)
+	c.n[key] = n
+	c.cost += cost
+}
+
+/* Must hold the write lock. */
+func (c *Cache[K, V]) forget(key K) {
+	n, ok := c.n[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&c.h, n.index)
+	delete(c.n, key)
+	c.cost -= n.cost
+}
@@ -2,10 +2,12 @@ package ttlcache
 
 import (
 	"time"
+
+	"github.com/titlerr/upgraderr/pkg/timecache"
 )
 
 func (c *Cache[K, V]) startExpirations() {
-	timer := time.NewTimer(1 * time.Second)
+	timer := c.o.getClock().NewTimer(1 * time.Second)
 	stopTimer(timer) // wasteful, but makes the loop cleaner because this is initialized.
 	defer stopTimer(timer)
 
@@ -24,7 +26,7 @@ func (c *Cache[K, V]) startExpirations() {
 				restartTimer(timer, timeSleep.Sub(c.tc.Now()))
 			}
 
-		case <-timer.C:
+		case <-timer.C():
 			stopTimer(timer)
 			c.expire()
 			timeSleep = time.Time{}
@@ -32,17 +34,17 @@ func (c *Cache[K, V]) startExpirations() {
 	}
 }
 
-func restartTimer(t *time.Timer, d time.Duration) {
+func restartTimer(t timecache.Timer, d time.Duration) {
 	stopTimer(t)
 	t.Reset(d)
 }
 
-func stopTimer(t *time.Timer) {
+func stopTimer(t timecache.Timer) {
 	t.Stop()
 
 	// go < 1.23 returns stale values on expired timers.
-	if len(t.C) != 0 {
-		<-t.C
+	if len(t.C()) != 0 {
+		<-t.C()
 	}
 }
 
@@ -65,6 +67,14 @@ func (c *Cache[K, V]) expire() {
 		c.deleteUnsafe(k, v, ReasonTimedOut)
 	}
 
+	for k, e := range c.errs {
+		if !e.until.After(t) {
+			delete(c.errs, k)
+		} else if soon.IsZero() || soon.After(e.until) {
+			soon = e.until
+		}
+	}
+
 	if !soon.IsZero() { // wake-up feedback loop
 		go func(s time.Time) { // we need to release the lock, if the input pipeline has exceeded the wakeup budget.
 			defer func() {
@@ -3,9 +3,23 @@ package ttlcache
 import "time"
 
 func (c *Cache[K, V]) get(key K) (Item[V], bool) {
+	if c.bounded() {
+		c.l.Lock()
+		defer c.l.Unlock()
+		it, ok := c._g(key)
+		if ok {
+			c.touch(key)
+		}
+
+		c.s.lookup(ok)
+		return it, ok
+	}
+
 	c.l.RLock()
 	defer c.l.RUnlock()
-	return c._g(key)
+	it, ok := c._g(key)
+	c.s.lookup(ok)
+	return it, ok
 }
 
 func (c *Cache[K, V]) _g(key K) (Item[V], bool) {
@@ -14,6 +28,11 @@ func (c *Cache[K, V]) _g(key K) (Item[V], bool) {
 		return v, ok
 	}
 
+	/* Expired but not yet reaped by the expiration loop. */
+	if !v.t.IsZero() && !v.t.After(c.tc.Now()) {
+		return Item[V]{}, false
+	}
+
 	return v, ok
 }
 
@@ -27,7 +46,13 @@ func (c *Cache[K, V]) set(key K, it Item[V]) Item[V] {
 
 func (c *Cache[K, V]) _s(key K, it Item[V]) Item[V] {
 	it.d, it.t = c.getDuration(it.d)
+	delete(c.errs, key)
+	if c.bounded() {
+		c.admit(key, it.v)
+	}
+
 	c.m[key] = it
+	c.persist(key, it)
 	c.ch <- it.t
 	return it
 }
@@ -39,24 +64,30 @@ func (c *Cache[K, V]) getOrSet(key K, it Item[V]) (Item[V], bool) {
 }
 
 func (c *Cache[K, V]) _gos(key K, it Item[V]) (Item[V], bool) {
-	if g, ok := c._g(key); ok {
+	g, ok := c._g(key)
+	c.s.lookup(ok)
+	if ok {
+		if c.bounded() {
+			c.touch(key)
+		}
+
 		return g, ok
+	} else if old, ok := c.m[key]; ok {
+		c.deleteUnsafe(key, old, ReasonTimedOut)
 	}
 
+	c.s.sets.Add(1)
 	return c._s(key, it), true
 }
 
 func (c *Cache[K, V]) delete(key K, reason DeallocationReason) {
-	var v Item[V]
 	c.l.Lock()
 	defer c.l.Unlock()
+	delete(c.errs, key)
 
-	if c.o.deallocationFunc != nil {
-		var ok bool
-		v, ok = c.m[key]
-		if !ok {
-			return
-		}
+	v, ok := c.m[key]
+	if !ok {
+		return
 	}
 
 	c.deleteUnsafe(key, v, reason)
@@ -64,6 +95,11 @@ func (c *Cache[K, V]) delete(key K, reason DeallocationReason) {
 
 func (c *Cache[K, V]) deleteUnsafe(key K, v Item[V], reason DeallocationReason) {
 	delete(c.m, key)
+	c.unpersist(key)
+	c.s.removed(reason)
+	if c.bounded() {
+		c.forget(key)
+	}
 
 	if c.o.deallocationFunc != nil {
 		c.o.deallocationFunc(key, v.v, reason)
@@ -74,7 +110,7 @@ func (c *Cache[K, V]) getkeys() []K {
 	c.l.RLock()
 	defer c.l.RUnlock()
 
-	keys := make([]K, len(c.m))
+	keys := make([]K, 0, len(c.m))
 	for k := range c.m {
 		keys = append(keys, k)
 	}
@@ -82,6 +118,24 @@ func (c *Cache[K, V]) getkeys() []K {
 	return keys
 }
 
+func (c *Cache[K, V]) len() int {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	return len(c.m)
+}
+
+func (c *Cache[K, V]) snapshot() map[K]Item[V] {
+	c.l.RLock()
+	defer c.l.RUnlock()
+
+	m := make(map[K]Item[V], len(c.m))
+	for k, v := range c.m {
+		m[k] = v
+	}
+
+	return m
+}
+
 func (c *Cache[K, V]) close() {
 	c.l.Lock()
 	defer c.l.Unlock()
@@ -0,0 +1,101 @@
+package ttlcache
+
+import (
+	"errors"
+	"time"
+)
+
+/* Returns the value to cache along with its TTL, DefaultTTL and NoTTL behave as they do for Set. */
+type Loader[K comparable, V any] func(key K) (V, time.Duration, error)
+
+var errLoaderPanic = errors.New("ttlcache: loader panicked")
+
+type call[V any] struct {
+	done chan struct{}
+	v    V
+	err  error
+}
+
+type loadError struct {
+	err   error
+	until time.Time
+}
+
+/*
+Returns the cached value, or runs loader once for every concurrent caller of the same key.
+Failed loads are remembered for the error TTL when one is set. With refresh-ahead, a hit
+that is about to expire is reloaded in the background while the current value is returned.
+*/
+func (c *Cache[K, V]) GetOrLoad(key K, loader Loader[K, V]) (V, error) {
+	if it, ok := c.GetItem(key); ok {
+		if c.o.refreshAhead != 0 && !it.t.IsZero() && it.t.Sub(c.tc.Now()) < c.o.refreshAhead {
+			go c.load(key, loader)
+		}
+
+		return it.v, nil
+	}
+
+	if err := c.loadError(key); err != nil {
+		return *new(V), err
+	}
+
+	return c.load(key, loader)
+}
+
+/* Always runs loader, joining a load already in flight for the key. */
+func (c *Cache[K, V]) Reload(key K, loader Loader[K, V]) (V, error) {
+	return c.load(key, loader)
+}
+
+func (c *Cache[K, V]) load(key K, loader Loader[K, V]) (V, error) {
+	c.lm.Lock()
+	if cl, ok := c.calls[key]; ok {
+		c.lm.Unlock()
+		<-cl.done
+		return cl.v, cl.err
+	}
+
+	cl := &call[V]{done: make(chan struct{}), err: errLoaderPanic}
+	c.calls[key] = cl
+	c.lm.Unlock()
+
+	defer func() {
+		c.lm.Lock()
+		delete(c.calls, key)
+		c.lm.Unlock()
+		close(cl.done)
+	}()
+
+	var d time.Duration
+	cl.v, d, cl.err = loader(key)
+	if cl.err != nil {
+		if c.o.errorTTL != NoTTL {
+			c.setLoadError(key, cl.err)
+		}
+
+		return cl.v, cl.err
+	}
+
+	c.s.sets.Add(1)
+	c.set(key, Item[V]{v: cl.v, d: c.fixupDuration(d)})
+	return cl.v, nil
+}
+
+func (c *Cache[K, V]) loadError(key K) error {
+	c.l.RLock()
+	defer c.l.RUnlock()
+	if e, ok := c.errs[key]; ok && e.until.After(c.tc.Now()) {
+		return e.err
+	}
+
+	return nil
+}
+
+func (c *Cache[K, V]) setLoadError(key K, err error) {
+	until := c.tc.Now().Add(c.o.errorTTL)
+
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.errs[key] = loadError{err: err, until: until}
+	c.ch <- until
+}
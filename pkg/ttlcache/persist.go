@@ -0,0 +1,94 @@
+package ttlcache
+
+import (
+	"encoding/json"
+	"time"
+)
+
+/* Turns keys or values into bytes for a backend and back. */
+type Codec[T any] interface {
+	Encode(v T) ([]byte, error)
+	Decode(b []byte) (T, error)
+}
+
+type JSONCodec[T any] struct{}
+
+func (JSONCodec[T]) Encode(v T) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (JSONCodec[T]) Decode(b []byte) (T, error) {
+	var v T
+	err := json.Unmarshal(b, &v)
+	return v, err
+}
+
+type StringCodec struct{}
+
+func (StringCodec) Encode(v string) ([]byte, error) {
+	return []byte(v), nil
+}
+
+func (StringCodec) Decode(b []byte) (string, error) {
+	return string(b), nil
+}
+
+/*
+Sees every write and removal of the cache it is given to, under the cache lock, so both must be cheap.
+Load hands back what was stored, expiry included, when the cache is created.
+*/
+type Backend[K comparable, V any] interface {
+	Load(f func(key K, value V, d time.Duration, t time.Time)) error
+	Store(key K, value V, d time.Duration, t time.Time)
+	Delete(key K)
+	Close() error
+}
+
+/* Runs before the expiration loop starts, entries that expired while stored are dropped from the backend. */
+func (c *Cache[K, V]) restore() error {
+	nt := c.tc.Now()
+	var soon time.Time
+	expired := make([]K, 0)
+
+	c.l.Lock()
+	err := c.o.backend.Load(func(key K, value V, d time.Duration, t time.Time) {
+		if !t.IsZero() && !t.After(nt) {
+			expired = append(expired, key)
+			return
+		}
+
+		if c.bounded() {
+			c.admit(key, value)
+		}
+
+		c.m[key] = Item[V]{v: value, d: d, t: t}
+		if !t.IsZero() && (soon.IsZero() || soon.After(t)) {
+			soon = t
+		}
+	})
+	c.l.Unlock()
+
+	for _, key := range expired {
+		c.o.backend.Delete(key)
+	}
+
+	if !soon.IsZero() {
+		c.ch <- soon
+	}
+
+	return err
+}
+
+/* Must hold the write lock. */
+func (c *Cache[K, V]) persist(key K, it Item[V]) {
+	if c.o.backend != nil {
+		c.o.backend.Store(key, it.v, it.d, it.t)
+	}
+}
+
+/* Must hold the write lock. */
+func (c *Cache[K, V]) unpersist(key K) {
+	if c.o.backend != nil {
+		c.o.backend.Delete(key)
+	}
+}
@@ -0,0 +1,52 @@
+package ttlcache
+
+import "sync/atomic"
+
+/* Counters since the cache was created. Deletions only count keys that were present. */
+type Stats struct {
+	Hits        uint64
+	Misses      uint64
+	Sets        uint64
+	Expirations uint64
+	Deletions   uint64
+	Evictions   uint64
+}
+
+type counters struct {
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	sets        atomic.Uint64
+	expirations atomic.Uint64
+	deletions   atomic.Uint64
+	evictions   atomic.Uint64
+}
+
+func (c *counters) lookup(ok bool) {
+	if ok {
+		c.hits.Add(1)
+	} else {
+		c.misses.Add(1)
+	}
+}
+
+func (c *counters) removed(reason DeallocationReason) {
+	switch reason {
+	case ReasonTimedOut:
+		c.expirations.Add(1)
+	case ReasonDeleted:
+		c.deletions.Add(1)
+	case ReasonEvicted:
+		c.evictions.Add(1)
+	}
+}
+
+func (c *counters) snapshot() Stats {
+	return Stats{
+		Hits:        c.hits.Load(),
+		Misses:      c.misses.Load(),
+		Sets:        c.sets.Load(),
+		Expirations: c.expirations.Load(),
+		Deletions:   c.deletions.Load(),
+		Evictions:   c.evictions.Load(),
+	}
+}
@@ -11,12 +11,26 @@ func New[K comparable, V any](options Options[K, V]) *Cache[K, V] {
 		o:  options,
 		ch: make(chan time.Time, 1000),
 		m:  make(map[K]Item[V]),
+
+		calls: make(map[K]*call[V]),
+		errs:  make(map[K]loadError),
+	}
+
+	if options.maxEntries > 0 {
+		c.h = evictionHeap[K]{policy: options.evictionPolicy}
+		c.n = make(map[K]*evictionNode[K])
 	}
 
+	var round time.Duration
 	if options.defaultTTL != NoTTL && options.defaultResolution == 0 {
-		c.tc = *timecache.New(timecache.Options{}.Round(options.defaultTTL / 2))
+		round = options.defaultTTL / 2
 	} else if options.defaultResolution != 0 {
-		c.tc = *timecache.New(timecache.Options{}.Round(options.defaultResolution))
+		round = options.defaultResolution
+	}
+
+	c.tc = *timecache.New(timecache.Options{}.Round(round).Clock(options.clock))
+	if options.backend != nil {
+		_ = c.restore() // the backend reports its own failures, whatever did not load is simply not cached.
 	}
 
 	go c.startExpirations()
@@ -79,6 +93,7 @@ func (c *Cache[K, V]) Set(key K, value V, duration time.Duration) bool {
 }
 
 func (c *Cache[K, V]) SetItem(key K, value V, duration time.Duration) Item[V] {
+	c.s.sets.Add(1)
 	return c.set(key, Item[V]{v: value, d: c.fixupDuration(duration)})
 }
 
@@ -90,8 +105,31 @@ func (c *Cache[K, V]) GetKeys() []K {
 	return c.getkeys()
 }
 
-func (c *Cache[K, V]) Close() {
+func (c *Cache[K, V]) Len() int {
+	return c.len()
+}
+
+/* Calls f for every entry until it returns false. f sees a snapshot, so it may use the cache freely. */
+func (c *Cache[K, V]) Range(f func(key K, it Item[V]) bool) {
+	for k, it := range c.snapshot() {
+		if !f(k, it) {
+			return
+		}
+	}
+}
+
+func (c *Cache[K, V]) Stats() Stats {
+	return c.s.snapshot()
+}
+
+/* Also closes the backend, flushing it. */
+func (c *Cache[K, V]) Close() error {
 	c.close()
+	if c.o.backend != nil {
+		return c.o.backend.Close()
+	}
+
+	return nil
 }
 
 func (i *Item[V]) GetDuration() time.Duration {
@@ -125,3 +163,52 @@ func (o Options[K, V]) DisableUpdateTime(val bool) Options[K, V] {
 	o.noUpdateTime = val
 	return o
 }
+
+/* Writes every change through to b, and fills the cache from it on New. */
+func (o Options[K, V]) SetBackend(b Backend[K, V]) Options[K, V] {
+	o.backend = b
+	return o
+}
+
+/* Bounds the cache to n entries, or n total cost with SetCostFunc. Zero leaves it unbounded. */
+func (o Options[K, V]) SetMaxEntries(n int64) Options[K, V] {
+	o.maxEntries = n
+	return o
+}
+
+func (o Options[K, V]) SetCostFunc(f CostFunc[K, V]) Options[K, V] {
+	o.costFunc = f
+	return o
+}
+
+/* Drives expirations and timers, tests pass a timecache.FakeClock. */
+func (o Options[K, V]) SetClock(c timecache.Clock) Options[K, V] {
+	o.clock = c
+	return o
+}
+
+func (o Options[K, V]) getClock() timecache.Clock {
+	if o.clock == nil {
+		return timecache.RealClock
+	}
+
+	return o.clock
+}
+
+/* How long GetOrLoad remembers a failed load, NoTTL (the default) retries every time. */
+func (o Options[K, V]) SetErrorTTL(d time.Duration) Options[K, V] {
+	o.errorTTL = d
+	return o
+}
+
+/* GetOrLoad hits expiring within d are reloaded in the background. */
+func (o Options[K, V]) SetRefreshAhead(d time.Duration) Options[K, V] {
+	o.refreshAhead = d
+	return o
+}
+
+/* Which entry makes room once the cache is full, EvictLRU by default. */
+func (o Options[K, V]) SetEvictionPolicy(p EvictionPolicy) Options[K, V] {
+	o.evictionPolicy = p
+	return o
+}
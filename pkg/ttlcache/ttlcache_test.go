@@ -1,10 +1,40 @@
 package ttlcache
 
 import (
+	"errors"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	"github.com/titlerr/upgraderr/pkg/timecache"
+	bolt "go.etcd.io/bbolt"
 )
 
+func newFake[K comparable, V any](o Options[K, V]) (*Cache[K, V], *timecache.FakeClock) {
+	clock := timecache.NewFakeClock(time.Unix(1700000000, 0))
+	return New[K, V](o.SetClock(clock)), clock
+}
+
+/* The expiration timer is armed by the cache's own goroutine, so the clock keeps moving until done reports the timer fired. */
+func advanceUntil[T any](t *testing.T, clock *timecache.FakeClock, d time.Duration, done <-chan T) T {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		clock.Advance(d)
+		select {
+		case v := <-done:
+			return v
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+
+	t.Fatalf("timer never fired")
+	panic("unreachable")
+}
+
 func TestGet(t *testing.T) {
 	t.Parallel()
 	c := New[int, bool](Options[int, bool]{}.SetDefaultTTL(1 * time.Second))
@@ -26,13 +56,13 @@ func TestGet(t *testing.T) {
 
 func TestExpirations(t *testing.T) {
 	t.Parallel()
-	c := New[int, bool](Options[int, bool]{}.SetDefaultTTL(200 * time.Millisecond))
+	c, clock := newFake(Options[int, bool]{}.SetDefaultTTL(200 * time.Millisecond))
 	defer c.Close()
 	for i := 0; i < 10; i++ {
 		c.Set(i, true, DefaultTTL)
 	}
 
-	time.Sleep(1 * time.Second)
+	clock.Advance(1 * time.Second)
 
 	for i := 0; i < 10; i++ {
 		if _, ok := c.Get(i); ok {
@@ -43,13 +73,13 @@ func TestExpirations(t *testing.T) {
 
 func TestSwaps(t *testing.T) {
 	t.Parallel()
-	c := New[int, bool](Options[int, bool]{}.SetDefaultTTL(200 * time.Millisecond))
+	c, clock := newFake(Options[int, bool]{}.SetDefaultTTL(200 * time.Millisecond))
 	defer c.Close()
 	for i := 0; i < 10; i++ {
 		c.Set(i, true, DefaultTTL)
 	}
 
-	time.Sleep(1 * time.Second)
+	clock.Advance(1 * time.Second)
 	for i := 0; i < 10; i++ {
 		if _, ok := c.Get(i); ok {
 			t.Fatalf("found key: %d", i)
@@ -66,13 +96,13 @@ func TestSwaps(t *testing.T) {
 
 func TestRetimer(t *testing.T) {
 	t.Parallel()
-	c := New[int, bool](Options[int, bool]{}.SetDefaultTTL(200 * time.Millisecond))
+	c, clock := newFake(Options[int, bool]{}.SetDefaultTTL(200 * time.Millisecond))
 	defer c.Close()
 	for i := 1; i < 10; i++ {
 		c.Set(i, true, time.Duration(10-i)*100*time.Millisecond)
 	}
 
-	time.Sleep(2 * time.Second)
+	clock.Advance(2 * time.Second)
 	for i := 1; i < 10; i++ {
 		if _, ok := c.Get(i); ok {
 			t.Fatalf("found key: %d", i)
@@ -82,13 +112,13 @@ func TestRetimer(t *testing.T) {
 
 func TestSchedule(t *testing.T) {
 	t.Parallel()
-	c := New[int, bool](Options[int, bool]{}.SetDefaultTTL(1 * time.Second))
+	c, clock := newFake(Options[int, bool]{}.SetDefaultTTL(1 * time.Second))
 	defer c.Close()
 	for i := 1; i < 10; i++ {
 		c.Set(i, true, time.Duration(i)*100*time.Millisecond)
 	}
 
-	time.Sleep(3 * time.Second)
+	clock.Advance(3 * time.Second)
 	for i := 1; i < 10; i++ {
 		if _, ok := c.Get(i); ok {
 			t.Fatalf("found key: %d", i)
@@ -98,7 +128,7 @@ func TestSchedule(t *testing.T) {
 
 func TestInterlace(t *testing.T) {
 	t.Parallel()
-	c := New[int, bool](Options[int, bool]{}.SetDefaultTTL(100 * time.Millisecond))
+	c, clock := newFake(Options[int, bool]{}.SetDefaultTTL(100 * time.Millisecond))
 	defer c.Close()
 	swap := false
 	for i := 0; i < 10; i++ {
@@ -110,7 +140,7 @@ func TestInterlace(t *testing.T) {
 		c.Set(i, true, ttl)
 	}
 
-	time.Sleep(1 * time.Second)
+	clock.Advance(1 * time.Second)
 	swap = false
 	for i := 0; i < 10; i++ {
 		swap = !swap
@@ -126,14 +156,14 @@ func TestInterlace(t *testing.T) {
 
 func TestReschedule(t *testing.T) {
 	t.Parallel()
-	c := New[int, bool](Options[int, bool]{}.SetDefaultTTL(100 * time.Millisecond))
+	c, clock := newFake(Options[int, bool]{}.SetDefaultTTL(100 * time.Millisecond))
 	defer c.Close()
 	for i := 1; i < 10; i++ {
 		c.Set(i, true, NoTTL)
 		c.Set(i, true, DefaultTTL)
 	}
 
-	time.Sleep(1 * time.Second)
+	clock.Advance(1 * time.Second)
 	for i := 1; i < 10; i++ {
 		if _, ok := c.Get(i); ok {
 			t.Fatalf("found key: %d", i)
@@ -143,14 +173,14 @@ func TestReschedule(t *testing.T) {
 
 func TestRescheduleNoTTL(t *testing.T) {
 	t.Parallel()
-	c := New[int, bool](Options[int, bool]{}.SetDefaultTTL(100 * time.Millisecond))
+	c, clock := newFake(Options[int, bool]{}.SetDefaultTTL(100 * time.Millisecond))
 	defer c.Close()
 	for i := 1; i < 10; i++ {
 		c.Set(i, true, DefaultTTL)
 		c.Set(i, true, NoTTL)
 	}
 
-	time.Sleep(1 * time.Second)
+	clock.Advance(1 * time.Second)
 	for i := 1; i < 10; i++ {
 		if _, ok := c.Get(i); !ok {
 			t.Fatalf("found key: %d", i)
@@ -176,21 +206,20 @@ func TestDelete(t *testing.T) {
 
 func TestDeallocationTimeout(t *testing.T) {
 	t.Parallel()
-	hit := false
+	ch := make(chan DeallocationReason, 1)
 	o := Options[int, bool]{}.
 		SetDefaultTTL(time.Millisecond * 100).
-		SetDeallocationFunc(func(key int, value bool, reason DeallocationReason) { hit = reason == ReasonTimedOut })
+		SetDeallocationFunc(func(key int, value bool, reason DeallocationReason) { ch <- reason })
 
-	c := New[int, bool](o)
+	c, clock := newFake(o)
 	defer c.Close()
 
 	for i := 0; i < 1; i++ {
 		c.Set(i, true, DefaultTTL)
 	}
 
-	time.Sleep(3 * time.Second)
-	if !hit {
-		t.Fatalf("Deallocation not hit.")
+	if reason := advanceUntil(t, clock, 3*time.Second, ch); reason != ReasonTimedOut {
+		t.Fatalf("Deallocation not hit: %d", reason)
 	}
 }
 
@@ -243,3 +272,418 @@ func TestTimerReset(t *testing.T) {
 		<-ch
 	}
 }
+
+func TestMaxEntriesLRU(t *testing.T) {
+	t.Parallel()
+	evicted := make([]int, 0)
+	c := New[int, bool](Options[int, bool]{}.
+		SetMaxEntries(3).
+		SetDeallocationFunc(func(key int, value bool, reason DeallocationReason) {
+			if reason == ReasonEvicted {
+				evicted = append(evicted, key)
+			}
+		}))
+
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		c.Set(i, true, NoTTL)
+	}
+
+	c.Get(0)
+	c.Set(3, true, NoTTL)
+	c.Set(4, true, NoTTL)
+
+	if len(evicted) != 2 || evicted[0] != 1 || evicted[1] != 2 {
+		t.Fatalf("evicted %v, want [1 2]", evicted)
+	}
+
+	for _, i := range []int{0, 3, 4} {
+		if _, ok := c.Get(i); !ok {
+			t.Fatalf("missing key: %d", i)
+		}
+	}
+}
+
+func TestMaxEntriesLFU(t *testing.T) {
+	t.Parallel()
+	c := New[int, bool](Options[int, bool]{}.
+		SetMaxEntries(3).
+		SetEvictionPolicy(EvictLFU))
+
+	defer c.Close()
+	for i := 0; i < 3; i++ {
+		c.Set(i, true, NoTTL)
+	}
+
+	for i := 0; i < 3; i++ {
+		c.Get(0)
+		c.Get(2)
+	}
+
+	c.Get(1)
+	c.Set(3, true, NoTTL)
+	if _, ok := c.Get(1); ok {
+		t.Fatalf("least frequently used key survived")
+	}
+
+	/* 3 is now the least used, but a fresh entry is never its own victim. */
+	c.Set(4, true, NoTTL)
+	for _, i := range []int{0, 2, 4} {
+		if _, ok := c.Get(i); !ok {
+			t.Fatalf("missing key: %d", i)
+		}
+	}
+
+	if _, ok := c.Get(3); ok {
+		t.Fatalf("found key: 3")
+	}
+}
+
+func TestMaxEntriesCost(t *testing.T) {
+	t.Parallel()
+	c := New[string, string](Options[string, string]{}.
+		SetMaxEntries(10).
+		SetCostFunc(func(key string, value string) int64 { return int64(len(value)) }))
+
+	defer c.Close()
+	c.Set("a", "aaaa", NoTTL)
+	c.Set("b", "bbbb", NoTTL)
+	c.Set("c", "cc", NoTTL)
+	if _, ok := c.Get("a"); !ok {
+		t.Fatalf("evicted below the bound")
+	}
+
+	c.Set("d", "ddd", NoTTL)
+	if _, ok := c.Get("b"); ok {
+		t.Fatalf("found key: b")
+	}
+
+	/* Shrinking a value frees its cost. */
+	c.Set("a", "a", NoTTL)
+	c.Set("e", "eee", NoTTL)
+	for _, k := range []string{"a", "c", "d", "e"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("missing key: %s", k)
+		}
+	}
+}
+
+func TestMaxEntriesDelete(t *testing.T) {
+	t.Parallel()
+	ch := make(chan DeallocationReason, 10)
+	c, clock := newFake(Options[int, bool]{}.
+		SetDefaultTTL(100 * time.Millisecond).
+		SetMaxEntries(2).
+		SetDeallocationFunc(func(key int, value bool, reason DeallocationReason) { ch <- reason }))
+
+	defer c.Close()
+	c.Set(0, true, NoTTL)
+	c.Set(1, true, DefaultTTL)
+	c.Delete(0)
+	if reason := <-ch; reason != ReasonDeleted {
+		t.Fatalf("delete reported as %d", reason)
+	}
+
+	if reason := advanceUntil(t, clock, 1*time.Second, ch); reason != ReasonTimedOut {
+		t.Fatalf("expiry reported as %d", reason)
+	}
+
+	c.Set(2, true, NoTTL)
+	c.Set(3, true, NoTTL)
+	if len(ch) != 0 {
+		t.Fatalf("evicted with room left after delete and expiry")
+	}
+
+	c.Set(4, true, NoTTL)
+	if len(ch) != 1 || <-ch != ReasonEvicted {
+		t.Fatalf("Eviction not hit.")
+	}
+}
+
+func TestGetOrLoadSingleflight(t *testing.T) {
+	t.Parallel()
+	c := New[int, int](Options[int, int]{}.SetDefaultTTL(time.Minute))
+	defer c.Close()
+
+	var loads atomic.Int32
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := c.GetOrLoad(1, func(key int) (int, time.Duration, error) {
+				loads.Add(1)
+				<-release
+				return key * 10, DefaultTTL, nil
+			})
+
+			if err != nil || v != 10 {
+				t.Errorf("got %d, %v", v, err)
+			}
+		}()
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if n := loads.Load(); n != 1 {
+		t.Fatalf("loaded %d times", n)
+	}
+
+	if v, ok := c.Get(1); !ok || v != 10 {
+		t.Fatalf("load not cached: %d %t", v, ok)
+	}
+}
+
+func TestGetOrLoadErrors(t *testing.T) {
+	t.Parallel()
+	boom := errors.New("boom")
+	loads := 0
+	fail := func(key int) (int, time.Duration, error) {
+		loads++
+		return 0, DefaultTTL, boom
+	}
+
+	c := New[int, int](Options[int, int]{}.SetDefaultTTL(time.Minute))
+	defer c.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetOrLoad(1, fail); err != boom {
+			t.Fatalf("got %v", err)
+		}
+	}
+
+	if loads != 2 {
+		t.Fatalf("errors cached without an error TTL: %d loads", loads)
+	}
+
+	loads = 0
+	ce, clock := newFake(Options[int, int]{}.SetDefaultTTL(time.Minute).SetTimerResolution(10 * time.Millisecond).SetErrorTTL(200 * time.Millisecond))
+	defer ce.Close()
+	for i := 0; i < 2; i++ {
+		if _, err := ce.GetOrLoad(1, fail); err != boom {
+			t.Fatalf("got %v", err)
+		}
+	}
+
+	if loads != 1 {
+		t.Fatalf("error not cached: %d loads", loads)
+	}
+
+	clock.Advance(500 * time.Millisecond)
+	v, err := ce.GetOrLoad(1, func(key int) (int, time.Duration, error) { return 5, DefaultTTL, nil })
+	if err != nil || v != 5 {
+		t.Fatalf("error outlived its TTL: %d %v", v, err)
+	}
+}
+
+func TestGetOrLoadRefreshAhead(t *testing.T) {
+	t.Parallel()
+	c, clock := newFake(Options[int, int]{}.
+		SetDefaultTTL(time.Second).
+		SetTimerResolution(10 * time.Millisecond).
+		SetRefreshAhead(800 * time.Millisecond).
+		DisableUpdateTime(true))
+
+	defer c.Close()
+
+	var loads atomic.Int32
+	loaded := make(chan struct{}, 4)
+	loader := func(key int) (int, time.Duration, error) {
+		defer func() { loaded <- struct{}{} }()
+		return int(loads.Add(1)), DefaultTTL, nil
+	}
+
+	if v, _ := c.GetOrLoad(1, loader); v != 1 {
+		t.Fatalf("got %d", v)
+	}
+
+	<-loaded
+	if v, _ := c.GetOrLoad(1, loader); v != 1 || loads.Load() != 1 {
+		t.Fatalf("refreshed a fresh entry: %d", v)
+	}
+
+	clock.Advance(400 * time.Millisecond)
+	if v, _ := c.GetOrLoad(1, loader); v != 1 {
+		t.Fatalf("refresh-ahead blocked the hit: %d", v)
+	}
+
+	/* The refresh stores its value after the loader returns. */
+	<-loaded
+	for v, _ := c.Get(1); v != 2; v, _ = c.Get(1) {
+		runtime.Gosched()
+	}
+
+	if v, _ := c.Reload(1, loader); v != 3 {
+		t.Fatalf("reload: %d", v)
+	}
+}
+
+func TestUpdateTime(t *testing.T) {
+	t.Parallel()
+	for _, disabled := range []bool{false, true} {
+		c, clock := newFake(Options[int, bool]{}.
+			SetDefaultTTL(10 * time.Second).
+			SetTimerResolution(time.Second).
+			DisableUpdateTime(disabled))
+
+		start := clock.Now()
+		c.Set(1, true, DefaultTTL)
+		clock.Advance(6 * time.Second)
+		if _, ok := c.Get(1); !ok {
+			t.Fatalf("expired early, disabled %t", disabled)
+		}
+
+		want := start.Add(16 * time.Second)
+		if disabled {
+			want = start.Add(10 * time.Second)
+		}
+
+		if it, _ := c.GetItem(1); !it.t.Equal(want) {
+			t.Fatalf("expires %s, want %s, disabled %t", it.t, want, disabled)
+		}
+
+		c.Close()
+	}
+}
+
+func TestResolution(t *testing.T) {
+	t.Parallel()
+	c, clock := newFake(Options[int, bool]{}.SetTimerResolution(time.Minute))
+	defer c.Close()
+
+	clock.Advance(40 * time.Second)
+	c.Set(1, true, 90*time.Second)
+	it, _ := c.GetItem(1)
+	if want := time.Unix(1700000000, 0).Round(time.Minute).Add(time.Minute + 90*time.Second); !it.t.Equal(want) {
+		t.Fatalf("expires %s, want %s", it.t, want)
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+	c, clock := newFake(Options[int, bool]{}.
+		SetDefaultTTL(100 * time.Millisecond).
+		SetMaxEntries(3))
+
+	defer c.Close()
+	for i := 0; i < 4; i++ {
+		c.Set(i, true, NoTTL)
+	}
+
+	c.Get(3)
+	c.Get(0)
+	c.Delete(3)
+	c.Delete(3)
+	c.Set(5, true, DefaultTTL)
+	clock.Advance(1 * time.Second)
+	c.expire()
+
+	want := Stats{Hits: 1, Misses: 1, Sets: 5, Expirations: 1, Deletions: 1, Evictions: 1}
+	if s := c.Stats(); s != want {
+		t.Fatalf("stats %+v, want %+v", s, want)
+	}
+
+	if n := c.Len(); n != 2 {
+		t.Fatalf("len %d", n)
+	}
+}
+
+func TestRangeAndKeys(t *testing.T) {
+	t.Parallel()
+	c := New[int, int](Options[int, int]{})
+	defer c.Close()
+	for i := 0; i < 10; i++ {
+		c.Set(i, i*2, NoTTL)
+	}
+
+	if keys := c.GetKeys(); len(keys) != 10 {
+		t.Fatalf("got %d keys", len(keys))
+	}
+
+	seen := 0
+	c.Range(func(key int, it Item[int]) bool {
+		if it.GetValue() != key*2 {
+			t.Fatalf("bad value on key: %d", key)
+		}
+
+		/* Ranging over a snapshot, writing back must not deadlock. */
+		c.Set(key+100, 0, NoTTL)
+		seen++
+		return true
+	})
+
+	if seen != 10 || c.Len() != 20 {
+		t.Fatalf("saw %d entries, len %d", seen, c.Len())
+	}
+
+	seen = 0
+	c.Range(func(key int, it Item[int]) bool {
+		seen++
+		return seen < 3
+	})
+
+	if seen != 3 {
+		t.Fatalf("range did not stop: %d", seen)
+	}
+}
+
+func TestBackend(t *testing.T) {
+	t.Parallel()
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "cache.db"), 0600, nil)
+	if err != nil {
+		t.Fatalf("open: %q", err)
+	}
+
+	defer db.Close()
+	open := func(now time.Time) *Cache[string, int] {
+		b := NewBoltBackend[string, int](db, "cache", StringCodec{}, JSONCodec[int]{}, BoltOptions{}.SetFlushInterval(time.Hour))
+		return New[string, int](Options[string, int]{}.
+			SetDefaultTTL(time.Minute).
+			SetTimerResolution(time.Second).
+			DisableUpdateTime(true).
+			SetClock(timecache.NewFakeClock(now)).
+			SetBackend(b))
+	}
+
+	start := time.Unix(1700000000, 0)
+	c := open(start)
+	c.Set("short", 1, 10*time.Second)
+	c.Set("long", 2, DefaultTTL)
+	c.Set("forever", 3, NoTTL)
+	c.Set("gone", 4, DefaultTTL)
+	c.Delete("gone")
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %q", err)
+	}
+
+	c = open(start.Add(30 * time.Second))
+	if _, ok := c.Get("short"); ok {
+		t.Fatalf("expired entry restored")
+	}
+
+	if _, ok := c.Get("gone"); ok {
+		t.Fatalf("deleted entry restored")
+	}
+
+	if it, ok := c.GetItem("long"); !ok || it.GetValue() != 2 || !it.GetTime().Equal(start.Add(time.Minute)) {
+		t.Fatalf("remaining ttl not kept: %t %+v", ok, it)
+	}
+
+	if it, ok := c.GetItem("forever"); !ok || it.GetValue() != 3 || !it.GetTime().IsZero() {
+		t.Fatalf("entry without ttl not kept: %t %+v", ok, it)
+	}
+
+	if err := c.Close(); err != nil {
+		t.Fatalf("close: %q", err)
+	}
+
+	db.View(func(tx *bolt.Tx) error {
+		if n := tx.Bucket([]byte("cache")).Stats().KeyN; n != 2 {
+			t.Fatalf("%d entries stored", n)
+		}
+
+		return nil
+	})
+}
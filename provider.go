@@ -0,0 +1,315 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autobrr/autobrr/pkg/sharedhttp"
+	"github.com/kylesanderson/go-jackett"
+	"github.com/titlerr/upgraderr/pkg/torznab"
+)
+
+type searchIndexer struct {
+	ID   string
+	Caps torznab.Caps
+}
+
+/* Anything able to enumerate Torznab indexers, search them and fetch their enclosures. */
+type searchProvider interface {
+	Indexers() ([]searchIndexer, error)
+	Search(id string, q torznab.Query) ([]torznab.Item, error)
+	Enclosure(id, enclosure string) ([]byte, error)
+}
+
+type torznabEndpoint struct {
+	URL    string
+	APIKey string
+}
+
+const providerTimeout = time.Second * 180
+
+/* Caps requests in flight at once while enumerating indexers. */
+const capsWorkers = 8
+
+func (req *torznabCrossSearch) getProvider() (searchProvider, error) {
+	switch Normalize(req.Provider) {
+	case "", "jackett":
+		if len(req.JackettHost) == 0 {
+			return nil, fmt.Errorf("missing jackett host")
+		}
+
+		return &jackettProvider{c: jackett.NewClient(jackett.Config{Host: req.JackettHost, APIKey: req.APIKey, Timeout: int(providerTimeout / time.Second)})}, nil
+	case "prowlarr":
+		if len(req.ProwlarrHost) == 0 {
+			return nil, fmt.Errorf("missing prowlarr host")
+		}
+
+		return &prowlarrProvider{host: strings.TrimSuffix(req.ProwlarrHost, "/"), apikey: req.APIKey}, nil
+	case "torznab":
+		if len(req.Torznab) == 0 {
+			return nil, fmt.Errorf("missing torznab endpoints")
+		}
+
+		p := &torznabProvider{clients: make(map[string]*torznab.Client, len(req.Torznab))}
+		for _, e := range req.Torznab {
+			p.clients[e.URL] = torznab.New(torznab.Config{URL: e.URL, APIKey: e.APIKey, Client: sharedhttp.Client})
+		}
+
+		return p, nil
+	}
+
+	return nil, fmt.Errorf("unknown provider %q", req.Provider)
+}
+
+func providerContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), providerTimeout)
+}
+
+type jackettProvider struct {
+	c *jackett.Client
+}
+
+func (p *jackettProvider) Indexers() ([]searchIndexer, error) {
+	indexers, err := p.c.GetIndexers()
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]searchIndexer, 0, len(indexers.Indexer))
+	for _, indexer := range indexers.Indexer {
+		var caps torznab.Caps
+		s := &indexer.Caps.Searching
+		caps.Searching.Search = torznab.SearchCap{Available: s.Search.Available, SupportedParams: s.Search.SupportedParams}
+		caps.Searching.TvSearch = torznab.SearchCap{Available: s.TvSearch.Available, SupportedParams: s.TvSearch.SupportedParams}
+		caps.Searching.MovieSearch = torznab.SearchCap{Available: s.MovieSearch.Available, SupportedParams: s.MovieSearch.SupportedParams}
+		caps.Searching.MusicSearch = torznab.SearchCap{Available: s.MusicSearch.Available, SupportedParams: s.MusicSearch.SupportedParams}
+		caps.Searching.AudioSearch = torznab.SearchCap{Available: s.AudioSearch.Available, SupportedParams: s.AudioSearch.SupportedParams}
+		caps.Searching.BookSearch = torznab.SearchCap{Available: s.BookSearch.Available, SupportedParams: s.BookSearch.SupportedParams}
+		for _, c := range indexer.Caps.Categories.Category {
+			caps.Categories.Category = append(caps.Categories.Category, torznab.Category{ID: c.ID, Name: c.Name})
+		}
+
+		res = append(res, searchIndexer{ID: indexer.ID, Caps: caps})
+	}
+
+	return res, nil
+}
+
+func (p *jackettProvider) Search(id string, q torznab.Query) ([]torznab.Item, error) {
+	m := make(map[string]string)
+	for k, v := range q.Values() {
+		m[k] = strings.Join(v, ",")
+	}
+
+	res, err := p.c.GetTorrents(id, m)
+	if err != nil {
+		return nil, err
+	}
+
+	items := make([]torznab.Item, 0, len(res.Channel.Item))
+	for _, ch := range res.Channel.Item {
+		it := torznab.Item{
+			Title:    ch.Title,
+			GUID:     ch.Guid,
+			Link:     ch.Link,
+			PubDate:  ch.PubDate,
+			Size:     ch.Size,
+			Category: ch.Category,
+		}
+
+		it.Enclosure.URL = ch.Enclosure.URL
+		it.Enclosure.Length = ch.Enclosure.Length
+		it.Enclosure.Type = ch.Enclosure.Type
+		for _, a := range ch.Attr {
+			it.Attr = append(it.Attr, torznab.Attr{Name: a.Name, Value: a.Value})
+		}
+
+		items = append(items, it)
+	}
+
+	return items, nil
+}
+
+func (p *jackettProvider) Enclosure(id, enclosure string) ([]byte, error) {
+	return p.c.GetEnclosure(enclosure)
+}
+
+/* Prowlarr exposes every indexer as its own Torznab endpoint under /{id}/api. */
+type prowlarrProvider struct {
+	host    string
+	apikey  string
+	clients map[string]*torznab.Client
+}
+
+func (p *prowlarrProvider) Indexers() ([]searchIndexer, error) {
+	ctx, cancel := providerContext()
+	defer cancel()
+
+	r, err := http.NewRequestWithContext(ctx, http.MethodGet, p.host+"/api/v1/indexer", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	r.Header.Set("X-Api-Key", p.apikey)
+	res, err := sharedhttp.Client.Do(r)
+	if err != nil {
+		return nil, err
+	}
+
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("bad code from prowlarr: %d", res.StatusCode)
+	}
+
+	var list []struct {
+		ID       int
+		Name     string
+		Enable   bool
+		Protocol string
+	}
+
+	if err := json.NewDecoder(res.Body).Decode(&list); err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(list))
+	names := make(map[string]string, len(list))
+	clients := make(map[string]*torznab.Client, len(list))
+	for _, i := range list {
+		if !i.Enable || i.Protocol != "torrent" {
+			continue
+		}
+
+		id := fmt.Sprintf("%d", i.ID)
+		ids = append(ids, id)
+		names[id] = i.Name
+		clients[id] = torznab.New(torznab.Config{URL: p.host + "/" + id + "/api", APIKey: p.apikey, Client: sharedhttp.Client})
+	}
+
+	indexers := fetchCaps(ids, clients, names)
+	p.clients = make(map[string]*torznab.Client, len(indexers))
+	for _, i := range indexers {
+		p.clients[i.ID] = clients[i.ID]
+	}
+
+	return indexers, nil
+}
+
+func (p *prowlarrProvider) Search(id string, q torznab.Query) ([]torznab.Item, error) {
+	return searchClient(p.clients[id], id, q)
+}
+
+func (p *prowlarrProvider) Enclosure(id, enclosure string) ([]byte, error) {
+	return downloadClient(p.clients[id], id, enclosure)
+}
+
+/* Individual Torznab endpoints, identified by their URL. */
+type torznabProvider struct {
+	clients map[string]*torznab.Client
+}
+
+func (p *torznabProvider) Indexers() ([]searchIndexer, error) {
+	return fetchCaps(slices.Sorted(maps.Keys(p.clients)), p.clients, nil), nil
+}
+
+func (p *torznabProvider) Search(id string, q torznab.Query) ([]torznab.Item, error) {
+	return searchClient(p.clients[id], id, q)
+}
+
+func (p *torznabProvider) Enclosure(id, enclosure string) ([]byte, error) {
+	return downloadClient(p.clients[id], id, enclosure)
+}
+
+/*
+Fetches the caps of every indexer in ids, capsWorkers at a time and each under its own timeout, so one slow
+indexer can't use up the time of the others. Indexers without caps are left out, the rest keep the order of ids.
+*/
+func fetchCaps(ids []string, clients map[string]*torznab.Client, names map[string]string) []searchIndexer {
+	var wg sync.WaitGroup
+	results := make([]*searchIndexer, len(ids))
+	jobs := make(chan int)
+	for i := 0; i < min(capsWorkers, len(ids)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := range jobs {
+				ctx, cancel := providerContext()
+				caps, err := clients[ids[n]].Caps(ctx)
+				cancel()
+				if err != nil {
+					name := names[ids[n]]
+					if len(name) == 0 {
+						name = ids[n]
+					}
+
+					slog.Warn("Unable to get caps", "indexer", name, "error", err)
+					continue
+				}
+
+				results[n] = &searchIndexer{ID: ids[n], Caps: caps}
+			}
+		}()
+	}
+
+	for n := range ids {
+		jobs <- n
+	}
+
+	close(jobs)
+	wg.Wait()
+
+	indexers := make([]searchIndexer, 0, len(ids))
+	for _, i := range results {
+		if i != nil {
+			indexers = append(indexers, *i)
+		}
+	}
+
+	return indexers
+}
+
+func searchClient(c *torznab.Client, id string, q torznab.Query) ([]torznab.Item, error) {
+	if c == nil {
+		return nil, fmt.Errorf("unknown indexer %q", id)
+	}
+
+	ctx, cancel := providerContext()
+	defer cancel()
+	return c.Search(ctx, q)
+}
+
+func downloadClient(c *torznab.Client, id, enclosure string) ([]byte, error) {
+	if c == nil {
+		return nil, fmt.Errorf("unknown indexer %q", id)
+	}
+
+	ctx, cancel := providerContext()
+	defer cancel()
+	return c.Download(ctx, enclosure)
+}
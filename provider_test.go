@@ -0,0 +1,75 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const providerCaps = `<caps><searching><search available="yes" supportedParams="q" /></searching></caps>`
+
+func TestProwlarrIndexers(t *testing.T) {
+	/* Every caps request waits for all three to be in flight, fetching them one by one would stall each for a second. */
+	var m sync.Mutex
+	arrived := 0
+	all := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Api-Key") != "key" && r.URL.Query().Get("apikey") != "key" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+
+		if r.URL.Path == "/api/v1/indexer" {
+			json.NewEncoder(w).Encode([]map[string]any{
+				{"id": 1, "name": "one", "enable": true, "protocol": "torrent"},
+				{"id": 2, "name": "usenet", "enable": true, "protocol": "usenet"},
+				{"id": 3, "name": "disabled", "enable": false, "protocol": "torrent"},
+				{"id": 4, "name": "broken", "enable": true, "protocol": "torrent"},
+				{"id": 5, "name": "five", "enable": true, "protocol": "torrent"},
+			})
+			return
+		}
+
+		m.Lock()
+		if arrived++; arrived == 3 {
+			close(all)
+		}
+		m.Unlock()
+
+		select {
+		case <-all:
+		case <-time.After(time.Second):
+		}
+
+		if strings.HasPrefix(r.URL.Path, "/4/") {
+			http.Error(w, "down", http.StatusBadGateway)
+			return
+		}
+
+		w.Write([]byte(providerCaps))
+	}))
+	t.Cleanup(srv.Close)
+
+	p := &prowlarrProvider{host: srv.URL, apikey: "key"}
+	start := time.Now()
+	indexers, err := p.Indexers()
+	if err != nil {
+		t.Fatalf("indexers: %q", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second/2 {
+		t.Fatalf("caps fetched one at a time, took %v", elapsed)
+	}
+
+	if len(indexers) != 2 || indexers[0].ID != "1" || indexers[1].ID != "5" || !indexers[1].Caps.Searching.Search.Supports("q") {
+		t.Fatalf("got %+v", indexers)
+	}
+
+	if len(p.clients) != 2 || p.clients["1"] == nil || p.clients["5"] == nil {
+		t.Fatalf("clients %v", p.clients)
+	}
+}
@@ -0,0 +1,477 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/autobrr/go-qbittorrent"
+	bolt "go.etcd.io/bbolt"
+)
+
+/*
+Everything needed to put a torrent back the way it was. Moved is false for torrents sharing
+their data with others, those stay in place and are purged without their data. Moved torrents
+get a folder of their own under the quarantine path, entries without a Location predate that.
+*/
+type quarantineEntry struct {
+	Hash        string
+	Host        string
+	Name        string
+	Size        int64
+	SavePath    string
+	Category    string
+	Tags        string
+	AutoTMM     bool
+	Paused      bool
+	Moved       bool
+	Location    string `json:",omitempty"`
+	Quarantined time.Time
+	Torrent     []byte `json:",omitempty"`
+	auditTrigger
+}
+
+func (e quarantineEntry) location() string {
+	if len(e.Location) != 0 {
+		return e.Location
+	}
+
+	return config.Quarantine.Path
+}
+
+func (e quarantineEntry) expired(now time.Time) bool {
+	return now.Sub(e.Quarantined) >= time.Duration(config.Quarantine.Grace)
+}
+
+func isPaused(t qbittorrent.Torrent) bool {
+	switch t.State {
+	case qbittorrent.TorrentStatePausedDl, qbittorrent.TorrentStatePausedUp,
+		qbittorrent.TorrentStateStoppedDl, qbittorrent.TorrentStateStoppedUp:
+		return true
+	}
+
+	return false
+}
+
+/* Entries live under quarantine/<host>/<hash>. */
+func putQuarantine(entries []quarantineEntry) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		for _, e := range entries {
+			buf, err := json.Marshal(e)
+			if err != nil {
+				return err
+			}
+
+			if err := putPath(tx, []string{"quarantine", e.Host}, []byte(e.Hash), buf); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func getQuarantine(host, hash string) (*quarantineEntry, error) {
+	var e *quarantineEntry
+	err := db.View(func(tx *bolt.Tx) error {
+		pb := tx.Bucket([]byte("quarantine"))
+		if pb == nil {
+			return nil
+		}
+
+		b := pb.Bucket([]byte(host))
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(hash))
+		if v == nil {
+			return nil
+		}
+
+		e = &quarantineEntry{}
+		return json.Unmarshal(v, e)
+	})
+
+	return e, err
+}
+
+/* Every entry of a host, or of every host when empty. */
+func listQuarantine(host string) ([]quarantineEntry, error) {
+	res := make([]quarantineEntry, 0)
+	err := db.View(func(tx *bolt.Tx) error {
+		pb := tx.Bucket([]byte("quarantine"))
+		if pb == nil {
+			return nil
+		}
+
+		return pb.ForEachBucket(func(k []byte) error {
+			if len(host) != 0 && string(k) != host {
+				return nil
+			}
+
+			return pb.Bucket(k).ForEach(func(_, v []byte) error {
+				var e quarantineEntry
+				if err := json.Unmarshal(v, &e); err != nil {
+					return err
+				}
+
+				res = append(res, e)
+				return nil
+			})
+		})
+	})
+
+	return res, err
+}
+
+func deleteQuarantine(host string, hashes []string) error {
+	return db.Update(func(tx *bolt.Tx) error {
+		pb := tx.Bucket([]byte("quarantine"))
+		if pb == nil {
+			return nil
+		}
+
+		b := pb.Bucket([]byte(host))
+		if b == nil {
+			return nil
+		}
+
+		for _, h := range hashes {
+			if err := b.Delete([]byte(h)); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+/*
+Stands in for deletedata: the .torrent and original placement are saved before anything is touched,
+then the torrents are paused, moved under the quarantine path and marked. Torrents sharing data
+with anything staying behind are only paused and tagged, moving them would break the survivors.
+*/
+func (c *upgradereq) quarantineTorrents(mp *timeentry, hashes []string) error {
+	if db == nil {
+		return fmt.Errorf("quarantine needs a database")
+	}
+
+	/* Quarantined torrents are still in the client and keep matching, they must keep their first entry. */
+	existing, err := listQuarantine(c.Host)
+	if err != nil {
+		return err
+	}
+
+	skip := make(map[string]struct{}, len(existing))
+	for _, e := range existing {
+		skip[e.Hash] = struct{}{}
+	}
+
+	want := make(map[string]struct{}, len(hashes))
+	fresh := make([]string, 0, len(hashes))
+	for _, h := range hashes {
+		if _, ok := skip[h]; !ok {
+			want[h] = struct{}{}
+			fresh = append(fresh, h)
+		}
+	}
+
+	if hashes = fresh; len(hashes) == 0 {
+		return nil
+	}
+
+	withData, _ := splitSharedData(mp, want)
+	moved := make(map[string]struct{}, len(withData))
+	for _, h := range withData {
+		moved[h] = struct{}{}
+	}
+
+	nt := globalTime.Now().UTC()
+	entries := make([]quarantineEntry, 0, len(hashes))
+	for _, h := range hashes {
+		t, ok := mp.torrent(h)
+		if !ok {
+			return fmt.Errorf("unable to find %q to quarantine", h)
+		}
+
+		buf, err := c.exportTorrent(t.Hash)
+		if err != nil {
+			return fmt.Errorf("unable to export %q: %w", t.Name, err)
+		}
+
+		location := ""
+		if _, ok = moved[t.Hash]; ok {
+			location = path.Join(config.Quarantine.Path, t.Hash)
+		}
+
+		entries = append(entries, quarantineEntry{
+			Hash:         t.Hash,
+			Host:         c.Host,
+			Name:         t.Name,
+			Size:         t.Size,
+			SavePath:     t.SavePath,
+			Category:     t.Category,
+			Tags:         t.Tags,
+			AutoTMM:      t.AutoManaged,
+			Paused:       isPaused(t),
+			Moved:        ok,
+			Location:     location,
+			Quarantined:  nt,
+			Torrent:      buf,
+			auditTrigger: c.trigger,
+		})
+	}
+
+	if err := putQuarantine(entries); err != nil {
+		return fmt.Errorf("unable to save quarantine: %w", err)
+	}
+
+	if err := c.pauseTorrents(hashes); err != nil {
+		return err
+	}
+
+	/* setLocation turns automatic management off, so the category set afterwards leaves the data alone. */
+	if len(withData) != 0 {
+		for _, e := range entries {
+			if !e.Moved {
+				continue
+			}
+
+			if err := c.setLocation([]string{e.Hash}, e.Location); err != nil {
+				return err
+			}
+		}
+
+		cats, err := c.getCategories()
+		if err != nil {
+			return err
+		}
+
+		if _, ok := cats[config.Quarantine.Category]; !ok {
+			if err := c.createCategory(config.Quarantine.Category, ""); err != nil {
+				return err
+			}
+		}
+
+		if err := c.setCategory(withData, config.Quarantine.Category); err != nil {
+			return err
+		}
+	}
+
+	return c.addTags(hashes, config.Quarantine.Tag)
+}
+
+/* Deletes every torrent of the host whose grace period has passed, returning how many were purged. */
+func (c *upgradereq) purgeQuarantine() (int, error) {
+	entries, err := listQuarantine(c.Host)
+	if err != nil {
+		return 0, err
+	}
+
+	nt := globalTime.Now()
+	withData, withoutData := make([]string, 0), make([]string, 0)
+	for _, e := range entries {
+		if !e.expired(nt) {
+			continue
+		} else if e.Moved {
+			withData = append(withData, e.Hash)
+		} else {
+			withoutData = append(withoutData, e.Hash)
+		}
+	}
+
+	if len(withData)+len(withoutData) == 0 {
+		return 0, nil
+	}
+
+	if len(withData) != 0 {
+		if err := c.deleteTorrents(withData, true); err != nil {
+			return 0, err
+		}
+	}
+
+	if len(withoutData) != 0 {
+		if err := c.deleteTorrents(withoutData, false); err != nil {
+			return 0, err
+		}
+	}
+
+	purged := append(withData, withoutData...)
+	if err := deleteQuarantine(c.Host, purged); err != nil {
+		return 0, err
+	}
+
+	torrentActions.Add(float64(len(purged)), "quarantine", "purge")
+	return len(purged), nil
+}
+
+/* Puts a torrent back at its original save path and category, re-adding it from the saved .torrent if it left the client. */
+func (c *upgradereq) restoreQuarantine(e *quarantineEntry) error {
+	c.Hash = e.Hash
+	torrents, err := c.getTorrents(qbittorrent.TorrentFilterOptions{Hashes: []string{e.Hash}})
+	if err != nil {
+		return err
+	}
+
+	if len(torrents) == 0 {
+		location := e.SavePath
+		if e.Moved {
+			location = e.location()
+		}
+
+		c.Torrent = e.Torrent
+		if err := c.submitTorrent(&qbittorrent.TorrentAddOptions{
+			Paused:   true,
+			SavePath: location,
+			Category: e.Category,
+			Tags:     e.Tags,
+		}); err != nil {
+			return err
+		}
+	} else if err := c.removeTags([]string{e.Hash}, config.Quarantine.Tag); err != nil {
+		return err
+	}
+
+	if e.Moved {
+		if err := c.setLocationTorrent(e.SavePath); err != nil {
+			return err
+		}
+	}
+
+	if err := c.setCategory([]string{e.Hash}, e.Category); err != nil {
+		return err
+	}
+
+	if e.AutoTMM {
+		if err := c.setTorrentManagement(true); err != nil {
+			return err
+		}
+	}
+
+	if len(torrents) == 0 {
+		if err := c.recheckTorrent(); err != nil {
+			return err
+		}
+	}
+
+	if !e.Paused {
+		if err := c.resumeTorrent(); err != nil {
+			return err
+		}
+	}
+
+	return deleteQuarantine(e.Host, []string{e.Hash})
+}
+
+func handleQuarantine(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	entries, err := listQuarantine(r.URL.Query().Get("host"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read quarantine: %q\n", err), 467)
+		return
+	}
+
+	for i := range entries {
+		entries[i].Torrent = nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(entries); err != nil {
+		http.Error(w, err.Error(), 466)
+	}
+}
+
+func handleQuarantineRestore(w http.ResponseWriter, r *http.Request) {
+	var req upgradereq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 470)
+		return
+	}
+
+	req.bind(r)
+
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	if len(req.Hash) == 0 {
+		http.Error(w, fmt.Sprintf("No hash passed.\n"), 469)
+		return
+	}
+
+	e, err := getQuarantine(req.Host, req.Hash)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read quarantine: %q\n", err), 467)
+		return
+	} else if e == nil {
+		http.Error(w, fmt.Sprintf("Not quarantined: %q\n", req.Hash), 404)
+		return
+	}
+
+	if err := getClient(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get client: %q\n", err), 471)
+		return
+	}
+
+	if err := req.restoreQuarantine(e); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to restore %q: %q\n", e.Name, err), 420)
+		return
+	}
+
+	torrentActions.Inc("quarantine", "restore")
+	http.Error(w, fmt.Sprintf("Restored %q to %q\n", e.Name, e.SavePath), 200)
+}
+
+func handleQuarantinePurge(w http.ResponseWriter, r *http.Request) {
+	var req upgradereq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 470)
+		return
+	}
+
+	req.bind(r)
+
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	if err := getClient(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get client: %q\n", err), 471)
+		return
+	}
+
+	n, err := req.purgeQuarantine()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to purge quarantine: %q\n", err), 420)
+		return
+	}
+
+	http.Error(w, fmt.Sprintf("Purged %d torrents.\n", n), 200)
+}
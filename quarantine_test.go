@@ -0,0 +1,179 @@
+package main
+
+import (
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/autobrr/go-qbittorrent"
+)
+
+func TestQuarantineEntries(t *testing.T) {
+	saved := db
+	t.Cleanup(func() { db = saved })
+
+	db = openFixture(t, nil)
+	if _, err := migrateDatabase(db); err != nil {
+		t.Fatalf("migrate: %q", err)
+	}
+
+	nt := time.Now()
+	grace := time.Duration(config.Quarantine.Grace)
+	if err := putQuarantine([]quarantineEntry{
+		{Hash: "aaaa", Host: "http://one", SavePath: "/data/tv", Category: "tv", Moved: true, Quarantined: nt.Add(-grace - time.Minute), Torrent: []byte("d4:infod4:name1:aee")},
+		{Hash: "bbbb", Host: "http://one", Quarantined: nt},
+		{Hash: "cccc", Host: "http://two", Quarantined: nt},
+	}); err != nil {
+		t.Fatalf("put: %q", err)
+	}
+
+	if all, err := listQuarantine(""); err != nil || len(all) != 3 {
+		t.Fatalf("listed %d entries: %v", len(all), err)
+	}
+
+	one, err := listQuarantine("http://one")
+	if err != nil || len(one) != 2 {
+		t.Fatalf("listed %d entries for one: %v", len(one), err)
+	}
+
+	if !one[0].expired(nt) || one[1].expired(nt) {
+		t.Fatalf("expiry: %t %t", one[0].expired(nt), one[1].expired(nt))
+	}
+
+	e, err := getQuarantine("http://one", "aaaa")
+	if err != nil || e == nil {
+		t.Fatalf("get: %v", err)
+	}
+
+	if e.SavePath != "/data/tv" || e.Category != "tv" || !e.Moved || string(e.Torrent) != "d4:infod4:name1:aee" {
+		t.Fatalf("entry not kept: %+v", e)
+	}
+
+	if e, err := getQuarantine("http://two", "aaaa"); err != nil || e != nil {
+		t.Fatalf("entry leaked across hosts: %+v %v", e, err)
+	}
+
+	if err := deleteQuarantine("http://one", []string{"aaaa"}); err != nil {
+		t.Fatalf("delete: %q", err)
+	}
+
+	if e, _ := getQuarantine("http://one", "aaaa"); e != nil {
+		t.Fatalf("entry not deleted")
+	}
+}
+
+func TestQuarantineConfig(t *testing.T) {
+	c := defaultConfig()
+	c.Quarantine.Enabled = true
+	if err := c.compile(); err == nil {
+		t.Fatalf("quarantine without a path accepted")
+	}
+
+	c.Quarantine.Path = "/data/quarantine"
+	if err := c.compile(); err != nil {
+		t.Fatalf("compile: %q", err)
+	}
+}
+
+func quarantineClient(t *testing.T) (*fakeClient, upgradereq) {
+	t.Helper()
+	saved, savedConfig := db, config
+	t.Cleanup(func() { db, config = saved, savedConfig })
+
+	db = openFixture(t, nil)
+	if _, err := migrateDatabase(db); err != nil {
+		t.Fatalf("migrate: %q", err)
+	}
+
+	config = defaultConfig()
+	config.Quarantine.Enabled, config.Quarantine.Path = true, "/data/quarantine"
+	f := &fakeClient{live: map[string]qbittorrent.Torrent{
+		/* a shares its data with b, which stays. c and d are unrelated but lay out the same files. */
+		"a": {Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", SavePath: "/data/tv", ContentPath: "/data/tv/Show.Name.S01E01.1080p.WEB.h264-GRP"},
+		"b": {Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", SavePath: "/data/tv", ContentPath: "/data/tv/Show.Name.S01E01.1080p.WEB.h264-GRP"},
+		"c": {Name: "Movie.Name.2020.1080p.BluRay.x264-GRP", SavePath: "/data/one", ContentPath: "/data/one/Movie.Name.2020.1080p.BluRay.x264-GRP", Category: "movies"},
+		"d": {Name: "Movie.Name.2020.1080p.BluRay.x264-GRP", SavePath: "/data/two", ContentPath: "/data/two/Movie.Name.2020.1080p.BluRay.x264-GRP", State: qbittorrent.TorrentStateStoppedUp},
+	}}
+
+	return f, newFakeClient(t, f)
+}
+
+func (f *fakeClient) called(path string, form url.Values) bool {
+	f.m.Lock()
+	defer f.m.Unlock()
+	return slices.Contains(f.calls, path+" "+form.Encode())
+}
+
+func TestQuarantineTorrents(t *testing.T) {
+	clock := fakeTime(t, time.Unix(1700000000, 0))
+	f, req := quarantineClient(t)
+	mp, err := req.getAllTorrents()
+	if err != nil {
+		t.Fatalf("snapshot: %q", err)
+	}
+
+	if err := req.quarantineTorrents(mp, []string{"a", "c", "d"}); err != nil {
+		t.Fatalf("quarantine: %q", err)
+	}
+
+	for _, h := range []string{"c", "d"} {
+		if !f.called("torrents/setLocation", url.Values{"hashes": {h}, "location": {"/data/quarantine/" + h}}) {
+			t.Fatalf("%s not moved into a folder of its own: %q", h, f.calls)
+		}
+
+		if e, _ := getQuarantine(req.Host, h); e == nil || !e.Moved || e.Location != "/data/quarantine/"+h {
+			t.Fatalf("%s entry: %+v", h, e)
+		}
+	}
+
+	if e, _ := getQuarantine(req.Host, "a"); e == nil || e.Moved || len(e.Location) != 0 {
+		t.Fatalf("shared torrent moved: %+v", e)
+	}
+
+	calls := len(f.calls)
+	if err := req.quarantineTorrents(mp, []string{"a", "c", "d"}); err != nil || len(f.calls) != calls {
+		t.Fatalf("quarantined twice: %v %q", err, f.calls[calls:])
+	}
+
+	/* d left the client, it comes back from its .torrent in its own folder and is moved home. */
+	f.m.Lock()
+	delete(f.live, "d")
+	f.m.Unlock()
+	e, _ := getQuarantine(req.Host, "d")
+	if err := req.restoreQuarantine(e); err != nil {
+		t.Fatalf("restore: %q", err)
+	}
+
+	if !f.called("torrents/setLocation", url.Values{"hashes": {"d"}, "location": {"/data/two"}}) || !slices.ContainsFunc(f.calls, func(c string) bool {
+		return strings.HasPrefix(c, "torrents/add ") && strings.Contains(c, "savepath="+url.QueryEscape("/data/quarantine/d"))
+	}) {
+		t.Fatalf("restore calls: %q", f.calls[calls:])
+	}
+
+	if slices.ContainsFunc(f.calls[calls:], func(c string) bool { return strings.HasPrefix(c, "torrents/start ") }) {
+		t.Fatalf("paused torrent resumed")
+	}
+
+	if e, _ := getQuarantine(req.Host, "d"); e != nil {
+		t.Fatalf("restored entry kept")
+	}
+
+	if n, err := req.purgeQuarantine(); err != nil || n != 0 {
+		t.Fatalf("purged %d within grace: %v", n, err)
+	}
+
+	clock.Advance(time.Duration(config.Quarantine.Grace))
+	if n, err := req.purgeQuarantine(); err != nil || n != 2 {
+		t.Fatalf("purged %d: %v", n, err)
+	}
+
+	if !f.called("torrents/delete", url.Values{"hashes": {"c"}, "deleteFiles": {"true"}}) || !f.called("torrents/delete", url.Values{"hashes": {"a"}, "deleteFiles": {"false"}}) {
+		t.Fatalf("purge calls: %q", f.calls)
+	}
+
+	if entries, _ := listQuarantine(req.Host); len(entries) != 0 {
+		t.Fatalf("purged entries kept: %+v", entries)
+	}
+}
@@ -0,0 +1,337 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/autobrr/autobrr/pkg/sharedhttp"
+	"github.com/moistari/rls"
+	"github.com/titlerr/upgraderr/pkg/torznab"
+	bolt "go.etcd.io/bbolt"
+)
+
+/* Seen guids are forgotten once they drop out of the feed and are older than this. */
+const rssSeenRetention = time.Hour * 24
+
+func startRSS() {
+	if db == nil || len(config.RSS.Feeds) == 0 {
+		return
+	}
+
+	if len(config.RSS.Host) == 0 {
+		slog.Warn("RSS feeds configured without a qBittorrent host, not polling")
+		return
+	}
+
+	for _, f := range config.RSS.Feeds {
+		go pollRSS(f)
+	}
+}
+
+func pollRSS(f rssFeed) {
+	t := time.NewTicker(f.interval())
+	defer t.Stop()
+	for {
+		if err := f.poll(); err != nil {
+			slog.Error("RSS poll failed", "indexer", f.indexer(), "error", err)
+		}
+
+		<-t.C
+	}
+}
+
+func (f rssFeed) interval() time.Duration {
+	interval := time.Duration(f.Interval)
+	if interval <= 0 {
+		interval = time.Duration(config.RSS.Interval)
+	}
+
+	return max(interval, time.Minute)
+}
+
+func (f rssFeed) indexer() string {
+	if len(f.Indexer) != 0 {
+		return f.Indexer
+	}
+
+	return f.URL
+}
+
+func (f rssFeed) poll() error {
+	id := f.indexer()
+	if h := getIndexerHealth(id); h.coolingDown(globalTime.Now()) {
+		return fmt.Errorf("cooling down until %s", h.CooldownUntil.Format(time.RFC3339))
+	}
+
+	c := torznab.New(torznab.Config{URL: f.URL, APIKey: f.APIKey, Client: sharedhttp.Client})
+	getIndexerLimiter(id, config.Search.indexer(id)).Wait(context.Background())
+
+	nt := globalTime.Now().Unix()
+	ctx, cancel := providerContext()
+	defer cancel()
+
+	var items []torznab.Item
+	var err error
+	if f.Torznab {
+		items, err = c.Search(ctx, torznab.Query{})
+	} else {
+		var body []byte
+		if body, err = c.Download(ctx, f.URL); err == nil {
+			items, err = torznab.ParseFeed(bytes.NewReader(body))
+		}
+	}
+
+	countIndexerRequest(id, "rss", err)
+	recordIndexerResult(id, err)
+	if err != nil {
+		return err
+	}
+
+	req := upgradereq{
+		Host:     config.RSS.Host,
+		User:     config.RSS.User,
+		Password: config.RSS.Password,
+		trigger:  auditTrigger{Endpoint: "rss", Rule: id},
+	}
+
+	if err := getClient(&req); err != nil {
+		return err
+	}
+
+	mp, err := req.getAllTorrents()
+	if err != nil {
+		return err
+	}
+
+	fresh, err := f.unseen(items, nt)
+	if err != nil {
+		return err
+	}
+
+	if len(fresh) == 0 {
+		return nil
+	}
+
+	log := slog.Default().With("indexer", id)
+	present := presentHashes(mp)
+	for _, it := range fresh {
+		settled := f.inject(c, &req, mp, present, it, log)
+		if err := f.record(rssGUID(it), settled, nt); err != nil {
+			log.Error("Failed to record item", "title", it.Title, "error", err)
+		}
+	}
+
+	return nil
+}
+
+/* Reports whether the item is done with, injected or of no use. Failures that may pass on a later poll are not. */
+func (f rssFeed) inject(c *torznab.Client, req *upgradereq, mp *timeentry, present map[string]struct{}, it torznab.Item, log *slog.Logger) bool {
+	if match, pending := rssMatch(mp, it.Title); pending {
+		return false
+	} else if !match {
+		return true
+	}
+
+	if len(it.Enclosure.URL) == 0 {
+		log.Warn("No enclosure", "title", it.Title)
+		return true
+	}
+
+	ctx, cancel := providerContext()
+	torrent, err := c.Download(ctx, it.Enclosure.URL)
+	cancel()
+	countIndexerRequest(f.indexer(), "enclosure", err)
+	if err != nil {
+		log.Error("Error snatching", "title", it.Title, "error", err)
+		return false
+	}
+
+	hash, name, err := torrentMetadata(torrent)
+	if err != nil {
+		log.Error("Invalid torrent", "title", it.Title, "error", err)
+		return false
+	}
+
+	if _, ok := present[hash]; ok {
+		return true
+	}
+
+	if len(name) == 0 {
+		name = it.Title
+	}
+
+	sub := upgradereq{
+		Name:     name,
+		Host:     req.Host,
+		User:     req.User,
+		Password: req.Password,
+		Hash:     hash,
+		Torrent:  torrent,
+		Client:   req.Client,
+		log:      log,
+		trigger:  req.trigger,
+	}
+
+	code, msg := sub.crossTorrent(mp)
+	if code != 200 {
+		sub.logger().Warn("Injection failed", "code", code, "message", strings.TrimSpace(msg))
+		return false
+	}
+
+	present[hash] = struct{}{}
+	sub.logger().Info("Injected")
+	return true
+}
+
+/* A completed torrent of the same release must already be in the client, pending while one is still downloading. */
+func rssMatch(mp *timeentry, title string) (match, pending bool) {
+	ent, ok := mp.e[CacheFormatted(title)]
+	if !ok {
+		return false, false
+	}
+
+	r := CacheTitle(title)
+	for _, e := range ent {
+		if rls.Compare(*r, *CacheTitle(e.Name)) != 0 {
+			continue
+		} else if e.Progress == 1.0 {
+			return true, false
+		}
+
+		pending = true
+	}
+
+	return false, pending
+}
+
+func rssGUID(it torznab.Item) string {
+	if len(it.GUID) != 0 {
+		return it.GUID
+	}
+
+	return it.Enclosure.URL
+}
+
+/*
+Settled guids are stored as the stamp they settled at, failed ones as the stamp of the poll that failed and the count of failures.
+Those are retried on the next poll, then after 2, 4 and more polls, up to a day.
+*/
+func (f rssFeed) retryDue(v []byte, nt int64) bool {
+	if len(v) != 16 {
+		return false
+	}
+
+	wait := f.interval()
+	for i := uint64(1); i < binary.LittleEndian.Uint64(v[8:]) && wait < rssSeenRetention; i++ {
+		wait *= 2
+	}
+
+	/* Polls drift a little, half an interval of slack keeps a retry from slipping to the poll after. */
+	wait = min(wait, rssSeenRetention) - f.interval()/2
+	return nt-int64(binary.LittleEndian.Uint64(v)) >= int64(wait/time.Second)
+}
+
+func (f rssFeed) record(guid string, settled bool, nt int64) error {
+	if len(guid) == 0 {
+		return nil
+	}
+
+	return db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("rss")).Bucket([]byte(f.indexer()))
+		v := binary.LittleEndian.AppendUint64(nil, uint64(nt))
+		if settled {
+			return b.Put([]byte(guid), v)
+		}
+
+		failures := uint64(1)
+		if prev := b.Get([]byte(guid)); len(prev) == 16 {
+			failures += binary.LittleEndian.Uint64(prev[8:])
+		}
+
+		return b.Put([]byte(guid), binary.LittleEndian.AppendUint64(v, failures))
+	})
+}
+
+/* Returns the items in the feed neither settled nor waiting on a retry, guids gone from the feed for a day are forgotten. */
+func (f rssFeed) unseen(items []torznab.Item, nt int64) ([]torznab.Item, error) {
+	id := f.indexer()
+	fresh := make([]torznab.Item, 0)
+	err := db.Update(func(tx *bolt.Tx) error {
+		pb, err := tx.CreateBucketIfNotExists([]byte("rss"))
+		if err != nil {
+			return err
+		}
+
+		b, err := pb.CreateBucketIfNotExists([]byte(id))
+		if err != nil {
+			return err
+		}
+
+		current := make(map[string]struct{}, len(items))
+		for _, it := range items {
+			guid := rssGUID(it)
+			if len(guid) == 0 {
+				continue
+			}
+
+			if _, ok := current[guid]; ok {
+				continue
+			}
+
+			current[guid] = struct{}{}
+			if v := b.Get([]byte(guid)); v != nil && !f.retryDue(v, nt) {
+				continue
+			}
+
+			fresh = append(fresh, it)
+		}
+
+		stale := make([][]byte, 0)
+		if err := b.ForEach(func(k, v []byte) error {
+			if _, ok := current[string(k)]; ok || len(v) < 8 {
+				return nil
+			}
+
+			if nt-int64(rssSeenRetention/time.Second) > int64(binary.LittleEndian.Uint64(v)) {
+				stale = append(stale, bytes.Clone(k))
+			}
+
+			return nil
+		}); err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+
+	return fresh, err
+}
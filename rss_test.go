@@ -0,0 +1,95 @@
+package main
+
+import (
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/autobrr/go-qbittorrent"
+	"github.com/titlerr/upgraderr/pkg/torznab"
+)
+
+func TestRSSRetry(t *testing.T) {
+	saved := db
+	t.Cleanup(func() { db = saved })
+
+	db = openFixture(t, nil)
+	clock := fakeTime(t, time.Unix(1700000000, 0))
+	f := rssFeed{Indexer: "someindexer", Interval: duration(time.Minute * 10)}
+	items := []torznab.Item{{Title: "Show.S01E01", GUID: "a"}, {Title: "Show.S01E02", GUID: "b"}, {Title: "Show.S01E02", GUID: "b"}}
+
+	poll := func(want ...string) {
+		t.Helper()
+		nt := globalTime.Now().Unix()
+		fresh, err := f.unseen(items, nt)
+		if err != nil {
+			t.Fatalf("unseen: %q", err)
+		}
+
+		got := make([]string, 0, len(fresh))
+		for _, it := range fresh {
+			got = append(got, it.GUID)
+			if err := f.record(it.GUID, it.GUID == "a", nt); err != nil {
+				t.Fatalf("record: %q", err)
+			}
+		}
+
+		if len(got) != len(want) || (len(want) != 0 && got[0] != want[0]) {
+			t.Fatalf("polled %v, want %v", got, want)
+		}
+	}
+
+	poll("a", "b")
+	clock.Advance(time.Minute*10 - time.Second)
+	poll("b")
+
+	/* The second failure waits two polls, the third four. */
+	clock.Advance(time.Minute * 10)
+	poll()
+	clock.Advance(time.Minute * 10)
+	poll("b")
+	for i := 0; i < 3; i++ {
+		clock.Advance(time.Minute * 10)
+		poll()
+	}
+
+	clock.Advance(time.Minute * 10)
+	poll("b")
+
+	items = items[:1]
+	clock.Advance(rssSeenRetention + time.Second)
+	poll()
+
+	items = append(items, torznab.Item{Title: "Show.S01E02", GUID: "b"})
+	poll("b")
+}
+
+func TestRSSMatchPending(t *testing.T) {
+	mp := newTimeentry([]qbittorrent.Torrent{
+		{Hash: "a", Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", Progress: 0.4},
+		{Hash: "b", Name: "Movie.Name.2020.1080p.BluRay.x264-GRP", Progress: 1},
+	}, 1)
+
+	f := rssFeed{Indexer: "someindexer"}
+	for _, tc := range []struct {
+		title          string
+		match, settled bool
+	}{
+		{"Show.Name.S01E01.1080p.WEB.h264-GRP", false, false},
+		{"Movie.Name.2020.1080p.BluRay.x264-GRP", true, false},
+		{"Other.Show.S01E01.1080p.WEB.h264-GRP", false, true},
+	} {
+		if match, _ := rssMatch(mp, tc.title); match != tc.match {
+			t.Fatalf("%s matched %t", tc.title, match)
+		}
+
+		/* A match goes on to download, which needs a feed. */
+		if tc.match {
+			continue
+		}
+
+		if settled := f.inject(nil, &upgradereq{}, mp, nil, torznab.Item{Title: tc.title}, slog.Default()); settled != tc.settled {
+			t.Fatalf("%s settled %t", tc.title, settled)
+		}
+	}
+}
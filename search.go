@@ -0,0 +1,840 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autobrr/go-qbittorrent"
+	"github.com/moistari/rls"
+	"github.com/titlerr/upgraderr/pkg/torznab"
+	bolt "go.etcd.io/bbolt"
+)
+
+type torznabSummary struct {
+	Searched uint
+	Matched  uint
+	Injected uint
+	Failed   uint
+}
+
+type searchJob struct {
+	query   torznab.Query
+	text    string
+	release *rls.Release
+	age     time.Duration
+}
+
+/* Searches and searches returning the release itself, per text query. */
+type queryHits struct {
+	Searches uint
+	Hits     uint
+}
+
+type torznabCrossSearch struct {
+	APIKey       string
+	Provider     string
+	JackettHost  string
+	ProwlarrHost string
+	Torznab      []torznabEndpoint
+	AgeLimit     uint
+	arrConfig
+	upgradereq
+}
+
+func handleTorznabCrossSearch(w http.ResponseWriter, r *http.Request) {
+	if db == nil {
+		http.Error(w, fmt.Sprintf("You have a configuration error, unable to create a database on the filesystem"), 480)
+		return
+	}
+
+	var req torznabCrossSearch
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), 470)
+		return
+	}
+
+	req.bind(r)
+	log := req.logger()
+
+	provider, err := req.getProvider()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to configure provider: %q\n", err), 473)
+		return
+	}
+
+	indexers, err := provider.Indexers()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get indexers: %q\n", err), 472)
+		return
+	}
+
+	tmp := upgradereq{
+		Host:     req.Host,
+		User:     req.User,
+		Password: req.Password,
+	}
+
+	if err := getClient(&tmp); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get client: %q\n", err), 471)
+		return
+	}
+
+	req.Client = tmp.Client
+	mp, err := req.getAllTorrents()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Unable to get result: %q\n", err), 468)
+		return
+	}
+
+	processlist := make(map[string]qbittorrent.Torrent)
+	regexseason := regexp.MustCompile("(S\\d+)")
+	nt := globalTime.Now().Unix()
+	for _, e := range mp.e {
+		for _, torrent := range e {
+			if req.AgeLimit != 0 && nt-int64(req.AgeLimit) > torrent.CompletionOn {
+				continue
+			}
+
+			r := CacheTitle(torrent.Name)
+
+			q := strings.ToLower(r.Title)
+			y := ""
+			if r.Year != 0 {
+				y = fmt.Sprintf("%d", r.Year)
+			}
+
+			s := ""
+			if r.Series != 0 || r.Episode != 0 {
+				if regexseason.MatchString(torrent.Name) {
+					s = fmt.Sprintf("S%02d", r.Series)
+					if r.Episode != 0 {
+						s += fmt.Sprintf("E%02d", r.Episode)
+					}
+				} else if strings.Contains(strings.ToLower(torrent.Name), "season") {
+					s = fmt.Sprintf("season %d", r.Series)
+				}
+			} else if r.Month != 0 {
+				s = fmt.Sprintf("%02d", r.Month)
+			}
+
+			if len(y) != 0 {
+				q += " " + y
+			}
+			if len(s) != 0 {
+				q += " " + s
+			}
+
+			processlist[q] = torrent
+		}
+	}
+
+	regexadult := regexp.MustCompile("(XXX)")
+	summary := make(map[string]*torznabSummary, len(indexers))
+	for _, indexer := range indexers {
+		summary[indexer.ID] = &torznabSummary{}
+
+		if err := db.Update(func(tx *bolt.Tx) error {
+			for _, bucket := range []*bolt.Bucket{
+				tx.Bucket([]byte("enclosures")),
+				tx.Bucket([]byte("titles")),
+				tx.Bucket([]byte("torrents"))} {
+				if _, err := bucket.CreateBucketIfNotExists([]byte(indexer.ID)); err != nil {
+					return err
+				}
+			}
+
+			_, err := tx.Bucket([]byte("queries")).CreateBucketIfNotExists([]byte(config.Search.indexer(indexer.ID).Backend))
+			return err
+		}); err != nil {
+			log.Error("Failed to create initial indexer buckets", "indexer", indexer.ID, "error", err)
+		}
+	}
+
+	order := make([]string, 0, len(processlist))
+	for k := range processlist {
+		order = append(order, k)
+	}
+
+	hits := getQueryHits(order)
+	priority := make(map[string]float64, len(order))
+	for _, k := range order {
+		priority[k] = hits[k].priority(releaseAge(processlist[k], nt))
+	}
+
+	sort.Slice(order, func(i, j int) bool {
+		if priority[order[i]] != priority[order[j]] {
+			return priority[order[i]] > priority[order[j]]
+		}
+
+		return order[i] < order[j]
+	})
+
+	jobs := make(map[string][]searchJob, len(indexers))
+	resolver := newIDResolver(req.arrConfig)
+	for _, k := range order {
+		t := processlist[k]
+		r := CacheTitle(t.Name)
+		age := releaseAge(t, nt)
+		adult := regexadult.MatchString(t.Name)
+		ids := resolver.resolve(t, r)
+		for _, indexer := range indexers {
+			cat := ""
+			if adult {
+				for _, cl := range indexer.Caps.Categories.Category {
+					id, _ := strconv.Atoi(cl.ID)
+					if id >= 6000 && id <= 6999 {
+						cat = "6000"
+						break
+					}
+				}
+
+				if len(cat) == 0 {
+					continue
+				}
+			} else if r.Type == rls.Episode || r.Type == rls.Series {
+				if !indexer.Caps.Searching.TvSearch.IsAvailable() {
+					continue
+				}
+				cat = "5000"
+			} else if r.Type == rls.Movie {
+				if !indexer.Caps.Searching.MovieSearch.IsAvailable() {
+					continue
+				}
+				cat = "2000"
+			} else if r.Type == rls.Music || r.Type == rls.Audiobook {
+				if !indexer.Caps.Searching.MusicSearch.IsAvailable() && !indexer.Caps.Searching.AudioSearch.IsAvailable() {
+					continue
+				}
+				cat = "3000"
+			} else if r.Type == rls.Book || r.Type == rls.Comic || r.Type == rls.Education || r.Type == rls.Magazine {
+				if !indexer.Caps.Searching.BookSearch.IsAvailable() {
+					continue
+				}
+				cat = "7000"
+			}
+
+			jobs[indexer.ID] = append(jobs[indexer.ID], searchJob{
+				query:   buildSearchQuery(indexer.Caps, r, ids, k, cat),
+				text:    k,
+				release: r,
+				age:     age,
+			})
+		}
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	claimed := make(map[string]struct{})
+	for id, queries := range jobs {
+		if h := getIndexerHealth(id); h.coolingDown(globalTime.Now()) {
+			log.Warn("Cooling down, skipping queries", "indexer", id, "until", h.CooldownUntil.Format(time.RFC3339), "failures", h.Failures, "queries", len(queries))
+			continue
+		}
+
+		ic := config.Search.indexer(id)
+		limiter := getIndexerLimiter(id, ic)
+		search := func(j searchJob) {
+			key := j.query.Key()
+			ttl := int64(config.Search.queryTTL(ic, j.age) / time.Second)
+
+			lock.Lock()
+			if _, ok := claimed[ic.Backend+"|"+key]; ok {
+				lock.Unlock()
+				log.Debug("Already searched on backend this run, skipping", "indexer", id, "query", key, "backend", ic.Backend)
+				return
+			}
+
+			claimed[ic.Backend+"|"+key] = struct{}{}
+			lock.Unlock()
+
+			if err := db.View(func(tx *bolt.Tx) error {
+				if queryStamped(tx, ic.Backend, key, ttl) {
+					return fmt.Errorf("cache found for %q", key)
+				}
+
+				return nil
+			}); err != nil {
+				log.Debug("Skipping query", "indexer", id, "reason", err)
+				return
+			}
+
+			if getIndexerHealth(id).coolingDown(globalTime.Now()) {
+				return
+			}
+
+			limiter.Wait(context.Background())
+			res, err := provider.Search(id, j.query)
+			countIndexerRequest(id, "search", err)
+
+			lock.Lock()
+			summary[id].Searched++
+			lock.Unlock()
+
+			if err != nil {
+				log.Error("Fatal acquisition", "indexer", id, "error", err)
+				recordIndexerResult(id, err)
+				return
+			}
+
+			recordIndexerResult(id, nil)
+
+			if err := db.Update(func(tx *bolt.Tx) error {
+				{
+					tb := tx.Bucket([]byte("titles"))
+					if tb == nil {
+						return fmt.Errorf("titles: Failed to find bucket")
+					}
+
+					b := tb.Bucket([]byte(id))
+					if b == nil {
+						return fmt.Errorf("%q: Failed to find title bucket", id)
+					}
+
+					eb := tx.Bucket([]byte("enclosures"))
+					if eb == nil {
+						return fmt.Errorf("enclosures: Failed to find bucket")
+					}
+
+					c := eb.Bucket([]byte(id))
+					if c == nil {
+						return fmt.Errorf("%q: Failed to find enclosure bucket", id)
+					}
+
+					for _, ch := range res {
+						if err := b.Put([]byte(ch.Title), []byte(ch.GUID)); err != nil {
+							return err
+						}
+
+						if err := stampEntry(tx, "titles", id, []byte(ch.Title), nt); err != nil {
+							return err
+						}
+
+						if err := c.Put([]byte(ch.GUID), []byte(ch.Enclosure.URL)); err != nil {
+							return err
+						}
+
+						if err := stampEntry(tx, "enclosures", id, []byte(ch.GUID), nt); err != nil {
+							return err
+						}
+					}
+				}
+				{
+					pb := tx.Bucket([]byte("queries"))
+					if pb == nil {
+						return fmt.Errorf("queries: Failed to find bucket")
+					}
+
+					b := pb.Bucket([]byte(ic.Backend))
+					if b == nil {
+						return fmt.Errorf("%q: Failed to find queries bucket", ic.Backend)
+					}
+
+					if err := b.Put([]byte(key), binary.LittleEndian.AppendUint64(nil, uint64(nt))); err != nil {
+						return err
+					}
+				}
+				{
+					hit := false
+					for _, ch := range res {
+						if rls.Compare(*j.release, *CacheTitle(ch.Title)) == 0 {
+							hit = true
+							break
+						}
+					}
+
+					if err := recordQueryHit(tx, j.text, hit, nt); err != nil {
+						return err
+					}
+				}
+
+				return nil
+			}); err != nil {
+				log.Error("Failed to commit database transaction", "indexer", id, "error", err)
+			}
+		}
+
+		ch := make(chan searchJob)
+		for i := uint(0); i < max(ic.Concurrency, 1); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for j := range ch {
+					search(j)
+				}
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer close(ch)
+			for _, j := range queries {
+				log.Debug("Searching", "indexer", id, "query", j.query.Key())
+				ch <- j
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	type candidate struct {
+		indexer   string
+		title     string
+		guid      []byte
+		enclosure []byte
+		torrent   []byte
+	}
+
+	candidates := make([]candidate, 0)
+	if err := db.View(func(tx *bolt.Tx) error {
+		titb := tx.Bucket([]byte("titles"))
+		if titb == nil {
+			return fmt.Errorf("missing parent titles bucket")
+		}
+
+		eb := tx.Bucket([]byte("enclosures"))
+		if eb == nil {
+			return fmt.Errorf("missing parent enclosures bucket")
+		}
+
+		torb := tx.Bucket([]byte("torrents"))
+		if torb == nil {
+			return fmt.Errorf("missing parent torrents bucket")
+		}
+
+		atb := tx.Bucket([]byte("attempts"))
+		if atb == nil {
+			return fmt.Errorf("missing parent attempts bucket")
+		}
+
+		return titb.ForEachBucket(func(k []byte) error {
+			ibc := titb.Bucket(k)
+			ebc := eb.Bucket(k)
+			tbc := torb.Bucket(k)
+			if ebc == nil || tbc == nil {
+				return nil
+			}
+
+			abc := atb.Bucket(k)
+			return ibc.ForEach(func(kc, v []byte) error {
+				ent, ok := mp.e[CacheFormatted(string(kc))]
+				if !ok {
+					return nil
+				}
+
+				if abc != nil {
+					if stamp := abc.Get(v); stamp != nil && !config.Search.retryDue(int64(binary.LittleEndian.Uint64(stamp)), nt) {
+						return nil
+					}
+				}
+
+				r := CacheTitle(string(kc))
+				for _, e := range ent {
+					if e.Progress != 1.0 || rls.Compare(*r, *CacheTitle(e.Name)) != 0 {
+						continue
+					}
+
+					candidates = append(candidates, candidate{
+						indexer:   string(k),
+						title:     string(kc),
+						guid:      bytes.Clone(v),
+						enclosure: bytes.Clone(ebc.Get(v)),
+						torrent:   bytes.Clone(tbc.Get(v)),
+					})
+					break
+				}
+
+				return nil
+			})
+		})
+	}); err != nil {
+		http.Error(w, fmt.Sprintf("Unable to read search results: %q\n", err), 467)
+		return
+	}
+
+	present := presentHashes(mp)
+	for _, c := range candidates {
+		sum, ok := summary[c.indexer]
+		if !ok {
+			sum = &torznabSummary{}
+			summary[c.indexer] = sum
+		}
+
+		sum.Matched++
+		if c.torrent == nil {
+			if c.enclosure == nil {
+				sum.Failed++
+				continue
+			}
+
+			c.torrent, err = provider.Enclosure(c.indexer, string(c.enclosure))
+			countIndexerRequest(c.indexer, "enclosure", err)
+			if err != nil {
+				log.Error("Error snatching", "indexer", c.indexer, "title", c.title, "error", err)
+				sum.Failed++
+				continue
+			}
+
+			if err := db.Update(func(tx *bolt.Tx) error {
+				if err := tx.Bucket([]byte("torrents")).Bucket([]byte(c.indexer)).Put(c.guid, c.torrent); err != nil {
+					return err
+				}
+
+				return stampEntry(tx, "torrents", c.indexer, c.guid, nt)
+			}); err != nil {
+				log.Error("Failed to store torrent", "indexer", c.indexer, "title", c.title, "error", err)
+			}
+		}
+
+		hash, name, err := torrentMetadata(c.torrent)
+		if err != nil {
+			log.Error("Invalid torrent", "indexer", c.indexer, "title", c.title, "error", err)
+			sum.Failed++
+			continue
+		}
+
+		if _, ok := present[hash]; ok {
+			continue
+		}
+
+		present[hash] = struct{}{}
+		if err := db.Update(func(tx *bolt.Tx) error {
+			b, err := tx.Bucket([]byte("attempts")).CreateBucketIfNotExists([]byte(c.indexer))
+			if err != nil {
+				return err
+			}
+
+			return b.Put(c.guid, binary.LittleEndian.AppendUint64(nil, uint64(nt)))
+		}); err != nil {
+			log.Error("Failed to stamp attempt", "indexer", c.indexer, "title", c.title, "error", err)
+		}
+
+		if len(name) == 0 {
+			name = c.title
+		}
+
+		sub := upgradereq{
+			Name:     name,
+			Host:     req.Host,
+			User:     req.User,
+			Password: req.Password,
+			Hash:     hash,
+			Torrent:  c.torrent,
+			Client:   req.Client,
+			log:      req.log.With("indexer", c.indexer),
+			trigger:  auditTrigger{Endpoint: req.trigger.Endpoint, Rule: c.indexer, RequestID: req.trigger.RequestID},
+		}
+
+		if code, msg := sub.crossTorrent(mp); code == 200 {
+			sum.Injected++
+		} else {
+			sub.logger().Warn("Injection failed", "code", code, "message", strings.TrimSpace(msg))
+			sum.Failed++
+		}
+	}
+
+	ids := make([]string, 0, len(summary))
+	for id := range summary {
+		ids = append(ids, id)
+	}
+
+	sort.Strings(ids)
+	buf := &strings.Builder{}
+	for _, id := range ids {
+		sum := summary[id]
+		fmt.Fprintf(buf, "%s: searched %d, matched %d, injected %d, failed %d\n", id, sum.Searched, sum.Matched, sum.Injected, sum.Failed)
+	}
+
+	fmt.Fprintf(buf, "Processed: %d\n", len(processlist))
+	http.Error(w, buf.String(), 200)
+}
+
+/* Time since the torrent completed, or was added when it never has. */
+func releaseAge(t qbittorrent.Torrent, now int64) time.Duration {
+	stamp := t.CompletionOn
+	if stamp <= 0 {
+		stamp = t.AddedOn
+	}
+
+	return time.Duration(max(now-stamp, 0)) * time.Second
+}
+
+/* Laplace smoothed hit rate, decayed by the age of the release in days. */
+func (h queryHits) priority(age time.Duration) float64 {
+	return float64(h.Hits+1) / float64(h.Searches+2) / (1 + age.Hours()/24)
+}
+
+func getQueryHits(keys []string) map[string]queryHits {
+	res := make(map[string]queryHits, len(keys))
+	db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte("hits"))
+		if b == nil {
+			return nil
+		}
+
+		for _, k := range keys {
+			v := b.Get([]byte(k))
+			if v == nil {
+				continue
+			}
+
+			var h queryHits
+			if err := json.Unmarshal(v, &h); err != nil {
+				continue
+			}
+
+			res[k] = h
+		}
+
+		return nil
+	})
+
+	return res
+}
+
+func recordQueryHit(tx *bolt.Tx, key string, hit bool, nt int64) error {
+	b, err := tx.CreateBucketIfNotExists([]byte("hits"))
+	if err != nil {
+		return err
+	}
+
+	var h queryHits
+	if v := b.Get([]byte(key)); v != nil {
+		json.Unmarshal(v, &h)
+	}
+
+	h.Searches++
+	if hit {
+		h.Hits++
+	}
+
+	buf, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte(key), buf); err != nil {
+		return err
+	}
+
+	return stampEntry(tx, "hits", "", []byte(key), nt)
+}
+
+/* True when the backend ran the query less than ttl seconds ago. */
+func queryStamped(tx *bolt.Tx, backend, key string, ttl int64) bool {
+	pb := tx.Bucket([]byte("queries"))
+	if pb == nil {
+		return false
+	}
+
+	b := pb.Bucket([]byte(backend))
+	if b == nil {
+		return false
+	}
+
+	stamp := b.Get([]byte(key))
+	if stamp == nil {
+		return false
+	}
+
+	return globalTime.Now().Unix()-ttl < int64(binary.LittleEndian.Uint64(stamp))
+}
+
+/* Prefers structured tv and movie searches, by id when possible, if the indexer advertises them, otherwise the free-text query. */
+func buildSearchQuery(caps torznab.Caps, r *rls.Release, ids releaseIDs, text, cat string) torznab.Query {
+	q := torznab.Query{Q: text}
+	if len(cat) != 0 {
+		q.Cat = []string{cat}
+	}
+
+	title := strings.ToLower(r.Title)
+	if r.Year != 0 {
+		title += fmt.Sprintf(" %d", r.Year)
+	}
+
+	tv := caps.Searching.TvSearch
+	switch {
+	case (r.Type == rls.Episode || r.Type == rls.Series) && r.Series != 0 && tv.Supports("season") && (r.Episode == 0 || tv.Supports("ep")):
+		s := q
+		s.Type, s.Q, s.Season = "tvsearch", "", strconv.Itoa(r.Series)
+		if r.Episode != 0 {
+			s.Ep = strconv.Itoa(r.Episode)
+		}
+
+		if len(ids.TVDB) != 0 && tv.Supports("tvdbid") {
+			s.TVDBID = ids.TVDB
+		} else if len(ids.IMDB) != 0 && tv.Supports("imdbid") {
+			s.IMDBID = ids.IMDB
+		} else if len(ids.TMDB) != 0 && tv.Supports("tmdbid") {
+			s.TMDBID = ids.TMDB
+		} else if tv.Supports("q") {
+			s.Q = title
+		} else {
+			break
+		}
+
+		q = s
+	case r.Type == rls.Movie && caps.Searching.MovieSearch.IsAvailable():
+		movie := caps.Searching.MovieSearch
+		if len(ids.IMDB) != 0 && movie.Supports("imdbid") {
+			q.Type, q.Q, q.IMDBID = "movie", "", ids.IMDB
+		} else if len(ids.TMDB) != 0 && movie.Supports("tmdbid") {
+			q.Type, q.Q, q.TMDBID = "movie", "", ids.TMDB
+		} else if movie.Supports("q") {
+			q.Type = "movie"
+		}
+	}
+
+	return q
+}
+
+/* Every v1 infohash in the client, lowercased. */
+func presentHashes(mp *timeentry) map[string]struct{} {
+	present := make(map[string]struct{}, len(mp.h))
+	for _, t := range mp.h {
+		present[strings.ToLower(t.Hash)] = struct{}{}
+		if len(t.InfohashV1) != 0 {
+			present[strings.ToLower(t.InfohashV1)] = struct{}{}
+		}
+	}
+
+	return present
+}
+
+/* Returns the lowercase hex v1 infohash and the name of a bencoded torrent. */
+func torrentMetadata(b []byte) (string, string, error) {
+	if len(b) == 0 || b[0] != 'd' {
+		return "", "", fmt.Errorf("not a bencoded dictionary")
+	}
+
+	for pos := 1; pos < len(b) && b[pos] != 'e'; {
+		key, next, err := bencodeString(b, pos)
+		if err != nil {
+			return "", "", err
+		}
+
+		end, err := bencodeSkip(b, next)
+		if err != nil {
+			return "", "", err
+		}
+
+		if key != "info" {
+			pos = end
+			continue
+		}
+
+		name := ""
+		for ipos := next + 1; ipos < end-1 && b[ipos] != 'e'; {
+			ikey, inext, err := bencodeString(b, ipos)
+			if err != nil {
+				return "", "", err
+			}
+
+			if ipos, err = bencodeSkip(b, inext); err != nil {
+				return "", "", err
+			}
+
+			if ikey == "name" {
+				name, _, _ = bencodeString(b, inext)
+			}
+		}
+
+		sum := sha1.Sum(b[next:end])
+		return hex.EncodeToString(sum[:]), name, nil
+	}
+
+	return "", "", fmt.Errorf("missing info dictionary")
+}
+
+/* Torrents come from indexers, nothing about the length prefix is trusted. */
+func bencodeString(b []byte, pos int) (string, int, error) {
+	if pos >= len(b) || b[pos] < '0' || b[pos] > '9' {
+		return "", 0, fmt.Errorf("bad string at %d", pos)
+	}
+
+	l, start := 0, pos
+	for ; start < len(b) && b[start] >= '0' && b[start] <= '9'; start++ {
+		if l > (len(b)-start)/10 {
+			return "", 0, fmt.Errorf("string length out of range at %d", pos)
+		}
+
+		l = l*10 + int(b[start]-'0')
+	}
+
+	if start >= len(b) || b[start] != ':' {
+		return "", 0, fmt.Errorf("bad string at %d", pos)
+	}
+
+	start++
+	if l > len(b)-start {
+		return "", 0, fmt.Errorf("truncated string at %d", pos)
+	}
+
+	return string(b[start : start+l]), start + l, nil
+}
+
+/* Returns the offset just past the bencoded value at pos. */
+func bencodeSkip(b []byte, pos int) (int, error) {
+	if pos >= len(b) {
+		return 0, fmt.Errorf("truncated at %d", pos)
+	}
+
+	switch c := b[pos]; {
+	case c == 'i':
+		idx := bytes.IndexByte(b[pos:], 'e')
+		if idx == -1 {
+			return 0, fmt.Errorf("bad integer at %d", pos)
+		}
+
+		return pos + idx + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(b) && b[pos] != 'e' {
+			var err error
+			if pos, err = bencodeSkip(b, pos); err != nil {
+				return 0, err
+			}
+		}
+
+		if pos >= len(b) {
+			return 0, fmt.Errorf("unterminated container")
+		}
+
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		_, next, err := bencodeString(b, pos)
+		return next, err
+	}
+
+	return 0, fmt.Errorf("unknown type %q at %d", b[pos], pos)
+}
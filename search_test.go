@@ -0,0 +1,106 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"reflect"
+	"testing"
+
+	"github.com/moistari/rls"
+	"github.com/titlerr/upgraderr/pkg/torznab"
+)
+
+func TestTorrentMetadata(t *testing.T) {
+	info := "d6:lengthi5e4:name8:Show.S01e"
+	sum := sha1.Sum([]byte(info))
+	hash, name, err := torrentMetadata([]byte("d8:announce3:url4:info" + info + "e"))
+	if err != nil {
+		t.Fatalf("torrentMetadata: %q", err)
+	}
+
+	if hash != hex.EncodeToString(sum[:]) || name != "Show.S01" {
+		t.Fatalf("got %q %q", hash, name)
+	}
+
+	for _, in := range []string{
+		"",
+		"d",
+		"d  ",
+		"d4",
+		"d4:",
+		"d4:inf",
+		"d4:info",
+		"d4:infod",
+		"d4:infod4:name",
+		"d4:infod4:name8:Show",
+		"d99999999999999999999999:info",
+		"d-1:info",
+		"d4x:info",
+		"d:",
+		"d4:infoi5",
+		"d4:infol",
+		"d4:infod4:namexe",
+		"l4:infoe",
+	} {
+		if _, _, err := torrentMetadata([]byte(in)); err == nil {
+			t.Fatalf("%q accepted", in)
+		}
+	}
+}
+
+func TestBuildSearchQuery(t *testing.T) {
+	caps := func(tv, movie string) torznab.Caps {
+		var c torznab.Caps
+		c.Searching.Search = torznab.SearchCap{Available: "yes", SupportedParams: "q"}
+		if len(tv) != 0 {
+			c.Searching.TvSearch = torznab.SearchCap{Available: "yes", SupportedParams: tv}
+		}
+
+		if len(movie) != 0 {
+			c.Searching.MovieSearch = torznab.SearchCap{Available: "yes", SupportedParams: movie}
+		}
+
+		return c
+	}
+
+	episode := rls.ParseString("Show.Name.2020.S01E02.1080p.WEB.h264-GRP")
+	season := rls.ParseString("Show.Name.S02.1080p.WEB.h264-GRP")
+	movie := rls.ParseString("Movie.2020.1080p.BluRay.x264-GRP")
+	text := torznab.Query{Q: "text", Cat: []string{"5000"}}
+	all := releaseIDs{IMDB: "tt1", TVDB: "2", TMDB: "3"}
+	for _, c := range []struct {
+		name string
+		caps torznab.Caps
+		r    *rls.Release
+		ids  releaseIDs
+		want torznab.Query
+	}{
+		{"no tv search", caps("", ""), &episode, all, text},
+		{"tv search unavailable", torznab.Caps{}, &episode, all, text},
+		{"no season", caps("q,ep,tvdbid", ""), &episode, all, text},
+		{"no ep", caps("q,season,tvdbid", ""), &episode, all, text},
+		{"season pack without ep", caps("q,season", ""), &season, releaseIDs{}, torznab.Query{Type: "tvsearch", Q: "show name", Season: "2", Cat: []string{"5000"}}},
+		{"tv text", caps("q,season,ep", ""), &episode, all, torznab.Query{Type: "tvsearch", Q: "show name 2020", Season: "1", Ep: "2", Cat: []string{"5000"}}},
+		{"tv text without ids", caps("q,season,ep,tvdbid", ""), &episode, releaseIDs{}, torznab.Query{Type: "tvsearch", Q: "show name 2020", Season: "1", Ep: "2", Cat: []string{"5000"}}},
+		{"tvdb first", caps("q,season,ep,tvdbid,imdbid,tmdbid", ""), &episode, all, torznab.Query{Type: "tvsearch", Season: "1", Ep: "2", TVDBID: "2", Cat: []string{"5000"}}},
+		{"imdb before tmdb", caps("q,season,ep,imdbid,tmdbid", ""), &episode, all, torznab.Query{Type: "tvsearch", Season: "1", Ep: "2", IMDBID: "tt1", Cat: []string{"5000"}}},
+		{"tmdb", caps("q,season,ep,tvdbid,tmdbid", ""), &episode, releaseIDs{TMDB: "3"}, torznab.Query{Type: "tvsearch", Season: "1", Ep: "2", TMDBID: "3", Cat: []string{"5000"}}},
+		{"tvdb without q", caps("season,ep,tvdbid", ""), &episode, all, torznab.Query{Type: "tvsearch", Season: "1", Ep: "2", TVDBID: "2", Cat: []string{"5000"}}},
+		{"imdb without q", caps("season,ep,imdbid", ""), &episode, releaseIDs{IMDB: "tt1"}, torznab.Query{Type: "tvsearch", Season: "1", Ep: "2", IMDBID: "tt1", Cat: []string{"5000"}}},
+		{"no usable id without q", caps("season,ep,tvdbid", ""), &episode, releaseIDs{IMDB: "tt1"}, text},
+		{"movie on tv caps", caps("q,season,ep,imdbid", ""), &movie, all, text},
+		{"movie text", caps("", "q"), &movie, all, torznab.Query{Type: "movie", Q: "text", Cat: []string{"5000"}}},
+		{"movie imdb", caps("", "q,imdbid,tmdbid"), &movie, all, torznab.Query{Type: "movie", IMDBID: "tt1", Cat: []string{"5000"}}},
+		{"movie tmdb without q", caps("", "tmdbid"), &movie, all, torznab.Query{Type: "movie", TMDBID: "3", Cat: []string{"5000"}}},
+		{"movie no usable id without q", caps("", "imdbid"), &movie, releaseIDs{TMDB: "3"}, text},
+		{"episode on movie caps", caps("", "q,imdbid"), &episode, all, text},
+	} {
+		if got := buildSearchQuery(c.caps, c.r, c.ids, "text", "5000"); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v, want %+v", c.name, got, c.want)
+		}
+	}
+
+	if got := buildSearchQuery(caps("", ""), &movie, releaseIDs{}, "text", ""); got.Cat != nil {
+		t.Fatalf("empty category sent: %+v", got)
+	}
+}
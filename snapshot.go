@@ -0,0 +1,410 @@
+/*
+Copyright (C) 2022  Kyle Sanderson
+
+This program is free software; you can redistribute it and/or
+modify it under the terms of the GNU General Public License
+as published by the Free Software Foundation; specifically version 2
+of the License.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program; if not, write to the Free Software
+Foundation, Inc., 51 Franklin Street, Fifth Floor, Boston, MA  02110-1301, USA.
+*/
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/autobrr/go-qbittorrent"
+)
+
+/*
+A snapshot of one client, torrents grouped by CacheFormatted name and keyed by hash, with secondary
+indexes from content path, save path, tracker host, category and tag to hashes. Snapshots are never
+modified once published, a sync builds the next one from the last.
+*/
+type timeentry struct {
+	e map[string][]qbittorrent.Torrent
+	h map[string]qbittorrent.Torrent
+
+	content  index
+	save     index
+	tracker  index
+	category index
+	tag      index
+
+	rid     int64
+	synced  time.Time
+	took    time.Duration
+	session *syncSession
+}
+
+/* Hashes by key, in no particular order. */
+type index map[string][]string
+
+/* What each secondary index is keyed on, empty keys are not indexed. */
+var indexKeys = []struct {
+	of   func(t *timeentry) *index
+	keys func(t qbittorrent.Torrent) []string
+}{
+	{func(t *timeentry) *index { return &t.content }, func(t qbittorrent.Torrent) []string { return cleanPaths(t.ContentPath) }},
+	{func(t *timeentry) *index { return &t.save }, func(t qbittorrent.Torrent) []string { return cleanPaths(t.SavePath) }},
+	{func(t *timeentry) *index { return &t.tracker }, func(t qbittorrent.Torrent) []string { return []string{trackerHost(t.Tracker)} }},
+	{func(t *timeentry) *index { return &t.category }, func(t qbittorrent.Torrent) []string { return []string{t.Category} }},
+	{func(t *timeentry) *index { return &t.tag }, func(t qbittorrent.Torrent) []string { return splitTags(t.Tags) }},
+}
+
+func cleanPaths(p string) []string {
+	if len(p) == 0 {
+		return nil
+	}
+
+	return []string{path.Clean(p)}
+}
+
+func splitTags(tags string) []string {
+	res := make([]string, 0)
+	for _, tag := range strings.Split(tags, ",") {
+		if tag = strings.TrimSpace(tag); len(tag) != 0 {
+			res = append(res, tag)
+		}
+	}
+
+	return res
+}
+
+func newTimeentry(torrents []qbittorrent.Torrent, rid int64) *timeentry {
+	t := &timeentry{
+		e:   make(map[string][]qbittorrent.Torrent),
+		h:   make(map[string]qbittorrent.Torrent, len(torrents)),
+		rid: rid,
+	}
+
+	for _, ik := range indexKeys {
+		*ik.of(t) = make(index)
+	}
+
+	for _, tor := range torrents {
+		t.h[tor.Hash] = tor
+		s := CacheFormatted(tor.Name)
+		t.e[s] = append(t.e[s], tor)
+		for _, ik := range indexKeys {
+			ix := *ik.of(t)
+			for _, k := range ik.keys(tor) {
+				if len(k) != 0 {
+					ix[k] = append(ix[k], tor.Hash)
+				}
+			}
+		}
+	}
+
+	return t
+}
+
+/* Reused without asking the client again for as long as the last sync took, at least a second. */
+func (t *timeentry) fresh() bool {
+	return time.Since(t.synced) < max(t.took, time.Second*1)
+}
+
+func (t *timeentry) torrent(hash string) (qbittorrent.Torrent, bool) {
+	tor, ok := t.h[hash]
+	return tor, ok
+}
+
+/* The torrents under key in one of the snapshot's indexes. */
+func (t *timeentry) lookup(ix index, key string) []qbittorrent.Torrent {
+	res := make([]qbittorrent.Torrent, 0, len(ix[key]))
+	for _, hash := range ix[key] {
+		res = append(res, t.h[hash])
+	}
+
+	return res
+}
+
+/* Hashes announcing to host or any of its subdomains. */
+func (t *timeentry) trackedBy(host string) map[string]struct{} {
+	host = Normalize(host)
+	res := make(map[string]struct{})
+	for h, hashes := range t.tracker {
+		if h != host && !strings.HasSuffix(h, "."+host) {
+			continue
+		}
+
+		for _, hash := range hashes {
+			res[hash] = struct{}{}
+		}
+	}
+
+	return res
+}
+
+/* The torrents of an index, grouped by key. */
+func (t *timeentry) groups(ix index) map[string][]qbittorrent.Torrent {
+	res := make(map[string][]qbittorrent.Torrent, len(ix))
+	for k := range ix {
+		res[k] = t.lookup(ix, k)
+	}
+
+	return res
+}
+
+/*
+The next snapshot: removed and changed hashes are dropped, then changed is added back. A changed hash missing
+from changed is gone. Groups and index entries are shared with the previous snapshot, touched ones are rebuilt rather than edited.
+*/
+func (t *timeentry) apply(rid int64, touched []string, changed []qbittorrent.Torrent) *timeentry {
+	n := &timeentry{e: maps.Clone(t.e), h: maps.Clone(t.h), rid: rid}
+	gone := make(map[string]struct{}, len(touched))
+	old := make([]qbittorrent.Torrent, 0, len(touched))
+	for _, hash := range touched {
+		gone[hash] = struct{}{}
+		if tor, ok := n.h[hash]; ok {
+			old = append(old, tor)
+			delete(n.h, hash)
+		}
+	}
+
+	for _, tor := range changed {
+		n.h[tor.Hash] = tor
+	}
+
+	dirty := make(map[string]struct{})
+	added := make(map[string][]qbittorrent.Torrent)
+	for _, tor := range old {
+		dirty[CacheFormatted(tor.Name)] = struct{}{}
+	}
+
+	for _, tor := range changed {
+		s := CacheFormatted(tor.Name)
+		dirty[s] = struct{}{}
+		added[s] = append(added[s], tor)
+	}
+
+	for s := range dirty {
+		set := slices.DeleteFunc(slices.Clone(t.e[s]), func(tor qbittorrent.Torrent) bool {
+			_, ok := gone[tor.Hash]
+			return ok
+		})
+
+		if set = append(set, added[s]...); len(set) != 0 {
+			n.e[s] = set
+		} else {
+			delete(n.e, s)
+		}
+	}
+
+	for _, ik := range indexKeys {
+		prev, ix := *ik.of(t), maps.Clone(*ik.of(t))
+		dirty := make(map[string][]string)
+		for _, tor := range old {
+			for _, k := range ik.keys(tor) {
+				if _, ok := dirty[k]; !ok {
+					dirty[k] = nil
+				}
+			}
+		}
+
+		for _, tor := range changed {
+			for _, k := range ik.keys(tor) {
+				dirty[k] = append(dirty[k], tor.Hash)
+			}
+		}
+
+		for k, hashes := range dirty {
+			if len(k) == 0 {
+				continue
+			}
+
+			set := slices.DeleteFunc(slices.Clone(prev[k]), func(hash string) bool {
+				_, ok := gone[hash]
+				return ok
+			})
+
+			if set = append(set, hashes...); len(set) != 0 {
+				ix[k] = set
+			} else {
+				delete(ix, k)
+			}
+		}
+
+		*ik.of(n) = ix
+	}
+
+	return n
+}
+
+/*
+sync/maindata kept on a login of its own, so the rid it hands out is never reset by anything else talking to the client.
+The library decodes deltas into whole torrents, losing which fields were sent, so the raw objects are read here.
+*/
+type syncSession struct {
+	m      sync.Mutex
+	host   string
+	form   url.Values
+	client *http.Client
+}
+
+type mainDataDelta struct {
+	Rid             int64                      `json:"rid"`
+	FullUpdate      bool                       `json:"full_update"`
+	Torrents        map[string]json.RawMessage `json:"torrents"`
+	TorrentsRemoved []string                   `json:"torrents_removed"`
+}
+
+func newSyncSession(host, user, password string) *syncSession {
+	jar, _ := cookiejar.New(nil)
+	s := &syncSession{
+		host:   strings.TrimSuffix(host, "/"),
+		client: &http.Client{Jar: jar, Timeout: qbittorrent.DefaultTimeout},
+	}
+
+	if len(user) != 0 || len(password) != 0 {
+		s.form = url.Values{"username": {user}, "password": {password}}
+	}
+
+	return s
+}
+
+func (s *syncSession) login(ctx context.Context) error {
+	if s.form == nil {
+		return nil
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.host+"/api/v2/auth/login", strings.NewReader(s.form.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	res, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	if res.StatusCode != http.StatusOK || strings.TrimSpace(string(body)) == "Fails." {
+		return fmt.Errorf("login failed: %d %q", res.StatusCode, body)
+	}
+
+	return nil
+}
+
+/* Logs in again once when the session has expired, the client answers that rid with a full update. */
+func (s *syncSession) mainData(ctx context.Context, rid int64) (*mainDataDelta, error) {
+	s.m.Lock()
+	defer s.m.Unlock()
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.host+"/api/v2/sync/maindata?rid="+strconv.FormatInt(rid, 10), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err := s.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+
+		if res.StatusCode == http.StatusForbidden && attempt == 0 {
+			res.Body.Close()
+			if err := s.login(ctx); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		defer res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("maindata: unexpected status %d", res.StatusCode)
+		}
+
+		var md mainDataDelta
+		if err := json.NewDecoder(res.Body).Decode(&md); err != nil {
+			return nil, err
+		}
+
+		return &md, nil
+	}
+}
+
+func (c *upgradereq) syncMainData(s *syncSession, rid int64) (m *mainDataDelta, err error) {
+	defer observeClient(c.Host, "maindata", time.Now(), &err)
+	return s.mainData(context.Background(), rid)
+}
+
+/*
+Brings prev up to date with what qBittorrent reports as changed since its rid. Changed fields are
+merged into the torrents prev already holds, full updates are built from the maindata alone.
+*/
+func (c *upgradereq) syncTorrents(prev *timeentry) (*timeentry, error) {
+	start := time.Now()
+	var rid int64
+	session := newSyncSession(c.Host, c.User, c.Password)
+	if prev != nil && prev.session != nil {
+		rid, session = prev.rid, prev.session
+	}
+
+	md, err := c.syncMainData(session, rid)
+	if err != nil {
+		return nil, err
+	}
+
+	var next *timeentry
+	switch {
+	case prev == nil || prev.session != session || md.FullUpdate:
+		torrents := make([]qbittorrent.Torrent, 0, len(md.Torrents))
+		for hash, raw := range md.Torrents {
+			var t qbittorrent.Torrent
+			if err := json.Unmarshal(raw, &t); err != nil {
+				return nil, fmt.Errorf("torrent %s: %w", hash, err)
+			}
+
+			t.Hash = hash
+			torrents = append(torrents, t)
+		}
+
+		next = newTimeentry(torrents, md.Rid)
+	case len(md.Torrents) == 0 && len(md.TorrentsRemoved) == 0:
+		n := *prev
+		n.rid = md.Rid
+		next = &n
+	default:
+		changed := make([]qbittorrent.Torrent, 0, len(md.Torrents))
+		for hash, raw := range md.Torrents {
+			t := prev.h[hash]
+			if err := json.Unmarshal(raw, &t); err != nil {
+				return nil, fmt.Errorf("torrent %s: %w", hash, err)
+			}
+
+			t.Hash = hash
+			changed = append(changed, t)
+		}
+
+		next = prev.apply(md.Rid, slices.AppendSeq(md.TorrentsRemoved, maps.Keys(md.Torrents)), changed)
+	}
+
+	next.session = session
+	next.synced, next.took = time.Now(), time.Since(start)
+	return next, nil
+}
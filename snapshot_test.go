@@ -0,0 +1,215 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/autobrr/go-qbittorrent"
+)
+
+/*
+Serves sync/maindata from a script, then full updates of the live set, and torrents/info from the live set.
+Every other call is recorded with its form and answered with Ok.
+*/
+type fakeClient struct {
+	m        sync.Mutex
+	live     map[string]qbittorrent.Torrent
+	trackers map[string][]qbittorrent.TorrentTracker
+	script   []any
+	calls    []string
+}
+
+func (f *fakeClient) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.m.Lock()
+	defer f.m.Unlock()
+
+	var res any
+	switch r.URL.Path {
+	case "/api/v2/sync/maindata":
+		if len(f.script) != 0 {
+			res, f.script = f.script[0], f.script[1:]
+			break
+		}
+
+		torrents := make(map[string]qbittorrent.Torrent, len(f.live))
+		for hash, t := range f.live {
+			t.Hash = ""
+			torrents[hash] = t
+		}
+
+		res = map[string]any{"rid": 1, "full_update": true, "torrents": torrents}
+	case "/api/v2/torrents/info":
+		f.calls = append(f.calls, "info "+r.URL.Query().Get("hashes"))
+		torrents := make([]qbittorrent.Torrent, 0)
+		for hash, t := range f.live {
+			if h := r.URL.Query().Get("hashes"); len(h) == 0 || strings.Contains(h, hash) {
+				torrents = append(torrents, t)
+			}
+		}
+
+		res = torrents
+	case "/api/v2/app/webapiVersion":
+		w.Write([]byte("2.11.0"))
+		return
+	case "/api/v2/torrents/categories":
+		res = map[string]qbittorrent.Category{}
+	case "/api/v2/torrents/trackers":
+		trackers, ok := f.trackers[r.URL.Query().Get("hash")]
+		if !ok {
+			http.Error(w, "unknown hash", http.StatusInternalServerError)
+			return
+		}
+
+		res = trackers
+	default:
+		r.ParseMultipartForm(1 << 20)
+		f.calls = append(f.calls, strings.TrimPrefix(r.URL.Path, "/api/v2/")+" "+r.Form.Encode())
+		w.Write([]byte("Ok."))
+		return
+	}
+
+	json.NewEncoder(w).Encode(res)
+}
+
+func newFakeClient(t *testing.T, f *fakeClient) upgradereq {
+	t.Helper()
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return upgradereq{Host: srv.URL, Client: qbittorrent.NewClient(qbittorrent.Config{Host: srv.URL})}
+}
+
+func TestSyncTorrents(t *testing.T) {
+	a := qbittorrent.Torrent{Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", Progress: 0.5, DlSpeed: 1000}
+	b := qbittorrent.Torrent{Name: "Show.Name.S01E01.720p.WEB.h264-GRP", Progress: 1}
+	c := qbittorrent.Torrent{Name: "Movie.Name.2020.1080p.BluRay.x264-GRP", Progress: 1}
+	f := &fakeClient{
+		script: []any{
+			map[string]any{"rid": 1, "full_update": true, "torrents": map[string]qbittorrent.Torrent{"aaaa": a, "bbbb": b, "cccc": c}},
+			map[string]any{"rid": 2, "torrents": map[string]any{"aaaa": map[string]any{"category": "tv", "dlspeed": 0}}, "torrents_removed": []string{"cccc"}},
+			map[string]any{"rid": 3},
+		},
+	}
+
+	req := newFakeClient(t, f)
+	first, err := req.syncTorrents(nil)
+	if err != nil {
+		t.Fatalf("full sync: %q", err)
+	}
+
+	show := CacheFormatted(a.Name)
+	if first.rid != 1 || len(first.h) != 3 || len(first.e[show]) != 2 || first.h["aaaa"].Hash != "aaaa" {
+		t.Fatalf("full sync: rid %d, %d torrents, %d in group, %+v", first.rid, len(first.h), len(first.e[show]), first.h["aaaa"])
+	}
+
+	second, err := req.syncTorrents(first)
+	if err != nil {
+		t.Fatalf("delta sync: %q", err)
+	}
+
+	if got := second.h["aaaa"]; second.rid != 2 || len(second.h) != 2 || got.Category != "tv" || got.DlSpeed != 0 || got.Progress != 0.5 || got.Name != a.Name {
+		t.Fatalf("delta sync: rid %d, %+v", second.rid, got)
+	}
+
+	if _, ok := second.e[CacheFormatted(c.Name)]; ok {
+		t.Fatalf("removed torrent still grouped")
+	}
+
+	if set := second.e[show]; len(set) != 2 || (set[0].Category != "tv" && set[1].Category != "tv") {
+		t.Fatalf("changed torrent not regrouped: %+v", set)
+	}
+
+	for _, tor := range first.e[show] {
+		if tor.Category != "" || len(first.h) != 3 {
+			t.Fatalf("previous snapshot modified")
+		}
+	}
+
+	third, err := req.syncTorrents(second)
+	if err != nil || third.rid != 3 || len(third.h) != 2 {
+		t.Fatalf("empty delta: rid %d, %v", third.rid, err)
+	}
+
+	if len(f.calls) != 0 {
+		t.Fatalf("torrents fetched besides maindata: %q", f.calls)
+	}
+}
+
+func TestSnapshotIndexes(t *testing.T) {
+	a := qbittorrent.Torrent{Hash: "aaaa", Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", ContentPath: "/data/tv/Show.Name.S01E01.1080p.WEB.h264-GRP/", SavePath: "/data/tv", Tracker: "https://tracker.example/announce", Category: "tv", Tags: "one, two"}
+	b := qbittorrent.Torrent{Hash: "bbbb", Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", ContentPath: "/data/tv/Show.Name.S01E01.1080p.WEB.h264-GRP", SavePath: "/data/tv", Tracker: "https://eu.other.example/announce", Category: "tv.cross-seed", Tags: "two"}
+	c := qbittorrent.Torrent{Hash: "cccc", Name: "Movie.Name.2020.1080p.BluRay.x264-GRP", ContentPath: "/data/movies/Movie.Name.2020.1080p.BluRay.x264-GRP", SavePath: "/data/movies", Category: "movies"}
+	first := newTimeentry([]qbittorrent.Torrent{a, b, c}, 1)
+
+	if set := first.content["/data/tv/Show.Name.S01E01.1080p.WEB.h264-GRP"]; len(set) != 2 {
+		t.Fatalf("content paths not cleaned into one key: %v", first.content)
+	}
+
+	if len(first.save["/data/tv"]) != 2 || len(first.tag["two"]) != 2 || len(first.tag["one"]) != 1 || len(first.category["movies"]) != 1 {
+		t.Fatalf("indexes: %v %v %v", first.save, first.tag, first.category)
+	}
+
+	if _, ok := first.tracker[""]; ok {
+		t.Fatalf("torrent without a tracker indexed")
+	}
+
+	if tracked := first.trackedBy("other.example"); len(tracked) != 1 {
+		t.Fatalf("subdomain not matched: %v", tracked)
+	}
+
+	if tor, ok := first.torrent("cccc"); !ok || tor.Name != c.Name {
+		t.Fatalf("hash lookup: %+v", tor)
+	}
+
+	a.Category, a.Tags = "done", ""
+	second := first.apply(2, []string{"aaaa", "cccc"}, []qbittorrent.Torrent{a})
+	if _, ok := second.category["movies"]; ok || len(second.category["done"]) != 1 || len(second.category["tv"]) != 0 {
+		t.Fatalf("category index not updated: %v", second.category)
+	}
+
+	if len(second.tag["two"]) != 1 || len(second.tag["one"]) != 0 || len(second.content) != 1 {
+		t.Fatalf("indexes not updated: %v %v", second.tag, second.content)
+	}
+
+	if len(first.category["tv"]) != 1 || len(first.tag["two"]) != 2 {
+		t.Fatalf("previous snapshot modified")
+	}
+
+	groups, err := groupTorrents(second, "Category")
+	if err != nil || len(groups) != 2 || groups["done"][0].Hash != "aaaa" {
+		t.Fatalf("grouped %v: %v", groups, err)
+	}
+
+	if _, err := groupTorrents(second, "tag"); err == nil {
+		t.Fatalf("grouped by tag")
+	}
+}
+
+func TestSplitSharedData(t *testing.T) {
+	mp := newTimeentry([]qbittorrent.Torrent{
+		/* Registered sibling in the bucket, on a different path, and another resolution of the release. */
+		{Hash: "a", Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", ContentPath: "/data/a/Show.Name.S01E01.1080p.WEB.h264-GRP"},
+		{Hash: "b", Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", ContentPath: "/data/b/Show.Name.S01E01.1080p.WEB.h264-GRP"},
+		{Hash: "h", Name: "Show.Name.S01E01.720p.WEB.h264-GRP", ContentPath: "/data/tv/Show.Name.S01E01.720p.WEB.h264-GRP"},
+		{Hash: "i", Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", ContentPath: "/data/tv/Show.Name.S01E01.1080p.WEB.h264-GRP"},
+		/* Cross-seed of i in a subfolder of the same content. */
+		{Hash: "j", Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", ContentPath: "/data/tv/Show.Name.S01E01.1080p.WEB.h264-GRP/Show.Name.S01E01.1080p.WEB.h264-GRP.mkv"},
+		/* Unrelated name pointing into the same content. */
+		{Hash: "c", Name: "Movie.Name.2020.1080p.BluRay.x264-GRP", ContentPath: "/data/movies/Movie.Name.2020.1080p.BluRay.x264-GRP"},
+		{Hash: "d", Name: "Other.Movie.2021.1080p.BluRay.x264-GRP", ContentPath: "/data/movies/Movie.Name.2020.1080p.BluRay.x264-GRP/"},
+		/* Alone. */
+		{Hash: "e", Name: "Lonely.Movie.2019.1080p.BluRay.x264-GRP", ContentPath: "/data/movies/Lonely.Movie.2019.1080p.BluRay.x264-GRP"},
+		/* Cross-seeds going away together. */
+		{Hash: "f", Name: "Pair.Movie.2018.1080p.BluRay.x264-GRP", ContentPath: "/data/movies/Pair.Movie.2018.1080p.BluRay.x264-GRP"},
+		{Hash: "g", Name: "Pair.Movie.2018.1080p.BluRay.x264-GRP", ContentPath: "/data/movies/Pair.Movie.2018.1080p.BluRay.x264-GRP"},
+	}, 1)
+
+	withData, withoutData := splitSharedData(mp, map[string]struct{}{"a": {}, "c": {}, "e": {}, "f": {}, "g": {}, "h": {}, "i": {}})
+	if !slices.Equal(withData, []string{"a", "e", "f", "g", "h"}) || !slices.Equal(withoutData, []string{"c", "i"}) {
+		t.Fatalf("with data %v, without %v", withData, withoutData)
+	}
+}
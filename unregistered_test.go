@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/autobrr/go-qbittorrent"
+)
+
+/* a is unregistered, b is fine and c is unregistered on a tracker requiring two observations. */
+func unregisteredClient(t *testing.T) (*fakeClient, upgradereq) {
+	t.Helper()
+	savedConfig := config
+	t.Cleanup(func() { config = savedConfig })
+	config = defaultConfig()
+	config.Unregistered.Trackers = map[string]unregisteredRule{"slow.example": {Observations: 2}}
+	if err := config.compile(); err != nil {
+		t.Fatalf("compile: %q", err)
+	}
+
+	dead := func(tracker string) []qbittorrent.TorrentTracker {
+		return []qbittorrent.TorrentTracker{{Url: tracker, Status: qbittorrent.TrackerStatusNotWorking, Message: "Unregistered torrent"}}
+	}
+
+	f := &fakeClient{
+		live: map[string]qbittorrent.Torrent{
+			"a": {Name: "Show.Name.S01E01.1080p.WEB.h264-GRP", ContentPath: "/data/a", TrackersCount: 1},
+			"b": {Name: "Show.Name.S01E02.1080p.WEB.h264-GRP", ContentPath: "/data/b", TrackersCount: 1},
+			"c": {Name: "Movie.Name.2020.1080p.BluRay.x264-GRP", ContentPath: "/data/c", TrackersCount: 1},
+		},
+		trackers: map[string][]qbittorrent.TorrentTracker{
+			"a": dead("https://one.example/announce"),
+			"b": {{Url: "https://one.example/announce", Status: qbittorrent.TrackerStatusOK}},
+			"c": dead("https://tracker.slow.example/announce"),
+		},
+	}
+
+	return f, newFakeClient(t, f)
+}
+
+/* Calls changing torrents, leaving out logins and the reannounces done in the background. */
+func (f *fakeClient) mutations() []string {
+	f.m.Lock()
+	defer f.m.Unlock()
+	res := make([]string, 0)
+	for _, c := range f.calls {
+		if strings.HasPrefix(c, "torrents/") && !strings.HasPrefix(c, "torrents/reannounce") {
+			res = append(res, c)
+		}
+	}
+
+	return res
+}
+
+func TestUnregisteredObservations(t *testing.T) {
+	f, req := unregisteredClient(t)
+
+	/* A dry run reports what the next run would see without counting it. */
+	for i := 0; i < 2; i++ {
+		code, body := callHandler(t, handleUnregistered, req, map[string]any{"action": "test"})
+		if code != 200 {
+			t.Fatalf("test: %d %q", code, body)
+		}
+
+		var matches []unregisteredMatch
+		if err := json.Unmarshal([]byte(body), &matches); err != nil {
+			t.Fatalf("decode %q: %q", body, err)
+		}
+
+		got := make(map[string]unregisteredMatch)
+		for _, m := range matches {
+			got[m.Hash] = m
+		}
+
+		if len(got) != 2 || got["a"].Observed != 1 || got["a"].Required != 1 || got["c"].Observed != 1 || got["c"].Required != 2 {
+			t.Fatalf("test: %+v", matches)
+		}
+
+		if a := got["a"]; a.Pattern != "unregistered" || a.Message != "Unregistered torrent" || a.Tracker != "https://one.example/announce" || a.Name != f.live["a"].Name {
+			t.Fatalf("test: %+v", a)
+		}
+	}
+
+	if m := f.mutations(); len(m) != 0 {
+		t.Fatalf("dry run changed torrents: %q", m)
+	}
+
+	/* c is seen once, a is deleted right away. */
+	code, body := callHandler(t, handleUnregistered, req, map[string]any{})
+	if code != 200 || body != "Unregistered torrents deleted: 1" {
+		t.Fatalf("first run: %d %q", code, body)
+	}
+
+	if !f.called("torrents/delete", url.Values{"hashes": {"a"}, "deleteFiles": {"false"}}) || len(f.mutations()) != 1 {
+		t.Fatalf("first run: %q", f.mutations())
+	}
+
+	f.m.Lock()
+	f.trackers["a"] = f.trackers["b"]
+	f.m.Unlock()
+
+	code, body = callHandler(t, handleUnregistered, req, map[string]any{"action": "test"})
+	if code != 200 || !strings.Contains(body, `"Observed":2,"Required":2`) {
+		t.Fatalf("test after first run: %d %q", code, body)
+	}
+
+	/* The second observation of c acts on it. */
+	code, body = callHandler(t, handleUnregistered, req, map[string]any{"action": "delete"})
+	if code != 200 || body != "Unregistered torrents deleted: 1" {
+		t.Fatalf("second run: %d %q", code, body)
+	}
+
+	if !f.called("torrents/delete", url.Values{"hashes": {"c"}, "deleteFiles": {"false"}}) || len(f.mutations()) != 2 {
+		t.Fatalf("second run: %q", f.mutations())
+	}
+
+	/* A working tracker resets the count. */
+	f.m.Lock()
+	f.trackers["c"] = f.trackers["b"]
+	f.m.Unlock()
+	callHandler(t, handleUnregistered, req, map[string]any{})
+	if _, ok := unregisteredmap.Get(req.Host + "|c"); ok {
+		t.Fatalf("observations kept for a working torrent")
+	}
+}
+
+func TestUnregisteredActions(t *testing.T) {
+	for _, tc := range []struct {
+		body  map[string]any
+		code  int
+		reply string
+		calls []string
+	}{
+		{map[string]any{"action": "deletedata"}, 200, "Unregistered torrents processed (deletedata): 1 (1 with data, 0 without data still in use) (1 pending observation, 0 failed to inspect)", []string{"torrents/delete deleteFiles=true&hashes=a"}},
+		{map[string]any{"action": "pause"}, 200, "Unregistered torrents processed (pause): 1 (1 pending observation, 0 failed to inspect)", []string{"torrents/stop hashes=a"}},
+		{map[string]any{"action": " Tag "}, 200, "Unregistered torrents processed (tag): 1 (1 pending observation, 0 failed to inspect)", []string{"torrents/addTags hashes=a&tags=unregistered"}},
+		{map[string]any{"action": "category", "subject": "dead"}, 200, "Unregistered torrents processed (category): 1 (1 pending observation, 0 failed to inspect)", []string{"torrents/createCategory category=dead&savePath=", "torrents/setCategory category=dead&hashes=a"}},
+		{map[string]any{"action": "nuke"}, 472, `Unknown action: "nuke"`, nil},
+	} {
+		f, req := unregisteredClient(t)
+		code, body := callHandler(t, handleUnregistered, req, tc.body)
+		if code != tc.code || body != tc.reply {
+			t.Fatalf("%v: %d %q", tc.body, code, body)
+		}
+
+		if got := f.mutations(); strings.Join(got, "\n") != strings.Join(tc.calls, "\n") {
+			t.Fatalf("%v: calls %q, want %q", tc.body, got, tc.calls)
+		}
+	}
+}
+
+func TestUnregisteredFailures(t *testing.T) {
+	f, req := unregisteredClient(t)
+	f.m.Lock()
+	delete(f.trackers, "b")
+	f.m.Unlock()
+
+	code, body := callHandler(t, handleUnregistered, req, map[string]any{"action": "tag"})
+	if code != 200 || body != "Unregistered torrents processed (tag): 1 (1 pending observation, 1 failed to inspect)" {
+		t.Fatalf("missing trackers: %d %q", code, body)
+	}
+
+	/* A request given up by its caller inspects nothing and leaves the observations alone. */
+	buf, _ := json.Marshal(map[string]any{"host": req.Host, "action": "tag"})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	rec := httptest.NewRecorder()
+	handleUnregistered(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(buf)).WithContext(ctx))
+	if body := strings.TrimSpace(rec.Body.String()); rec.Code != 200 || body != "Unregistered torrents processed (tag): 0 (0 pending observation, 3 failed to inspect)" {
+		t.Fatalf("cancelled: %d %q", rec.Code, body)
+	}
+
+	if seen, _ := unregisteredmap.Get(req.Host + "|c"); seen != 1 {
+		t.Fatalf("observations of c changed to %d", seen)
+	}
+
+	if m := f.mutations(); len(m) != 1 {
+		t.Fatalf("cancelled request changed torrents: %q", m)
+	}
+}